@@ -0,0 +1,90 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Cancellation of transactions.
+
+// Canceller is an optional interface for an RM, to clean up when a transaction with an operation for it is cancelled.
+type Canceller interface {
+	Cancelled(id TxId, opType int, op Op) // operation that will not be executed
+}
+
+// Cancel abandons an extended transaction, or stops a recurring operation. Its operations held in this server are discarded,
+// its redo log entry is deleted, and each resource manager with an operation for it is notified, if it implements Canceller.
+// Like End, it must be called within a store transaction, followed by DoNext after commit if the transaction is a linked child.
+// Linked children and transactions started by BeginNext are not cancelled.
+// An operation already executing is not interrupted, so an RM should expect a later call to End to fail with ErrEnded.
+func (tm *TM) Cancel(id TxId) error {
+
+	r, err := tm.store.GetIf(int64(id))
+	if err != nil {
+		return err
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+
+	// pending operations, keeping any for transactions started by BeginNext
+	var ops []*nextOp
+	if next := tm.next[id]; next != nil {
+		keep := next[:0]
+		for _, op := range next {
+			if op.id == id {
+				ops = append(ops, op)
+			} else {
+				keep = append(keep, op)
+			}
+		}
+		if len(keep) > 0 {
+			tm.next[id] = keep
+		} else {
+			delete(tm.next, id)
+		}
+	}
+	for name, held := range tm.held {
+		keep := held[:0]
+		for _, op := range held {
+			if op.id == id {
+				ops = append(ops, op)
+			} else {
+				keep = append(keep, op)
+			}
+		}
+		tm.held[name] = keep
+	}
+	ops = append(ops, tm.waiting[id]...)
+	delete(tm.attempts, id)
+	tm.stopRecurring(id)
+
+	// the logged operation, usually the same as one held, and possibly for an RM known only from Recover
+	var logged RM
+	if r != nil && len(ops) == 0 {
+		logged = tm.rms[r.Manager]
+	}
+	tm.mu.Unlock()
+
+	if r != nil {
+		if err := tm.store.DeleteId(int64(id)); err != nil {
+			return err
+		}
+	}
+	tm.forget(id)
+
+	// notify resource managers
+	if logged != nil {
+		op, err := forOperation(logged, r)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &nextOp{id: id, rm: logged, opType: r.OpType, op: op})
+	}
+	for _, op := range ops {
+		if c, ok := op.rm.(Canceller); ok {
+			c.Cancelled(id, op.opType, op.op)
+		}
+	}
+
+	// parent of a linked transaction
+	tm.endLinked(r)
+	return nil
+}
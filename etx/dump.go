@@ -0,0 +1,173 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Readable export and import of the redo log, for operators.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// States of exported transactions.
+const (
+	StateLogged  = "logged"  // in the redo log, and executed or awaiting a timeout
+	StatePending = "pending" // operation set, but DoNext not yet called
+	StateHeld    = "held"    // held while the resource manager is paused or overloaded
+	StateWaiting = "waiting" // waiting for linked child transactions to end
+)
+
+// Dump is a readable copy of the redo log.
+type Dump struct {
+	Exported time.Time    `json:"exported"`
+	Redo     []*DumpEntry `json:"redo"`
+}
+
+// DumpEntry is a redo log entry, with its operation data as JSON.
+type DumpEntry struct {
+	Id        string          `json:"id"`      // transaction ID, as formatted by String
+	Started   time.Time       `json:"started"` // from transaction ID, for information only
+	State     string          `json:"state"`   // for information only
+	Manager   string          `json:"manager"`
+	OpType    int             `json:"opType"`
+	Version   int             `json:"version,omitempty"`
+	Operation json.RawMessage `json:"operation"`
+	Trace     string          `json:"trace,omitempty"`
+	Parent    string          `json:"parent,omitempty"`
+	Every     string          `json:"every,omitempty"` // interval for a recurring operation, such as "24h0m0s"
+}
+
+// Export writes the redo log as an indented JSON document, with the state of each transaction in this server.
+func (tm *TM) Export(w io.Writer) error {
+
+	// in-memory states
+	states := make(map[TxId]string)
+
+	// SERIALISED
+	tm.mu.Lock()
+	for _, ops := range tm.next {
+		for _, op := range ops {
+			states[op.id] = StatePending
+		}
+	}
+	for _, ops := range tm.held {
+		for _, op := range ops {
+			states[op.id] = StateHeld
+		}
+	}
+	for id := range tm.waiting {
+		states[id] = StateWaiting
+	}
+	tm.mu.Unlock()
+
+	d := Dump{Exported: time.Now()}
+	for _, r := range tm.store.All() {
+		id := TxId(r.Id)
+
+		op := json.RawMessage(r.Operation)
+		if !json.Valid(op) {
+			return fmt.Errorf("etx: invalid operation data for %s", String(id))
+		}
+
+		e := &DumpEntry{
+			Id:        String(id),
+			Started:   Timestamp(id),
+			State:     states[id],
+			Manager:   r.Manager,
+			OpType:    r.OpType,
+			Version:   r.Version,
+			Operation: op,
+			Trace:     r.Trace,
+		}
+		if e.State == "" {
+			e.State = StateLogged
+		}
+		if r.Parent != 0 {
+			e.Parent = String(TxId(r.Parent))
+		}
+		if r.Every != 0 {
+			e.Every = r.Every.String()
+		}
+		d.Redo = append(d.Redo, e)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Import adds redo log entries from a document written by Export, returning the number of entries added or replaced.
+// Existing entries are replaced only if replace is true.
+// Imported operations are not executed until Recover or Timeout is called, so typically import is followed by a restart.
+// The application must start a database transaction for the store, if needed.
+func (tm *TM) Import(r io.Reader, replace bool) (int, error) {
+
+	var d Dump
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return 0, err
+	}
+
+	// validate all entries before changing anything
+	redo := make([]*Redo, 0, len(d.Redo))
+	for _, e := range d.Redo {
+		id, err := Id(e.Id)
+		if err != nil || id == 0 {
+			return 0, fmt.Errorf("etx: invalid transaction ID %q", e.Id)
+		}
+		var op bytes.Buffer
+		if e.Manager == "" || json.Compact(&op, e.Operation) != nil {
+			return 0, fmt.Errorf("etx: invalid operation for %s", e.Id)
+		}
+
+		t := &Redo{
+			Id:        int64(id),
+			Manager:   e.Manager,
+			OpType:    e.OpType,
+			Operation: op.Bytes(),
+			Trace:     e.Trace,
+			Version:   e.Version,
+		}
+		if e.Parent != "" {
+			if !tm.linked {
+				return 0, fmt.Errorf("etx: linked transactions not enabled, for %s", e.Id)
+			}
+			parent, err := Id(e.Parent)
+			if err != nil {
+				return 0, fmt.Errorf("etx: invalid parent ID %q for %s", e.Parent, e.Id)
+			}
+			t.Parent = int64(parent)
+		}
+		if e.Every != "" {
+			every, err := time.ParseDuration(e.Every)
+			if err != nil || every <= 0 {
+				return 0, fmt.Errorf("etx: invalid interval %q for %s", e.Every, e.Id)
+			}
+			t.Every = every
+		}
+		redo = append(redo, t)
+	}
+
+	var n int
+	for _, t := range redo {
+		current, err := tm.store.GetIf(t.Id)
+		if err != nil {
+			return n, err
+		}
+
+		if current == nil {
+			err = tm.store.Insert(t)
+		} else if replace {
+			err = tm.store.Update(t)
+		} else {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,95 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Checks on the misuse of End.
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+)
+
+// maxEnded is the number of ended transactions remembered, to detect a second call to End.
+const maxEnded = 1024
+
+var (
+	ErrEnded     = errors.New("etx: transaction already ended")
+	ErrNoStoreTx = errors.New("etx: End called outside a store transaction")
+)
+
+// TxStore is an optional interface for a RedoStore, to check that End is called within a database transaction.
+// Typically a call outside a transaction is from the wrong goroutine, such as a worker that did not start one.
+type TxStore interface {
+	InTransaction() bool // true if the caller's database transaction has been started
+}
+
+// EndError reports a misuse of End, with the transaction and the caller.
+type EndError struct {
+	Id     TxId
+	Caller string // file and line
+	Err    error  // ErrEnded or ErrNoStoreTx
+}
+
+func (e *EndError) Error() string {
+	return fmt.Sprintf("%s (transaction %s, End called from %s)", e.Err.Error(), String(e.Id), e.Caller)
+}
+
+func (e *EndError) Unwrap() error {
+	return e.Err
+}
+
+// checkEnd returns an error if End should not be called for a transaction.
+// A missing redo entry for a transaction not known to have ended here is not an error,
+// because it may have ended before a restart and its operation been redone.
+func (tm *TM) checkEnd(id TxId, r *Redo) error {
+
+	var err error
+	if ts, ok := tm.store.(TxStore); ok && !ts.InTransaction() {
+		err = ErrNoStoreTx
+
+	} else if r == nil {
+		// SERIALISED
+		tm.mu.Lock()
+		ended := tm.ended[id]
+		tm.mu.Unlock()
+
+		if ended {
+			err = ErrEnded
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	// caller of End
+	caller := "unknown"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	e := &EndError{Id: id, Caller: caller, Err: err}
+	if tm.app != nil {
+		tm.app.Log(e)
+	}
+	return e
+}
+
+// forget removes the held operations for an ended transaction, and remembers that it has ended.
+// Operations set for other transactions started by BeginNext are kept, for DoNext.
+func (tm *TM) forget(id TxId) {
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	delete(tm.waiting, id)
+
+	if len(tm.endedOrder) >= maxEnded {
+		delete(tm.ended, tm.endedOrder[0])
+		tm.endedOrder = tm.endedOrder[1:]
+	}
+	tm.ended[id] = true
+	tm.endedOrder = append(tm.endedOrder, id)
+}
@@ -18,7 +18,7 @@ import (
 // App is the interface to functions provided by the parent application.
 type App interface {
 	// Log optionally records an error
-	Log(error) // ## not used
+	Log(error) // such as misuse of End
 }
 
 // Extended transaction identifier
@@ -33,6 +33,15 @@ type RM interface {
 	Operation(id TxId, opType int, op Op) // operation for execution
 }
 
+// Upgrader is an optional interface for an RM that changes the data for its operations.
+// Redo records saved by an earlier version are upgraded when read, instead of failing to unmarshal.
+type Upgrader interface {
+	OpVersion() int // current version of operation data (initially 0)
+
+	// Upgrade converts the JSON data for an operation saved at an earlier version.
+	Upgrade(opType int, version int, data []byte) ([]byte, error)
+}
+
 // Op is the interface to an RM operation.
 // Operations must either be database transactions or idempotent.
 type Op interface {
@@ -44,6 +53,11 @@ type Redo struct {
 	Manager   string // resource manager name
 	OpType    int    // operation type
 	Operation []byte // operation arguments, in JSON
+	Trace     string // trace context, if operations are traced (optional for the store)
+	Version   int    // version of operation data (optional for the store, if no RM changes its data)
+	Parent    int64  // parent transaction ID, for a linked child (optional for the store, if links are not used)
+
+	Every time.Duration // interval for a recurring operation (optional for the store, if there are no recurring operations)
 }
 
 // RedoStore is the interface for storage of extended transactions, implemented by the parent application.
@@ -61,13 +75,44 @@ type RedoStore interface {
 // TM holds transaction manager state, and dependencies of this package on the parent application.
 // It has no state of its own.
 type TM struct {
-	app   App
-	store RedoStore
+	app    App
+	store  RedoStore
+	tracer Tracer
+	linked bool // transactions may have linked children
 
 	// state
-	mu     sync.Mutex
-	next   map[TxId][]*nextOp
-	lastId TxId
+	mu      sync.Mutex
+	next    map[TxId][]*nextOp
+	traces  map[TxId]string
+	paused  map[string]bool      // RMs paused, by name
+	held    map[string][]*nextOp // operations held for paused or overloaded RMs
+	waiting map[TxId][]*nextOp   // operations held for linked children
+	lastId  TxId
+
+	// RMs overloaded, with the end of the period for which their operations are held
+	overloaded map[string]time.Time
+
+	// parents of ended linked children, to be released by DoNext for the children
+	releases map[TxId]TxId
+
+	// recently ended transactions, oldest first
+	ended      map[TxId]bool
+	endedOrder []TxId
+
+	// last recovery, for health checks
+	recovered time.Time
+	recovery  time.Duration
+
+	// retries of failed operations, with attempts so far by transaction
+	retryAttempts int
+	retryAfter    time.Duration
+	attempts      map[TxId]retrying
+
+	// resource managers by name, as known from Recover and SetNext
+	rms map[string]RM
+
+	// timers for recurring operations
+	recurring map[TxId]*time.Timer
 }
 
 // next caches the next operation for a transaction
@@ -76,6 +121,7 @@ type nextOp struct {
 	rm     RM
 	opType int
 	op     Op
+	trace  string
 }
 
 // New initialises the transaction manager and recovers all logged operations.
@@ -83,10 +129,25 @@ type nextOp struct {
 func New(app App, store RedoStore) *TM {
 
 	return &TM{
-		app:   app,
-		store: store,
-		mu:    sync.Mutex{},
-		next:  make(map[TxId][]*nextOp, 8),
+		app:     app,
+		store:   store,
+		mu:      sync.Mutex{},
+		next:    make(map[TxId][]*nextOp, 8),
+		traces:  make(map[TxId]string),
+		paused:  make(map[string]bool),
+		held:    make(map[string][]*nextOp),
+		waiting: make(map[TxId][]*nextOp),
+
+		overloaded: make(map[string]time.Time),
+		ended:      make(map[TxId]bool),
+		releases:   make(map[TxId]TxId),
+
+		retryAttempts: retryAttempts,
+		retryAfter:    retryAfter,
+		attempts:      make(map[TxId]retrying),
+
+		rms:       make(map[string]RM),
+		recurring: make(map[TxId]*time.Timer),
 	}
 }
 
@@ -115,9 +176,30 @@ func (tm *TM) BeginNext(first TxId, rm RM, opType int, op Op) error {
 }
 
 // End terminates and forgets the transaction.
+// It must be called within the store transaction for the final operation.
+// For a linked child, call DoNext after the store transaction has been committed, to execute operations held for the parent.
+// Misuse, such as a second call for the same transaction, is logged and returned as an EndError.
 func (tm *TM) End(id TxId) error {
 
-	return tm.store.DeleteId(int64(id))
+	// discard any unused trace context
+	tm.traceFor(id)
+
+	r, err := tm.store.GetIf(int64(id))
+	if err != nil {
+		return err
+	}
+	if err := tm.checkEnd(id, r); err != nil {
+		return err
+	}
+
+	if err := tm.store.DeleteId(int64(id)); err != nil {
+		return err
+	}
+	tm.forget(id)
+
+	// parent of a linked transaction
+	tm.endLinked(r)
+	return nil
 }
 
 // Id returns a transaction identifier from its string reresentation.
@@ -126,6 +208,16 @@ func Id(s string) (TxId, error) {
 	return TxId(id), err
 }
 
+// Pause holds operations for a resource manager, for example while its storage is being migrated.
+// Other resource managers continue. Held operations remain in the redo log, so they are not lost on a restart.
+func (tm *TM) Pause(rm RM) {
+
+	// SERIALISED
+	tm.mu.Lock()
+	tm.paused[rm.Name()] = true
+	tm.mu.Unlock()
+}
+
 // Recover reads and processes the redo log, to complete interrupted transactions after a server restart.
 func (tm *TM) Recover(mgrs ...RM) error {
 
@@ -135,7 +227,15 @@ func (tm *TM) Recover(mgrs ...RM) error {
 		rms[rm.Name()] = rm
 	}
 
+	// SERIALISED
+	tm.mu.Lock()
+	for name, rm := range rms {
+		tm.rms[name] = rm
+	}
+	tm.mu.Unlock()
+
 	// recover using transaction log
+	start := time.Now()
 	ts := tm.store.All()
 	for _, t := range ts {
 		// RM and operation
@@ -143,25 +243,54 @@ func (tm *TM) Recover(mgrs ...RM) error {
 		if rm == nil {
 			return errors.New("Missing resource manager")
 		}
-		op := rm.ForOperation(t.OpType)
-		if err := json.Unmarshal(t.Operation, op); err != nil {
+		op, err := forOperation(rm, t)
+		if err != nil {
 			return err
 		}
 
-		// redo operation
-		rm.Operation(TxId(t.Id), t.OpType, op)
+		// reschedule recurring operation, or redo operation
+		if t.Every != 0 {
+			tm.schedule(rm, t, op)
+		} else {
+			tm.operation(t.Trace, rm, TxId(t.Id), t.OpType, op)
+		}
 	}
 
+	// SERIALISED
+	tm.mu.Lock()
+	tm.recovered = time.Now()
+	tm.recovery = tm.recovered.Sub(start)
+	tm.mu.Unlock()
+
 	return nil
 }
 
+// Resume executes any operations held for a resource manager, in order, and continues normal operation.
+func (tm *TM) Resume(rm RM) {
+
+	// SERIALISED
+	tm.mu.Lock()
+	delete(tm.paused, rm.Name())
+	if tm.holding(rm.Name()) {
+		tm.mu.Unlock()
+		return // still overloaded
+	}
+	ops := tm.held[rm.Name()]
+	delete(tm.held, rm.Name())
+	tm.mu.Unlock()
+
+	for _, op := range ops {
+		tm.operation(op.trace, op.rm, op.id, op.opType, op.op)
+	}
+}
+
 // SetNext sets or updates the next operation for an extended transaction.
 // Database changes may have been requested, but must not be commmitted yet.
 func (tm *TM) SetNext(id TxId, rm RM, opType int, op Op) error {
 	return tm.setNext(id, id, rm, opType, op)
 }
 
-// DoNext executes the operation specified in SetNext.
+// DoNext executes the operation specified in SetNext, and for a linked child ended by End, any operations held for its parent.
 // It must be called after database changes have been committed.
 func (tm *TM) DoNext(id TxId) {
 
@@ -171,13 +300,20 @@ func (tm *TM) DoNext(id TxId) {
 	// operations from SetNext and AlsoNext
 	ops := tm.next[id]
 	delete(tm.next, id)
+
+	// parent of an ended child
+	parent := tm.releases[id]
+	delete(tm.releases, id)
 	tm.mu.Unlock()
 
 	if ops != nil {
 		for _, op := range ops {
-			op.rm.Operation(op.id, op.opType, op.op)
+			tm.operation(op.trace, op.rm, op.id, op.opType, op.op)
 		}
 	}
+	if parent != 0 {
+		tm.release(parent)
+	}
 }
 
 // String formats a transaction ID.
@@ -185,32 +321,105 @@ func String(id TxId) string {
 	return strconv.FormatInt(int64(id), 36)
 }
 
-// 	Timestamp returns the start time of an extended transaction.
+// Timestamp returns the start time of an extended transaction.
 func Timestamp(id TxId) time.Time {
 	return time.Unix(0, int64(id)) // transaction ID is also a timestamp
 }
 
-// Timeout executes any old operations for a resource manager.
+// Timeout executes any old operations for a resource manager, except recurring operations.
 // A non-zero opType selects the specified type.
 func (tm *TM) Timeout(rm RM, opType int, before time.Time) error {
 
+	// operations for a paused or overloaded RM will be found on a later timeout
+	if tm.isPaused(rm) {
+		return nil
+	}
+
 	// recover using transaction log
 	ts := tm.store.ForManager(rm.Name(), before.UnixNano())
 	for _, t := range ts {
-		if opType == 0 || t.OpType == opType {
+		if t.Every == 0 && (opType == 0 || t.OpType == opType) {
 			// operation
-			op := rm.ForOperation(t.OpType)
-			if err := json.Unmarshal(t.Operation, op); err != nil {
+			op, err := forOperation(rm, t)
+			if err != nil {
 				return err
 			}
 
 			// do operation
-			rm.Operation(TxId(t.Id), t.OpType, op)
+			tm.operation(t.Trace, rm, TxId(t.Id), t.OpType, op)
 		}
 	}
 	return nil
 }
 
+// forOperation returns the operation for a redo record, upgrading its data if needed.
+func forOperation(rm RM, t *Redo) (Op, error) {
+
+	data := t.Operation
+	if u, ok := rm.(Upgrader); ok && t.Version < u.OpVersion() {
+		var err error
+		if data, err = u.Upgrade(t.OpType, t.Version, data); err != nil {
+			return nil, err
+		}
+	}
+
+	op := rm.ForOperation(t.OpType)
+	if err := json.Unmarshal(data, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// isPaused returns true if operations for a resource manager are paused or deferred.
+func (tm *TM) isPaused(rm RM) bool {
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return tm.holding(rm.Name())
+}
+
+// operation executes an RM operation, or holds it if the RM is paused or overloaded, or the transaction has linked children.
+// If tracing is enabled, the operation is executed within a span.
+// Note that the span covers only the call to the RM, and not any processing it hands to a background worker.
+func (tm *TM) operation(carrier string, rm RM, id TxId, opType int, op Op) {
+
+	// SERIALISED
+	tm.mu.Lock()
+	if tm.holding(rm.Name()) {
+		tm.held[rm.Name()] = append(tm.held[rm.Name()], &nextOp{id: id, rm: rm, opType: opType, op: op, trace: carrier})
+		tm.mu.Unlock()
+		return
+	}
+	tm.mu.Unlock()
+
+	// wait for linked children
+	if tm.linked && tm.hasChildren(id) {
+		tm.mu.Lock()
+		tm.waiting[id] = append(tm.waiting[id], &nextOp{id: id, rm: rm, opType: opType, op: op, trace: carrier})
+		tm.mu.Unlock()
+
+		// children may have ended meanwhile
+		tm.release(id)
+		return
+	}
+
+	if tm.tracer != nil {
+		defer tm.tracer.Start(carrier, rm.Name(), opType)()
+	}
+	tm.execute(carrier, rm, id, opType, op)
+}
+
+// opVersion returns the current version of operation data for an RM.
+func opVersion(rm RM) int {
+
+	if u, ok := rm.(Upgrader); ok {
+		return u.OpVersion()
+	}
+	return 0
+}
+
 // setNext saves the logged redo entry for an operation, and adds it to the list for DoNext.
 func (tm *TM) setNext(head TxId, id TxId, rm RM, opType int, op Op) error {
 
@@ -222,12 +431,13 @@ func (tm *TM) setNext(head TxId, id TxId, rm RM, opType int, op Op) error {
 	}
 	if r == nil {
 		add = true
-		r = &Redo{Id: int64(id)}
+		r = &Redo{Id: int64(id), Trace: tm.traceFor(id)}
 	}
 
 	// set the next operation
 	r.Manager = rm.Name()
 	r.OpType = opType
+	r.Version = opVersion(rm)
 	r.Operation, err = json.Marshal(op)
 	if err != nil {
 		return err
@@ -237,21 +447,29 @@ func (tm *TM) setNext(head TxId, id TxId, rm RM, opType int, op Op) error {
 		rm:     rm,
 		opType: opType,
 		op:     op,
+		trace:  r.Trace,
 	}
 
 	// SERIALISED
 	tm.mu.Lock()
 
+	tm.rms[rm.Name()] = rm
 	if tm.next[head] == nil {
 		// save the first operation, for execution ..
 		tm.next[head] = make([]*nextOp, 1, 4)
 		tm.next[head][0] = nxt
-	} else if id == head {
-		// update the operation
-		tm.next[head][0] = nxt
 	} else {
-		// add an operation
-		tm.next[head] = append(tm.next[head], nxt)
+		// update the operation for the transaction, or add one
+		ops := tm.next[head]
+		i := 0
+		for i < len(ops) && ops[i].id != id {
+			i++
+		}
+		if i < len(ops) {
+			ops[i] = nxt
+		} else {
+			tm.next[head] = append(ops, nxt)
+		}
 	}
 
 	tm.mu.Unlock()
@@ -0,0 +1,170 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Append-only file redo log.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileStore is an implementation of RedoStore in an append-only file, for tools and small deployments without a database.
+// Each change is appended and synced before it returns, so it survives a crash, and the file is compacted
+// when most of its records are obsolete. The log is held in memory as well.
+// As for MemStore, changes are not atomic with any other storage used by an application, so RMs should use idempotent operations.
+type FileStore struct {
+	*MemStore
+	path    string
+	f       *os.File
+	records int // records in the file
+}
+
+// fileRecord is a change to the log, as a line of JSON.
+type fileRecord struct {
+	Delete int64 `json:",omitempty"` // ID of deleted entry
+	Redo   *Redo `json:",omitempty"` // added or updated entry
+}
+
+// NewFileStore returns a redo store, reloaded from the file if it exists.
+// A partial record at the end of the file, from a crash while writing, is ignored.
+func NewFileStore(path string) (*FileStore, error) {
+
+	ms, _ := NewMemStore("") // no error without a snapshot
+	s := &FileStore{MemStore: ms, path: path}
+
+	// replay the log
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			var rec fileRecord
+			if json.Unmarshal(sc.Bytes(), &rec) != nil {
+				break // incomplete
+			}
+			if rec.Redo != nil {
+				ms.redos[rec.Redo.Id] = *rec.Redo
+			} else {
+				delete(ms.redos, rec.Delete)
+			}
+			s.records++
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// start with a compacted file, which also drops any partial record
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the file.
+func (s *FileStore) Close() error {
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// DeleteId deletes a redo log entry.
+func (s *FileStore) DeleteId(id int64) error {
+	return s.append(fileRecord{Delete: id})
+}
+
+// Insert adds a log entry.
+func (s *FileStore) Insert(r *Redo) error {
+	return s.Update(r)
+}
+
+// Update replaces a log entry.
+func (s *FileStore) Update(r *Redo) error {
+	c := *r
+	return s.append(fileRecord{Redo: &c})
+}
+
+// append writes a change to the file, and then applies it to the log in memory.
+func (s *FileStore) append(rec fileRecord) error {
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err = s.f.Write(append(data, '\n')); err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	s.records++
+
+	if rec.Redo != nil {
+		s.redos[rec.Redo.Id] = *rec.Redo
+	} else {
+		delete(s.redos, rec.Delete)
+	}
+
+	// rewrite the file when it is mostly obsolete
+	if s.records > 2*len(s.redos)+100 {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact replaces the file with one holding just the current log entries.
+// The new file is complete before it replaces the old one. It must be called with the store locked, except on creation.
+func (s *FileStore) compact() error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, r := range s.redos {
+		c := r
+		data, err := json.Marshal(fileRecord{Redo: &c})
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// continue appending to the new file
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = tmp
+	s.records = len(s.redos)
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Health summary of extended transactions, for readiness probes.
+
+import (
+	"fmt"
+	"time"
+)
+
+// Health summarises the state of transaction processing.
+type Health struct {
+	Pending int // transactions with operations set but not yet started
+	Waiting int // operations waiting for linked child transactions
+	Held    int // operations held for paused or overloaded resource managers
+	Retries int // failed operations waiting to be retried
+	Logged  int // entries in the redo log
+
+	OldestPending time.Duration // age of the oldest pending or held operation
+	OldestLogged  time.Duration // age of the oldest entry in the redo log
+
+	Recovered    time.Time     // when recovery last completed (zero if not yet)
+	LastRecovery time.Duration // time taken by the last recovery
+}
+
+// Health returns a summary of the backlog of operations, suitable for a readiness probe.
+func (tm *TM) Health() Health {
+
+	var h Health
+	now := time.Now()
+
+	// redo log, read outside the lock
+	ts := tm.store.All()
+	h.Logged = len(ts)
+	for _, t := range ts {
+		if t.Every == 0 {
+			h.OldestLogged = now.Sub(Timestamp(TxId(t.Id)))
+			break // recurring operations are expected to be old
+		}
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	var oldest TxId
+	older := func(id TxId) {
+		if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+
+	h.Pending = len(tm.next)
+	for id := range tm.next {
+		older(id)
+	}
+	for _, ops := range tm.held {
+		h.Held += len(ops)
+		for _, o := range ops {
+			older(o.id)
+		}
+	}
+	for _, ops := range tm.waiting {
+		h.Waiting += len(ops)
+	}
+	h.Retries = len(tm.attempts)
+	if oldest != 0 {
+		h.OldestPending = now.Sub(Timestamp(oldest))
+	}
+
+	h.Recovered = tm.recovered
+	h.LastRecovery = tm.recovery
+
+	return h
+}
+
+// Check returns an error if the oldest pending operation is older than maxAge, or recovery has not completed.
+// It is intended for a server's readiness check.
+func (h Health) Check(maxAge time.Duration) error {
+
+	if h.Recovered.IsZero() {
+		return fmt.Errorf("etx: recovery not completed, %d operations logged", h.Logged)
+	}
+	if maxAge > 0 && h.OldestPending > maxAge {
+		return fmt.Errorf("etx: operation pending for %v, %d pending, %d held", h.OldestPending.Round(time.Second), h.Pending, h.Held)
+	}
+	return nil
+}
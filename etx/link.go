@@ -0,0 +1,141 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Transactions linked across transaction managers.
+
+import (
+	"errors"
+)
+
+// LinkStore is an extension to RedoStore, to find linked transactions. It is required for linked transactions.
+type LinkStore interface {
+	Children(parent int64) []*Redo // entries linked to a parent transaction
+}
+
+var (
+	errNoChild   = errors.New("etx: no redo entry for child transaction")
+	errNotLinked = errors.New("etx: linked transactions not enabled")
+	errNoLinks   = errors.New("etx: redo store does not implement LinkStore")
+)
+
+// Branch starts another extended transaction, with an operation executed after the first one, as for BeginNext,
+// and makes it a linked child of the first. Operations for the first transaction, set before or after,
+// then wait until all its branches have ended. For example, an operation to delete old files can wait for
+// separate image and video processing to complete. It returns the ID of the new transaction.
+// The TM must have called SetLinked, and the resource manager that ends each branch must call DoNext for it after committing.
+func (tm *TM) Branch(first TxId, rm RM, opType int, op Op) (TxId, error) {
+
+	if !tm.linked {
+		return 0, errNotLinked
+	}
+
+	id := tm.Begin()
+	if err := tm.setNext(first, id, rm, opType, op); err != nil {
+		return 0, err
+	}
+	return id, tm.Link(first, id)
+}
+
+// CheckLinked executes held operations for parent transactions whose linked children have ended.
+// Call it periodically if children may be ended by a different TM, such as another service sharing the database.
+func (tm *TM) CheckLinked() {
+
+	// SERIALISED
+	tm.mu.Lock()
+	ids := make([]TxId, 0, len(tm.waiting))
+	checked := make(map[TxId]bool, len(tm.waiting))
+	for id := range tm.waiting {
+		ids = append(ids, id)
+		checked[id] = true
+	}
+	tm.mu.Unlock()
+
+	for _, id := range ids {
+		tm.release(id)
+	}
+
+	// releases queued for parents that have now been released are not needed,
+	// but others may be for children not yet committed, or queued concurrently
+	tm.mu.Lock()
+	for child, parent := range tm.releases {
+		if _, held := tm.waiting[parent]; checked[parent] && !held {
+			delete(tm.releases, child)
+		}
+	}
+	tm.mu.Unlock()
+}
+
+// Link makes one transaction the child of another, which may belong to a different TM sharing the same redo store.
+// Operations for the parent are held until all of its children have ended.
+// The held operations are executed by DoNext for the last child, called after the store transaction for End has been committed.
+// Call it after SetNext for the child, so that the link is saved with the child's redo entry and recovered after a restart.
+// The TM for the parent must have called SetLinked.
+func (tm *TM) Link(parent TxId, child TxId) error {
+
+	r, err := tm.store.GetIf(int64(child))
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errNoChild
+	}
+
+	r.Parent = int64(parent)
+	return tm.store.Update(r)
+}
+
+// SetLinked enables linked transactions, so that operations wait for linked children. It must be called before Recover.
+// It returns an error if the redo store does not implement LinkStore.
+func (tm *TM) SetLinked() error {
+
+	if _, ok := tm.store.(LinkStore); !ok {
+		return errNoLinks
+	}
+	tm.linked = true
+	return nil
+}
+
+// endLinked notes the parent of a child transaction that has ended, so that DoNext for the child
+// can execute the parent's held operations, after the child's store transaction has been committed.
+func (tm *TM) endLinked(child *Redo) {
+
+	if child != nil && child.Parent != 0 {
+		// SERIALISED
+		tm.mu.Lock()
+		tm.releases[TxId(child.Id)] = TxId(child.Parent)
+		tm.mu.Unlock()
+	}
+}
+
+// children returns the linked children of a transaction that have not ended.
+func (tm *TM) children(id TxId) []*Redo {
+
+	if ls, ok := tm.store.(LinkStore); ok {
+		return ls.Children(int64(id))
+	}
+	return nil
+}
+
+// hasChildren returns true if a transaction has linked children that have not ended.
+func (tm *TM) hasChildren(id TxId) bool {
+	return len(tm.children(id)) > 0
+}
+
+// release executes the held operations for a parent transaction, if all its children have ended.
+func (tm *TM) release(id TxId) {
+
+	if tm.hasChildren(id) {
+		return
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+	ops := tm.waiting[id]
+	delete(tm.waiting, id)
+	tm.mu.Unlock()
+
+	for _, op := range ops {
+		tm.operation(op.trace, op.rm, op.id, op.opType, op.op)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// In-memory redo log.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// MemStore is an in-memory implementation of RedoStore, for tests and for small applications without a database.
+// If a snapshot file is specified, the log is saved to it after each change, and reloaded by NewMemStore.
+// Note that operations are not atomic with any other storage used by an application, so RMs should use idempotent operations.
+type MemStore struct {
+	mu       sync.Mutex
+	redos    map[int64]Redo
+	snapshot string // file path, or empty
+}
+
+// NewMemStore returns a redo store, reloaded from the snapshot file if specified and it exists.
+func NewMemStore(snapshot string) (*MemStore, error) {
+
+	s := &MemStore{
+		redos:    make(map[int64]Redo),
+		snapshot: snapshot,
+	}
+
+	if snapshot != "" {
+		data, err := ioutil.ReadFile(snapshot)
+		if err == nil {
+			var rs []Redo
+			if err = json.Unmarshal(data, &rs); err != nil {
+				return nil, err
+			}
+			for _, r := range rs {
+				s.redos[r.Id] = r
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// All returns all redo log entries in ID order.
+func (s *MemStore) All() []*Redo {
+	return s.selected(func(r *Redo) bool { return true })
+}
+
+// Children returns the log entries linked to a parent transaction.
+func (s *MemStore) Children(parent int64) []*Redo {
+	return s.selected(func(r *Redo) bool { return r.Parent == parent })
+}
+
+// DeleteId deletes a redo log entry.
+func (s *MemStore) DeleteId(id int64) error {
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.redos, id)
+	return s.save()
+}
+
+// ForManager returns the log entries for a resource manager, started before the specified time.
+func (s *MemStore) ForManager(rm string, before int64) []*Redo {
+	return s.selected(func(r *Redo) bool { return r.Manager == rm && r.Id < before })
+}
+
+// GetIf returns a log entry, or nil if it doesn't exist.
+func (s *MemStore) GetIf(id int64) (*Redo, error) {
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.redos[id]; ok {
+		return &r, nil
+	}
+	return nil, nil
+}
+
+// Insert adds a log entry.
+func (s *MemStore) Insert(r *Redo) error {
+	return s.Update(r)
+}
+
+// Update replaces a log entry.
+func (s *MemStore) Update(r *Redo) error {
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.redos[r.Id] = *r
+	return s.save()
+}
+
+// save writes the snapshot file, if any. It replaces the previous file only when the new one is complete.
+// It must be called with the store locked.
+func (s *MemStore) save() error {
+
+	if s.snapshot == "" {
+		return nil
+	}
+
+	rs := make([]Redo, 0, len(s.redos))
+	for _, r := range s.redos {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Id < rs[j].Id })
+
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.snapshot), filepath.Base(s.snapshot)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.snapshot)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// selected returns copies of the matching log entries, in ID order.
+func (s *MemStore) selected(match func(r *Redo) bool) []*Redo {
+
+	// SERIALISED
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs := make([]*Redo, 0, len(s.redos))
+	for _, r := range s.redos {
+		if match(&r) {
+			c := r
+			rs = append(rs, &c)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Id < rs[j].Id })
+	return rs
+}
@@ -0,0 +1,39 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Metrics for extended transactions.
+
+import (
+	"github.com/inchworks/webparts/metrics"
+)
+
+// Metrics implements metrics.Collector. It reports operations held in this server, not the size of the redo log.
+func (tm *TM) Metrics() []*metrics.Metric {
+
+	held := metrics.NewGauge("webparts_etx_held", "Operations held for paused or overloaded resource managers.")
+	overloaded := metrics.NewGauge("webparts_etx_overloaded", "Resource managers reporting overload (1) or not (0).")
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for rm, ops := range tm.held {
+		held.Add(float64(len(ops)), "manager", rm)
+	}
+	for rm := range tm.overloaded {
+		overloaded.Add(1, "manager", rm)
+	}
+
+	var waiting int
+	for _, ops := range tm.waiting {
+		waiting += len(ops)
+	}
+
+	return []*metrics.Metric{
+		metrics.NewGauge("webparts_etx_pending", "Transactions with operations set but not yet started.").Add(float64(len(tm.next))),
+		metrics.NewGauge("webparts_etx_waiting", "Operations waiting for linked child transactions.").Add(float64(waiting)),
+		held,
+		overloaded,
+	}
+}
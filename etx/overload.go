@@ -0,0 +1,71 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Backpressure from resource managers that are overloaded.
+
+import (
+	"time"
+)
+
+// Overloaded defers further operations for a resource manager for a period, for example when its work queue is full.
+// Deferred operations are held, and executed in order when the period ends, so that recovery or a burst of timeouts
+// cannot overwhelm the RM. A further call extends the period. Deferred operations remain in the redo log.
+// The RM must still handle any operation it is executing when it calls Overloaded, or leave it in the redo log for a later timeout.
+func (tm *TM) Overloaded(rm RM, period time.Duration) {
+
+	until := time.Now().Add(period)
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	current, ok := tm.overloaded[rm.Name()]
+	if ok {
+		if until.After(current) {
+			tm.overloaded[rm.Name()] = until // timer will be restarted for the remainder
+		}
+		return
+	}
+
+	tm.overloaded[rm.Name()] = until
+	time.AfterFunc(period, func() { tm.endOverload(rm) })
+}
+
+// endOverload executes operations deferred for a resource manager, unless it is still overloaded or is paused.
+func (tm *TM) endOverload(rm RM) {
+
+	// SERIALISED
+	tm.mu.Lock()
+
+	// period extended?
+	if remaining := time.Until(tm.overloaded[rm.Name()]); remaining > 0 {
+		time.AfterFunc(remaining, func() { tm.endOverload(rm) })
+		tm.mu.Unlock()
+		return
+	}
+	delete(tm.overloaded, rm.Name())
+
+	// held operations are left for Resume
+	if tm.paused[rm.Name()] {
+		tm.mu.Unlock()
+		return
+	}
+	ops := tm.held[rm.Name()]
+	delete(tm.held, rm.Name())
+	tm.mu.Unlock()
+
+	for _, op := range ops {
+		tm.operation(op.trace, op.rm, op.id, op.opType, op.op)
+	}
+}
+
+// holding returns true if operations for a resource manager must be held. It must be called with tm.mu locked.
+func (tm *TM) holding(name string) bool {
+
+	if tm.paused[name] {
+		return true
+	}
+	_, ok := tm.overloaded[name]
+	return ok
+}
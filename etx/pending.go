@@ -0,0 +1,102 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Listing of transactions in progress, for operators.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PendingTx summarises a transaction with operations held in this server.
+type PendingTx struct {
+	Id  TxId
+	Age time.Duration // since the transaction started
+
+	// operations by state
+	Pending  int // set, but DoNext not yet called
+	Held     int // held for a paused or overloaded resource manager
+	Waiting  int // waiting for linked child transactions
+	Retrying int // failed, and waiting to be retried
+}
+
+// Pending returns the transactions with operations held in memory, oldest first.
+// Operations that have been executed and are just in the redo log are not included; use Export to see those.
+func (tm *TM) Pending() []*PendingTx {
+
+	now := time.Now()
+	txs := make(map[TxId]*PendingTx)
+	get := func(id TxId) *PendingTx {
+		p := txs[id]
+		if p == nil {
+			p = &PendingTx{Id: id, Age: now.Sub(Timestamp(id))}
+			txs[id] = p
+		}
+		return p
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+	for id, ops := range tm.next {
+		get(id).Pending += len(ops)
+	}
+	for _, ops := range tm.held {
+		for _, op := range ops {
+			get(op.id).Held++
+		}
+	}
+	for id, ops := range tm.waiting {
+		get(id).Waiting += len(ops)
+	}
+	for id := range tm.attempts {
+		get(id).Retrying++
+	}
+	tm.mu.Unlock()
+
+	ps := make([]*PendingTx, 0, len(txs))
+	for _, p := range txs {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Id < ps[j].Id })
+	return ps
+}
+
+// PendingHandler returns an HTTP handler that lists pending transactions as JSON.
+// It has no access control, so the application must serve it only to operators.
+func (tm *TM) PendingHandler() http.Handler {
+
+	type entry struct {
+		Id       string    `json:"id"` // as formatted by String
+		Started  time.Time `json:"started"`
+		Age      string    `json:"age"`
+		Pending  int       `json:"pending,omitempty"`
+		Held     int       `json:"held,omitempty"`
+		Waiting  int       `json:"waiting,omitempty"`
+		Retrying int       `json:"retrying,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		es := []entry{}
+		for _, p := range tm.Pending() {
+			es = append(es, entry{
+				Id:       String(p.Id),
+				Started:  Timestamp(p.Id),
+				Age:      p.Age.Round(time.Second).String(),
+				Pending:  p.Pending,
+				Held:     p.Held,
+				Waiting:  p.Waiting,
+				Retrying: p.Retrying,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(es)
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Operations repeated at intervals, such as periodic maintenance.
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var errInterval = errors.New("etx: interval for recurring operation must be positive")
+
+// AddRecurring adds an operation that is executed at regular intervals, from now, and returns its transaction ID.
+// The operation is saved in the redo log, so that it continues after a restart, when it is rescheduled by Recover.
+// A run missed while the server was stopped is not repeated. The RM must not call End for the operation;
+// call Cancel to stop it. The application must start a database transaction for the store, if needed.
+func (tm *TM) AddRecurring(rm RM, opType int, op Op, every time.Duration) (TxId, error) {
+
+	if every <= 0 {
+		return 0, errInterval
+	}
+
+	id := tm.Begin()
+	r := &Redo{
+		Id:      int64(id),
+		Manager: rm.Name(),
+		OpType:  opType,
+		Version: opVersion(rm),
+		Every:   every,
+	}
+	var err error
+	if r.Operation, err = json.Marshal(op); err != nil {
+		return 0, err
+	}
+	if err = tm.store.Insert(r); err != nil {
+		return 0, err
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+	tm.rms[rm.Name()] = rm
+	tm.mu.Unlock()
+
+	tm.schedule(rm, r, op)
+	return id, nil
+}
+
+// schedule sets a timer for the next execution of a recurring operation, at a multiple of its interval from the start.
+func (tm *TM) schedule(rm RM, r *Redo, op Op) {
+
+	id := TxId(r.Id)
+	start := Timestamp(id)
+	next := start.Add(r.Every * (time.Since(start)/r.Every + 1))
+
+	t := time.AfterFunc(time.Until(next), func() {
+
+		// the operation may have been cancelled
+		current, err := tm.store.GetIf(int64(id))
+		if err != nil || current == nil || current.Every == 0 {
+			tm.mu.Lock()
+			delete(tm.recurring, id)
+			tm.mu.Unlock()
+			return
+		}
+
+		tm.operation(r.Trace, rm, id, r.OpType, op)
+		tm.schedule(rm, r, op)
+	})
+
+	// SERIALISED
+	tm.mu.Lock()
+	tm.recurring[id] = t
+	tm.mu.Unlock()
+}
+
+// stopRecurring stops the timer for a recurring operation, if there is one.
+// It must be called with the TM locked.
+func (tm *TM) stopRecurring(id TxId) {
+
+	if t := tm.recurring[id]; t != nil {
+		t.Stop()
+		delete(tm.recurring, id)
+	}
+}
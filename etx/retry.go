@@ -0,0 +1,107 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Retries of operations that fail.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Fallible is an optional interface for an RM whose operations may fail, to be retried by the TM.
+// If implemented, TryOperation is called instead of RM.Operation. An error is reported only for a failure
+// detected before TryOperation returns; an RM that completes an operation asynchronously must handle later failures itself.
+type Fallible interface {
+	TryOperation(id TxId, opType int, op Op) error
+}
+
+// retry defaults
+const (
+	retryAttempts = 5
+	retryAfter    = time.Second
+)
+
+// retrying is the state of a failed operation.
+type retrying struct {
+	n   int       // attempts so far
+	due time.Time // next attempt
+}
+
+// SetRetry sets the maximum number of attempts for a failed operation, and the delay before the first retry,
+// which doubles for each further attempt. The defaults are 5 attempts, starting after 1 second.
+// After the last attempt, the error is logged and the operation is left in the redo log, to be redone on recovery.
+func (tm *TM) SetRetry(maxAttempts int, after time.Duration) {
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.retryAttempts = maxAttempts
+	tm.retryAfter = after
+}
+
+// execute calls an RM operation, and schedules a retry if it fails.
+func (tm *TM) execute(carrier string, rm RM, id TxId, opType int, op Op) {
+
+	frm, ok := rm.(Fallible)
+	if !ok {
+		rm.Operation(id, opType, op)
+		return
+	}
+
+	// the operation as logged, before the RM might change it, to check that it has not been replaced before a retry
+	data, _ := json.Marshal(op) // no error, because SetNext has marshalled it
+	err := frm.TryOperation(id, opType, op)
+
+	// SERIALISED
+	tm.mu.Lock()
+	if err == nil {
+		delete(tm.attempts, id)
+		tm.mu.Unlock()
+		return
+	}
+	n := tm.attempts[id].n + 1
+	max, delay := tm.retryAttempts, retryDelay(tm.retryAfter, n)
+	if n >= max {
+		delete(tm.attempts, id)
+	} else {
+		tm.attempts[id] = retrying{n: n, due: time.Now().Add(delay)}
+	}
+	tm.mu.Unlock()
+
+	if n >= max {
+		if tm.app != nil {
+			tm.app.Log(fmt.Errorf("etx: operation %d for %s, transaction %s, failed after %d attempts: %w", opType, rm.Name(), String(id), n, err))
+		}
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+
+		// the transaction may have ended or moved on, such as by a timeout or a new SetNext
+		if r, err := tm.store.GetIf(int64(id)); err != nil || r == nil || r.Manager != rm.Name() || r.OpType != opType ||
+			!bytes.Equal(r.Operation, data) {
+			tm.mu.Lock()
+			delete(tm.attempts, id)
+			tm.mu.Unlock()
+			return
+		}
+		tm.operation(carrier, rm, id, opType, op)
+	})
+}
+
+// retryDelay returns the delay before a further attempt, doubling for each attempt up to a limit of one day.
+func retryDelay(after time.Duration, n int) time.Duration {
+
+	const limit = 24 * time.Hour
+	for i := 1; i < n && after < limit; i++ {
+		after *= 2
+	}
+	if after > limit {
+		after = limit
+	}
+	return after
+}
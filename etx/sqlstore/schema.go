@@ -0,0 +1,106 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package sqlstore
+
+// Table definitions and migrations.
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+// migrations are the changes for each schema version, from 1, by dialect.
+// Versions after the first add the columns needed by later features of etx.
+var migrations = [][2][]string{
+	{
+		// MySQL
+		{`CREATE TABLE IF NOT EXISTS redo (
+			id BIGINT NOT NULL PRIMARY KEY,
+			manager VARCHAR(60) NOT NULL,
+			optype INT NOT NULL,
+			operation BLOB NOT NULL)`},
+		// SQLite
+		{`CREATE TABLE IF NOT EXISTS redo (
+			id INTEGER NOT NULL PRIMARY KEY,
+			manager TEXT NOT NULL,
+			optype INTEGER NOT NULL,
+			operation BLOB NOT NULL)`},
+	},
+	{
+		{`ALTER TABLE redo ADD COLUMN trace VARCHAR(512) NOT NULL DEFAULT ''`},
+		{`ALTER TABLE redo ADD COLUMN trace TEXT NOT NULL DEFAULT ''`},
+	},
+	{
+		{`ALTER TABLE redo ADD COLUMN version INT NOT NULL DEFAULT 0`},
+		{`ALTER TABLE redo ADD COLUMN version INTEGER NOT NULL DEFAULT 0`},
+	},
+	{
+		{`ALTER TABLE redo ADD COLUMN parent BIGINT NOT NULL DEFAULT 0`,
+			`CREATE INDEX redo_parent ON redo (parent)`,
+			`CREATE INDEX redo_manager ON redo (manager, id)`},
+		{`ALTER TABLE redo ADD COLUMN parent INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX IF NOT EXISTS redo_parent ON redo (parent)`,
+			`CREATE INDEX IF NOT EXISTS redo_manager ON redo (manager, id)`},
+	},
+	{
+		{`ALTER TABLE redo ADD COLUMN every BIGINT NOT NULL DEFAULT 0`},
+		{`ALTER TABLE redo ADD COLUMN every INTEGER NOT NULL DEFAULT 0`},
+	},
+}
+
+// Migrate creates the redo table, or upgrades it to the current schema.
+// The schema version is held in a table named "redo_schema". Each upgrade is applied in its own transaction,
+// although MySQL commits table changes implicitly.
+func (s *Store) Migrate() error {
+
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS redo_schema (version INT NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM redo_schema`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = s.db.Exec(`INSERT INTO redo_schema (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for v := version; v < len(migrations); v++ {
+		if err := s.migrate(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Schema returns the statements to create the current redo table for a dialect, for applications that manage their own schema.
+func Schema(dialect int) []string {
+
+	var stmts []string
+	for _, m := range migrations {
+		stmts = append(stmts, m[dialect]...)
+	}
+	return stmts
+}
+
+// migrate applies the changes for a schema version.
+func (s *Store) migrate(v int) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range migrations[v][s.dialect] {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE redo_schema SET version = ` + strconv.Itoa(v+1)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,147 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+// Package sqlstore implements etx.RedoStore using database/sql, for MySQL or SQLite.
+//
+// The application supplies the database driver, and a function that returns its current database transaction,
+// so that redo records are written atomically with the resource managers' changes.
+// Call Migrate at startup to create or upgrade the table.
+package sqlstore
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Database dialects.
+const (
+	MySQL = iota
+	SQLite
+)
+
+// Store is a redo log held in an SQL database table.
+type Store struct {
+	db       *sql.DB
+	dialect  int
+	current  func() *sql.Tx // the application's current transaction, or nil
+	errorLog *log.Logger
+}
+
+// querier is implemented by both sql.DB and sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const (
+	table   = "redo"
+	columns = "id, manager, optype, operation, trace, version, parent, every"
+)
+
+// New returns a redo store for a database, using a table named "redo" (see Migrate).
+// current returns the application's database transaction in progress, or nil if there is none.
+// Errors reading the log, which the RedoStore interface cannot return, are written to errorLog.
+func New(db *sql.DB, dialect int, current func() *sql.Tx, errorLog *log.Logger) *Store {
+
+	return &Store{
+		db:       db,
+		dialect:  dialect,
+		current:  current,
+		errorLog: errorLog,
+	}
+}
+
+// All returns all redo log entries in ID order.
+func (s *Store) All() []*etx.Redo {
+	return s.selected("")
+}
+
+// Children returns the log entries linked to a parent transaction, implementing etx.LinkStore.
+func (s *Store) Children(parent int64) []*etx.Redo {
+	return s.selected("WHERE parent = ?", parent)
+}
+
+// DeleteId deletes a redo log entry.
+func (s *Store) DeleteId(id int64) error {
+
+	_, err := s.q().Exec("DELETE FROM "+table+" WHERE id = ?", id)
+	return err
+}
+
+// ForManager returns the log entries for a resource manager, started before the specified time.
+func (s *Store) ForManager(rm string, before int64) []*etx.Redo {
+	return s.selected("WHERE manager = ? AND id < ?", rm, before)
+}
+
+// GetIf returns a log entry, or nil if it doesn't exist.
+func (s *Store) GetIf(id int64) (*etx.Redo, error) {
+
+	r := &etx.Redo{}
+	err := s.q().QueryRow("SELECT "+columns+" FROM "+table+" WHERE id = ?", id).Scan(
+		&r.Id, &r.Manager, &r.OpType, &r.Operation, &r.Trace, &r.Version, &r.Parent, &r.Every)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// InTransaction returns true if the application has started a database transaction, implementing etx.TxStore.
+func (s *Store) InTransaction() bool {
+	return s.current != nil && s.current() != nil
+}
+
+// Insert adds a log entry.
+func (s *Store) Insert(r *etx.Redo) error {
+
+	_, err := s.q().Exec("INSERT INTO "+table+" ("+columns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		r.Id, r.Manager, r.OpType, r.Operation, r.Trace, r.Version, r.Parent, r.Every)
+	return err
+}
+
+// Update replaces a log entry.
+func (s *Store) Update(r *etx.Redo) error {
+
+	_, err := s.q().Exec("UPDATE "+table+" SET manager = ?, optype = ?, operation = ?, trace = ?, version = ?, parent = ?, every = ? WHERE id = ?",
+		r.Manager, r.OpType, r.Operation, r.Trace, r.Version, r.Parent, r.Every, r.Id)
+	return err
+}
+
+// q returns the current transaction if there is one, or the database.
+func (s *Store) q() querier {
+
+	if s.current != nil {
+		if tx := s.current(); tx != nil {
+			return tx
+		}
+	}
+	return s.db
+}
+
+// selected returns the matching log entries, in ID order.
+func (s *Store) selected(where string, args ...interface{}) []*etx.Redo {
+
+	rows, err := s.q().Query("SELECT "+columns+" FROM "+table+" "+where+" ORDER BY id", args...)
+	if err != nil {
+		s.errorLog.Print(err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	var rs []*etx.Redo
+	for rows.Next() {
+		r := &etx.Redo{}
+		if err := rows.Scan(&r.Id, &r.Manager, &r.OpType, &r.Operation, &r.Trace, &r.Version, &r.Parent, &r.Every); err != nil {
+			s.errorLog.Print(err.Error())
+			return rs
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		s.errorLog.Print(err.Error())
+	}
+	return rs
+}
@@ -0,0 +1,92 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Queries on the state of transactions.
+
+import (
+	"time"
+)
+
+// States of operations, in addition to those for Export.
+const (
+	StateRetrying  = "retrying"  // failed, and waiting to be retried
+	StateRecurring = "recurring" // executed at intervals
+)
+
+// Status is the state of an extended transaction, for example to tell a user that background processing is incomplete.
+type Status struct {
+	Active   bool      // true if the transaction has not ended
+	Started  time.Time // from the transaction ID
+	Children int       // linked child transactions not yet ended
+	Ops      []OpStatus
+}
+
+// OpStatus is an operation for a transaction that has not completed.
+type OpStatus struct {
+	Id      TxId      // transaction, which may be another started by BeginNext
+	Manager string    // resource manager name
+	OpType  int       // operation type
+	State   string    // StateLogged, StatePending, StateHeld, StateWaiting, StateRetrying or StateRecurring
+	Due     time.Time // time of the next attempt, for StateRetrying or StateRecurring
+}
+
+// Status returns the operations outstanding for a transaction, in this server and in the redo log.
+// An operation in StateLogged has been executed, or is awaiting a timeout if it was not completed,
+// and the resource manager determines when that is due.
+func (tm *TM) Status(id TxId) (Status, error) {
+
+	s := Status{Started: Timestamp(id)}
+
+	r, err := tm.store.GetIf(int64(id))
+	if err != nil {
+		return s, err
+	}
+
+	// SERIALISED
+	tm.mu.Lock()
+
+	inMemory := false
+	add := func(op *nextOp, state string) {
+		if op.id == id {
+			inMemory = true
+		}
+		s.Ops = append(s.Ops, OpStatus{Id: op.id, Manager: op.rm.Name(), OpType: op.opType, State: state})
+	}
+
+	for _, op := range tm.next[id] {
+		add(op, StatePending)
+	}
+	for _, ops := range tm.held {
+		for _, op := range ops {
+			if op.id == id {
+				add(op, StateHeld)
+			}
+		}
+	}
+	for _, op := range tm.waiting[id] {
+		add(op, StateWaiting)
+	}
+	retry, retrying := tm.attempts[id]
+	tm.mu.Unlock()
+
+	// logged operation, if not already listed
+	if r != nil && !inMemory {
+		o := OpStatus{Id: id, Manager: r.Manager, OpType: r.OpType, State: StateLogged}
+		if retrying {
+			o.State = StateRetrying
+			o.Due = retry.due
+		} else if r.Every != 0 {
+			o.State = StateRecurring
+			o.Due = s.Started.Add(r.Every * (time.Since(s.Started)/r.Every + 1))
+		}
+		s.Ops = append(s.Ops, o)
+	}
+	s.Active = r != nil || len(s.Ops) > 0
+
+	// linked children
+	if tm.linked {
+		s.Children = len(tm.children(id))
+	}
+	return s, nil
+}
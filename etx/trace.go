@@ -0,0 +1,54 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package etx
+
+// Optional tracing of operations.
+
+import (
+	"context"
+)
+
+// Tracer is an optional interface to trace the execution of operations, implemented by the parent application.
+// Typically it is a thin wrapper around OpenTelemetry, so that a slow sequence of asynchronous operations
+// can be linked to the web request that started the transaction.
+type Tracer interface {
+	// Carrier returns the trace context for a request, serialised for storage in the redo log.
+	Carrier(ctx context.Context) string
+
+	// Start begins a span for an operation, linked to the stored trace context, and returns a function to end the span.
+	// The carrier is empty if the transaction was not traced.
+	Start(carrier string, rm string, opType int) func()
+}
+
+// SetTracer specifies a tracer for operations. It must be called before Recover.
+func (tm *TM) SetTracer(t Tracer) {
+	tm.tracer = t
+}
+
+// Trace associates the trace context of a request with an extended transaction.
+// Call it after Begin, and before the first SetNext for the transaction.
+// The context is saved in the redo log, so it is kept if the transaction is recovered after a restart.
+func (tm *TM) Trace(ctx context.Context, id TxId) {
+
+	if tm.tracer == nil {
+		return
+	}
+	carrier := tm.tracer.Carrier(ctx)
+
+	// SERIALISED
+	tm.mu.Lock()
+	tm.traces[id] = carrier
+	tm.mu.Unlock()
+}
+
+// traceFor returns the trace context for a new redo log entry, and forgets the cached copy.
+func (tm *TM) traceFor(id TxId) string {
+
+	// SERIALISED
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	carrier := tm.traces[id]
+	delete(tm.traces, id)
+	return carrier
+}
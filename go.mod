@@ -6,6 +6,6 @@ require (
 	github.com/disintegration/imaging v1.6.2
 	github.com/oschwald/maxminddb-golang v1.12.0
 	golang.org/x/crypto v0.23.0
-	golang.org/x/image v0.18.0 // indirect
+	golang.org/x/image v0.18.0
 	golang.org/x/time v0.5.0
 )
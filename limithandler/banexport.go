@@ -0,0 +1,218 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package limithandler
+
+// Export of bans, so that they can be enforced upstream of the server.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ban describes a banned visitor.
+type Ban struct {
+	IP    string    // visitor address
+	Limit string    // limit that imposed the ban
+	Until time.Time // end of ban
+}
+
+// BanSink receives the current set of bans, for enforcement elsewhere, such as an nginx deny list or a cloud firewall.
+type BanSink interface {
+	// Export is called with all current bans. It returns any addresses for which bans have been revoked externally.
+	Export(bans []Ban) (revoked []string, err error)
+}
+
+// DenyFile is a BanSink that writes a deny list for a web server or firewall.
+// An address removed from the file by an operator is treated as a revoked ban.
+type DenyFile struct {
+	Path   string       // file to be written
+	Format string       // format for each line, with %s for the address (default "deny %s;\n" for nginx)
+	Reload func() error // optional function called when the file has changed, e.g. to signal nginx
+
+	written map[string]bool // addresses written last time
+}
+
+// SetBanExport starts periodic export of bans to a sink, with revocation of any bans removed by the sink.
+func (lhs *Handlers) SetBanExport(sink BanSink, every time.Duration, errorLog func(error)) {
+
+	t := time.NewTicker(every)
+	lhs.export = t
+
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				revoked, err := sink.Export(lhs.Bans())
+				if err != nil && errorLog != nil {
+					errorLog(err)
+				}
+				lhs.Revoke(revoked...)
+
+			case <-lhs.chDone:
+				return
+			}
+		}
+	}()
+}
+
+// Ban bans a visitor detected by other means, such as an impostor crawler, as if they had exceeded the specified limit.
+// The ban is extended to the limit's alsoBan limits, and escalated if the visitor has been banned before.
+func (lhs *Handlers) Ban(limit string, ip string) {
+
+	lim := lhs.limiters[limit]
+	if lim == nil {
+		return
+	}
+
+	// SERIALISED
+	lim.mu.Lock()
+	lim.ban(ip, lim.visitor(ip))
+	lim.mu.Unlock()
+}
+
+// Bans returns the visitors currently banned, one entry per address, ordered by address.
+func (lhs *Handlers) Bans() []Ban {
+
+	now := time.Now()
+	byIP := make(map[string]Ban)
+
+	for name, lim := range lhs.limiters {
+		lim.mu.Lock()
+		for ip, v := range lim.visitors {
+			if v.banTo.After(now) && v.banTo.After(byIP[ip].Until) {
+				byIP[ip] = Ban{IP: ip, Limit: name, Until: v.banTo}
+			}
+		}
+		lim.mu.Unlock()
+	}
+
+	bans := make([]Ban, 0, len(byIP))
+	for _, b := range byIP {
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Revoke lifts the bans on the specified addresses, for all limits.
+func (lhs *Handlers) Revoke(ips ...string) {
+
+	if len(ips) == 0 {
+		return
+	}
+
+	for _, lim := range lhs.limiters {
+		lim.mu.Lock()
+		for _, ip := range ips {
+			if v := lim.visitors[ip]; v != nil {
+				v.banTo = time.Time{}
+				v.reject = false
+				v.rejects = 0
+			}
+		}
+		lim.mu.Unlock()
+	}
+}
+
+// Export writes the deny list, and returns addresses removed from the file since the last export.
+func (df *DenyFile) Export(bans []Ban) ([]string, error) {
+
+	// addresses written last time that have been removed
+	var revoked []string
+	if df.written != nil {
+		current, err := ioutil.ReadFile(df.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listed := make(map[string]bool)
+		for _, w := range strings.FieldsFunc(string(current), func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ';' || r == ','
+		}) {
+			listed[w] = true
+		}
+		for ip := range df.written {
+			if !listed[ip] {
+				revoked = append(revoked, ip)
+			}
+		}
+	}
+	gone := make(map[string]bool, len(revoked))
+	for _, ip := range revoked {
+		gone[ip] = true
+	}
+
+	// new content
+	format := df.Format
+	if format == "" {
+		format = "deny %s;\n"
+	}
+	var sb strings.Builder
+	written := make(map[string]bool, len(bans))
+	for _, b := range bans {
+		if !validAddr(b.IP) {
+			continue // not safe to write to a configuration file
+		}
+		if !gone[b.IP] {
+			fmt.Fprintf(&sb, format, b.IP)
+			written[b.IP] = true
+		}
+	}
+
+	// unchanged?
+	if df.written != nil && len(revoked) == 0 && sameSet(written, df.written) {
+		return nil, nil
+	}
+
+	// replace file atomically, so that the reader never sees a partial list
+	tmp, err := ioutil.TempFile(filepath.Dir(df.Path), ".deny-*")
+	if err != nil {
+		return revoked, err
+	}
+	_, err = tmp.WriteString(sb.String())
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), df.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return revoked, err
+	}
+	df.written = written
+
+	if df.Reload != nil {
+		err = df.Reload()
+	}
+	return revoked, err
+}
+
+// validAddr returns true for an IP address or CIDR block, with nothing else that could be interpreted by a web server.
+func validAddr(s string) bool {
+
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// sameSet returns true if two sets of addresses are the same.
+func sameSet(a, b map[string]bool) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,6 +7,7 @@
 package limithandler
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -25,6 +26,7 @@ const (
 
 type Handler struct {
 	limit *limiter
+	queue time.Duration // maximum wait for over-limit requests
 
 	// handlers wrapped
 	banned    http.Handler
@@ -33,16 +35,28 @@ type Handler struct {
 	report    func(*http.Request, string, string)
 	reportAll bool
 	success   http.Handler
+
+	// optional site-wide limits
+	parents    []*total
+	overloaded http.Handler
 }
 
 type Handlers struct {
 	banFor      time.Duration
 	forget      time.Duration
 	visitorAddr func(*http.Request) string
+	errorPage   func(w http.ResponseWriter, r *http.Request, status int, msg string)
 
 	limiters map[string]*limiter
+	totals   map[string]*total
 	release  *time.Ticker
-	chDone   <-chan bool
+	export   *time.Ticker
+	chDone   chan bool // closed to stop background goroutines
+
+	// analysis of request rates
+	tune     *time.Ticker
+	muTuning sync.Mutex
+	tuned    []*Tuning
 }
 
 type limiter struct {
@@ -58,6 +72,13 @@ type limiter struct {
 	mu       sync.Mutex
 	visitors map[string]*visitor
 	rejects  int		// rejected requests (statistic)
+
+	rejectsAll int64 // rejected requests since start (metric)
+
+	// observed usage for tuning, by visitor
+	usage        map[string]*usage
+	unsampled    int64 // requests from visitors not observed, beyond maxObserved
+	tunedRejects int64 // rejectsAll at the last analysis
 }
 
 // rate limiter for each visitor
@@ -66,6 +87,7 @@ type visitor struct {
 	limiter  *rate.Limiter
 	reject   bool
 	rejects  int
+	queued   int // requests waiting
 	banTo    time.Time
 	banLevel int // -1 = not banned
 }
@@ -78,9 +100,6 @@ func (lh *Handler) Allow(r *http.Request) (ok bool, status int) {
 	lim := lh.limit
 	lhs := lim.lhs
 
-	lim.mu.Lock()
-	defer lim.mu.Unlock()
-
 	// visitor address
 	ip, _, err := net.SplitHostPort(lhs.visitorAddr(r))
 	if err != nil {
@@ -89,16 +108,43 @@ func (lh *Handler) Allow(r *http.Request) (ok bool, status int) {
 		return
 	}
 
+	// SERIALISED
+	lim.mu.Lock()
+
 	// limiter for this limit and visitor
+	now := time.Now()
 	v := lim.visitor(ip)
-	if !v.banTo.IsZero() || (v.limiter != nil && !v.limiter.Allow()) || v.reject {
+	if lhs.tune != nil {
+		lim.observe(ip, now)
+	}
+	if !v.banTo.IsZero() || v.reject {
+		// banned
+		status = lh.reject(r, ip, v)
 
+	} else if res, allowed := reserve(v.limiter, now); allowed {
+		if len(lh.parents) == 0 || lh.allowTotals(now) {
+			ok = true
+		} else {
+			// not the visitor's fault, so give back their capacity
+			if res != nil {
+				res.CancelAt(now)
+			}
+			status = lh.overload(r, ip)
+		}
+
+	} else if lh.queue > 0 && v.queued < lim.burst {
+		// wait for the rate to allow the request
+		v.queued++
+		lim.mu.Unlock()
+		ok, status = lh.wait(r, ip, v.limiter)
+		return
+
+	} else {
 		// count rejections and report first one
 		status = lh.reject(r, ip, v)
-		return
 	}
 
-	ok = true
+	lim.mu.Unlock()
 	return
 }
 
@@ -124,9 +170,9 @@ func (lhs *Handlers) New(limit string, every time.Duration, burst int, banAfter
 	}
 	return &Handler{
 		limit:   lim,
-		banned:  http.HandlerFunc(defaultBannedHandler),
-		failure: http.HandlerFunc(defaultFailureHandler),
-		ignored: http.HandlerFunc(defaultIgnoredHandler),
+		banned:  http.HandlerFunc(lhs.defaultBannedHandler),
+		failure: http.HandlerFunc(lhs.defaultFailureHandler),
+		ignored: http.HandlerFunc(lhs.defaultIgnoredHandler),
 		success: next,
 	}
 }
@@ -146,9 +192,9 @@ func (lhs *Handlers) NewUnlimited(limit string, alsoBan string, next http.Handle
 	}
 	return &Handler{
 		limit:   lim,
-		banned:  http.HandlerFunc(defaultBannedHandler),
-		failure: http.HandlerFunc(defaultFailureHandler),
-		ignored: http.HandlerFunc(defaultIgnoredHandler),
+		banned:  http.HandlerFunc(lhs.defaultBannedHandler),
+		failure: http.HandlerFunc(lhs.defaultFailureHandler),
+		ignored: http.HandlerFunc(lhs.defaultIgnoredHandler),
 		success: next,
 	}
 }
@@ -162,6 +208,12 @@ func (lhs *Handlers) RejectsCounted() (rejects int) {
 		lim.rejects = 0
 		lim.mu.Unlock()
 	}
+	for _, t := range lhs.totals {
+		t.mu.Lock()
+		rejects += t.rejects
+		t.rejects = 0
+		t.mu.Unlock()
+	}
 	return
 }
 
@@ -181,6 +233,13 @@ func (lh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case http.StatusNotFound:
 			lh.ignored.ServeHTTP(w, r) // banned and ignored
 
+		case http.StatusServiceUnavailable:
+			if lh.overloaded != nil {
+				lh.overloaded.ServeHTTP(w, r) // total limit exceeded
+			} else {
+				lh.limit.lhs.defaultOverloadHandler(w, r)
+			}
+
 		case http.StatusTooManyRequests:
 			fallthrough
 
@@ -220,6 +279,18 @@ func (lh *Handler) SetReportAllHandler(handler func(r *http.Request, ip string,
 	lh.reportAll = true
 }
 
+// SetQueue specifies that requests over the rate limit should wait, for up to maxWait, before being rejected.
+// This smooths short bursts of requests from legitimate users. The number of requests waiting for each visitor is limited to the burst size.
+func (lh *Handler) SetQueue(maxWait time.Duration) {
+	lh.queue = maxWait
+}
+
+// SetErrorPage specifies a function to render error pages for rejected requests, such as server.ErrorPages.Error.
+// It replaces the default plain text responses.
+func (lhs *Handlers) SetErrorPage(fn func(w http.ResponseWriter, r *http.Request, status int, msg string)) {
+	lhs.errorPage = fn
+}
+
 // SetVisitorAddr specifies a function to extract a visitor's IP address from a request.
 // The default is to use Request.RemoteAddr.
 // Alternatives of "x-real-ip" or "x-forwarded-for" from the Request.Header are needed if the server is behind a load balancer or other proxy.
@@ -246,7 +317,9 @@ func Start(ban time.Duration, forget time.Duration) *Handlers {
 		visitorAddr: defaultVisitorAddr,
 
 		limiters: make(map[string]*limiter),
+		totals:   make(map[string]*total),
 		release:  time.NewTicker(tick),
+		chDone:   make(chan bool),
 	}
 
 	// start background goroutine to remove old entries from the visitors map
@@ -258,6 +331,13 @@ func Start(ban time.Duration, forget time.Duration) *Handlers {
 // Stop terminates LimitHander operation.
 func (lhs *Handlers) Stop() {
 	lhs.release.Stop()
+	if lhs.export != nil {
+		lhs.export.Stop()
+	}
+	if lhs.tune != nil {
+		lhs.tune.Stop()
+	}
+	close(lhs.chDone)
 }
 
 // ban blocks a misbehaving visitor
@@ -284,20 +364,20 @@ func (lim *limiter) ban(ip string, v *visitor) {
 }
 
 // defaultBannedHandler calls an HTTP error for a newly banned IP address.
-func defaultBannedHandler(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "Banned for suspected intrusion attempt", http.StatusForbidden)
+func (lhs *Handlers) defaultBannedHandler(w http.ResponseWriter, r *http.Request) {
+	lhs.error(w, r, http.StatusForbidden, "Banned for suspected intrusion attempt")
 }
 
 // defaultFailureHandler calls an HTTP error for limit failures.
-func defaultFailureHandler(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+func (lhs *Handlers) defaultFailureHandler(w http.ResponseWriter, r *http.Request) {
+	lhs.error(w, r, http.StatusTooManyRequests, "")
 }
 
 // defaultIgnoredHandler calls an HTTP error for an already banned IP address.
-func defaultIgnoredHandler(w http.ResponseWriter, r *http.Request) {
+func (lhs *Handlers) defaultIgnoredHandler(w http.ResponseWriter, r *http.Request) {
 
 	// trying a different strategy in the faint hope that idiot bots might give up sooner
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	lhs.error(w, r, http.StatusNotFound, "")
 }
 
 // defaultVisitorAddr returns the IP address of a visitor, from Request.RemoteAddr.
@@ -305,6 +385,19 @@ func defaultVisitorAddr(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// error sends an error response, using the error page if specified.
+func (lhs *Handlers) error(w http.ResponseWriter, r *http.Request, status int, msg string) {
+
+	if lhs.errorPage != nil {
+		lhs.errorPage(w, r, status, msg)
+	} else {
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		http.Error(w, msg, status)
+	}
+}
+
 // reject records a rate rejection for a visitor, and returns a status for reporting.
 // Note that in reporting we distinguish between extended bans, called "banned", and single limit bans, called "blocked".
 func (lh *Handler) reject(r *http.Request, ip string, v *visitor) int {
@@ -316,6 +409,7 @@ func (lh *Handler) reject(r *http.Request, ip string, v *visitor) int {
 	// count rejections
 	v.rejects++
 	lim.rejects++
+	lim.rejectsAll++
 
 	if v.reject {
 
@@ -358,6 +452,34 @@ func (lh *Handler) reject(r *http.Request, ip string, v *visitor) int {
 	return httpStatus
 }
 
+// wait delays a request until allowed by a visitor's rate limiter, and returns false and a status if it waited too long.
+func (lh *Handler) wait(r *http.Request, ip string, rl *rate.Limiter) (ok bool, status int) {
+
+	// bounded wait, abandoned if the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), lh.queue)
+	err := rl.Wait(ctx)
+	cancel()
+
+	// SERIALISED
+	lim := lh.limit
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	v := lim.visitor(ip) // note that the visitor may have been forgotten
+	if v.queued > 0 {
+		v.queued--
+	}
+
+	if err != nil {
+		status = lh.reject(r, ip, v)
+	} else if len(lh.parents) == 0 || lh.allowTotals(time.Now()) {
+		ok = true
+	} else {
+		status = lh.overload(r, ip)
+	}
+	return
+}
+
 // visitor returns visitor data, including a rate limiter.
 func (lim *limiter) visitor(id string) *visitor {
 	v, exists := lim.visitors[id]
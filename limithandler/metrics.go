@@ -0,0 +1,44 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package limithandler
+
+// Metrics for rate limits.
+
+import (
+	"github.com/inchworks/webparts/metrics"
+)
+
+// Metrics implements metrics.Collector.
+func (lhs *Handlers) Metrics() []*metrics.Metric {
+
+	rejects := metrics.NewCounter("webparts_limithandler_rejects_total", "Requests rejected by rate limit.")
+	visitors := metrics.NewGauge("webparts_limithandler_visitors", "Visitors remembered by rate limit.")
+	banned := metrics.NewGauge("webparts_limithandler_banned", "Visitors banned by rate limit.")
+
+	for name, lim := range lhs.limiters {
+
+		// SERIALISED
+		lim.mu.Lock()
+		var nBanned int
+		for _, v := range lim.visitors {
+			if !v.banTo.IsZero() {
+				nBanned++
+			}
+		}
+		rejects.Add(float64(lim.rejectsAll), "limit", name)
+		visitors.Add(float64(len(lim.visitors)), "limit", name)
+		banned.Add(float64(nBanned), "limit", name)
+		lim.mu.Unlock()
+	}
+
+	overloads := metrics.NewCounter("webparts_limithandler_overloads_total", "Requests rejected by total limit.")
+	for name, t := range lhs.totals {
+
+		// SERIALISED
+		t.mu.Lock()
+		overloads.Add(float64(t.rejectsAll), "limit", name)
+		t.mu.Unlock()
+	}
+
+	return []*metrics.Metric{rejects, visitors, banned, overloads}
+}
@@ -0,0 +1,106 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package limithandler
+
+// Site-wide limits, shared by all visitors, to protect the server from aggregate overload.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// total is a rate limit on requests from all visitors.
+type total struct {
+	limiter *rate.Limiter
+
+	mu      sync.Mutex
+	rejects int // rejected requests (statistic)
+
+	rejectsAll int64 // rejected requests since start (metric)
+}
+
+// NewTotal specifies a limit on the total rate of requests from all visitors.
+// It has no effect until used as a parent for other limits, by SetParent.
+// If called multiple times for the same limit name, the first specification is used.
+func (lhs *Handlers) NewTotal(limit string, every time.Duration, burst int) {
+
+	if lhs.totals[limit] == nil {
+		lhs.totals[limit] = &total{limiter: rate.NewLimiter(rate.Every(every), burst)}
+	}
+}
+
+// SetParent nests the handler's limit under a total limit specified by NewTotal, so that a request must pass both.
+// It may be called more than once, for a hierarchy of limits, such as for a group of pages and for the whole site.
+// Requests rejected by a total limit get a StatusServiceUnavailable response, and don't count towards banning the visitor.
+func (lh *Handler) SetParent(limit string) {
+
+	if t := lh.limit.lhs.totals[limit]; t != nil {
+		lh.parents = append(lh.parents, t)
+	}
+}
+
+// SetOverloadHandler specifies a function to be called when a total limit is exceeded.
+func (lh *Handler) SetOverloadHandler(handler http.Handler) {
+	lh.overloaded = handler
+}
+
+// allowTotals returns true if the total limits allow a request at the specified time.
+func (lh *Handler) allowTotals(now time.Time) bool {
+
+	reserved := make([]*rate.Reservation, 0, len(lh.parents))
+	for _, t := range lh.parents {
+
+		res, ok := reserve(t.limiter, now)
+		if !ok {
+			// give back the capacity taken from other limits
+			for _, r := range reserved {
+				r.CancelAt(now)
+			}
+
+			t.mu.Lock()
+			t.rejects++
+			t.rejectsAll++
+			t.mu.Unlock()
+			return false
+		}
+		reserved = append(reserved, res)
+	}
+	return true
+}
+
+// defaultOverloadHandler calls an HTTP error when the server is too busy.
+func (lhs *Handlers) defaultOverloadHandler(w http.ResponseWriter, r *http.Request) {
+	lhs.error(w, r, http.StatusServiceUnavailable, "Server busy, try again later")
+}
+
+// overload reports a request rejected by a total limit, and returns a status.
+func (lh *Handler) overload(r *http.Request, ip string) int {
+
+	if lh.report != nil && lh.reportAll {
+		lh.report(r, ip, "overloaded")
+	}
+	return http.StatusServiceUnavailable
+}
+
+// reserve takes a token from a rate limiter if one is available at the specified time, returning a reservation.
+// The reservation may be cancelled, giving back the token, by CancelAt for the same time.
+// A nil limiter allows all requests.
+func reserve(rl *rate.Limiter, now time.Time) (*rate.Reservation, bool) {
+
+	if rl == nil {
+		return nil, true
+	}
+
+	res := rl.ReserveN(now, 1)
+	if !res.OK() {
+		return nil, false
+	}
+	if res.DelayFrom(now) > 0 {
+		res.CancelAt(now)
+		return nil, false
+	}
+	return res, true
+}
@@ -0,0 +1,209 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package limithandler
+
+// Analysis of observed request rates, to help choose the parameters for limits.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Tuning summarises the request rates observed for a limit over a reporting period, compared with its parameters.
+// Rates are the peak requests in any minute for each visitor, and bursts are the peak requests in any second.
+// They are sampled from the first visitors seen in the period, up to a limit, so that a scan from many addresses
+// cannot exhaust memory.
+type Tuning struct {
+	Limit     string
+	Every     time.Duration // configured interval between requests (0 if unlimited)
+	Burst     int           // configured burst
+	Visitors  int           // visitors observed in the period
+	Unsampled int64         // requests from further visitors, not observed
+	Rejects   int64         // requests rejected in the period
+
+	P50, P95, Max int // requests per minute, by visitor
+	BurstP95      int // requests per second, by visitor
+
+	Suggestions []string
+}
+
+// usage records a visitor's peak request rates.
+type usage struct {
+	minute, second         int64
+	inMinute, inSecond     int
+	peakMinute, peakSecond int
+}
+
+// Visitors needed for suggestions, and observed in a period.
+const (
+	minVisitors = 10
+	maxObserved = 10000
+)
+
+// SetTuning starts periodic analysis of request rates, reported to fn, such as to be logged.
+// The most recent analysis is also available from Tuning.
+func (lhs *Handlers) SetTuning(every time.Duration, fn func([]*Tuning)) {
+
+	t := time.NewTicker(every)
+	lhs.tune = t
+
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				ts := lhs.analyse()
+				if fn != nil {
+					fn(ts)
+				}
+
+			case <-lhs.chDone:
+				return
+			}
+		}
+	}()
+}
+
+// Tuning returns the most recent analysis of request rates, or nil if none is available yet.
+func (lhs *Handlers) Tuning() []*Tuning {
+
+	// SERIALISED
+	lhs.muTuning.Lock()
+	defer lhs.muTuning.Unlock()
+
+	return lhs.tuned
+}
+
+// analyse summarises the request rates for each limit, and starts a new period.
+func (lhs *Handlers) analyse() []*Tuning {
+
+	var ts []*Tuning
+	for name, lim := range lhs.limiters {
+
+		// SERIALISED
+		lim.mu.Lock()
+		t := &Tuning{
+			Limit:     name,
+			Burst:     lim.burst,
+			Visitors:  len(lim.usage),
+			Unsampled: lim.unsampled,
+			Rejects:   lim.rejectsAll - lim.tunedRejects,
+		}
+		if lim.rate != 0 {
+			t.Every = time.Duration(float64(time.Second) / float64(lim.rate))
+		}
+		perMinute := make([]int, 0, len(lim.usage))
+		perSecond := make([]int, 0, len(lim.usage))
+		for _, u := range lim.usage {
+			perMinute = append(perMinute, u.peakMinute)
+			perSecond = append(perSecond, u.peakSecond)
+		}
+		lim.usage = nil
+		lim.unsampled = 0
+		lim.tunedRejects = lim.rejectsAll
+		lim.mu.Unlock()
+
+		sort.Ints(perMinute)
+		sort.Ints(perSecond)
+		t.P50 = percentile(perMinute, 50)
+		t.P95 = percentile(perMinute, 95)
+		t.BurstP95 = percentile(perSecond, 95)
+		if len(perMinute) > 0 {
+			t.Max = perMinute[len(perMinute)-1]
+		}
+		t.suggest()
+
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Limit < ts[j].Limit })
+
+	// SERIALISED
+	lhs.muTuning.Lock()
+	lhs.tuned = ts
+	lhs.muTuning.Unlock()
+
+	return ts
+}
+
+// observe records a request for a visitor's usage. It must be called with the limiter locked.
+func (lim *limiter) observe(ip string, now time.Time) {
+
+	if lim.usage == nil {
+		lim.usage = make(map[string]*usage)
+	}
+	u := lim.usage[ip]
+	if u == nil {
+		if len(lim.usage) >= maxObserved {
+			lim.unsampled++
+			return
+		}
+		u = &usage{}
+		lim.usage[ip] = u
+	}
+
+	if m := now.Unix() / 60; m != u.minute {
+		u.minute = m
+		u.inMinute = 0
+	}
+	if s := now.Unix(); s != u.second {
+		u.second = s
+		u.inSecond = 0
+	}
+	u.inMinute++
+	u.inSecond++
+	if u.inMinute > u.peakMinute {
+		u.peakMinute = u.inMinute
+	}
+	if u.inSecond > u.peakSecond {
+		u.peakSecond = u.inSecond
+	}
+}
+
+// suggest adds suggested changes to the limit's parameters.
+func (t *Tuning) suggest() {
+
+	if t.Visitors < minVisitors {
+		t.Suggestions = append(t.Suggestions, fmt.Sprintf("too few visitors (%d) for suggestions", t.Visitors))
+		return
+	}
+	if t.Every == 0 {
+		return // unlimited
+	}
+
+	allowed := float64(time.Minute) / float64(t.Every) // requests per minute
+	switch {
+	case float64(t.P95) > 0.8*allowed:
+		t.Suggestions = append(t.Suggestions,
+			fmt.Sprintf("5%% of visitors reach %d requests per minute, close to the limit of %.0f: consider every=%v", t.P95, allowed, every(t.P95*3/2)))
+
+	case t.Max > 0 && float64(t.Max) < 0.25*allowed:
+		t.Suggestions = append(t.Suggestions,
+			fmt.Sprintf("no visitor exceeded %d requests per minute, a quarter of the limit of %.0f: consider every=%v", t.Max, allowed, every(t.Max*2)))
+	}
+
+	if t.BurstP95 > t.Burst {
+		t.Suggestions = append(t.Suggestions,
+			fmt.Sprintf("5%% of visitors make %d requests in a second, more than the burst of %d: consider burst=%d", t.BurstP95, t.Burst, t.BurstP95))
+	}
+}
+
+// every returns the interval between requests for a rate per minute.
+func every(perMinute int) time.Duration {
+	if perMinute < 1 {
+		perMinute = 1
+	}
+	return (time.Minute / time.Duration(perMinute)).Round(time.Millisecond)
+}
+
+// percentile returns the value at a percentile of sorted values.
+func percentile(sorted []int, p int) int {
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,75 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package metrics
+
+// Accumulation of observations for histograms.
+
+import (
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Buckets counts observations, such as durations, for a histogram metric. It is safe for concurrent use.
+type Buckets struct {
+	bounds []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewBuckets returns a set of buckets with the specified upper bounds, in ascending order.
+func NewBuckets(bounds ...float64) *Buckets {
+	return &Buckets{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds a value.
+func (b *Buckets) Observe(v float64) {
+
+	// SERIALISED
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, ub := range b.bounds {
+		if v <= ub {
+			b.counts[i]++
+			break
+		}
+	}
+	b.sum += v
+	b.count++
+}
+
+// Metric returns a histogram metric for the current observations, with optional pairs of label names and values.
+func (b *Buckets) Metric(name, help string, labels ...string) *Metric {
+
+	m := &Metric{Name: name, Help: help, Type: Histogram}
+
+	// SERIALISED
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var cumulative uint64
+	for i, ub := range b.bounds {
+		cumulative += b.counts[i]
+		m.Samples = append(m.Samples, Sample{Labels: withLe(labels, ub), Value: float64(cumulative), Suffix: "_bucket"})
+	}
+	m.Samples = append(m.Samples,
+		Sample{Labels: withLe(labels, math.Inf(1)), Value: float64(b.count), Suffix: "_bucket"},
+		Sample{Labels: labels, Value: b.sum, Suffix: "_sum"},
+		Sample{Labels: labels, Value: float64(b.count), Suffix: "_count"},
+	)
+	return m
+}
+
+// withLe returns labels with the upper bound for a bucket added.
+func withLe(labels []string, ub float64) []string {
+
+	le := "+Inf"
+	if !math.IsInf(ub, 1) {
+		le = strconv.FormatFloat(ub, 'g', -1, 64)
+	}
+	return append(append([]string{}, labels...), "le", le)
+}
@@ -0,0 +1,189 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+// Package metrics is a lightweight registry of metrics from webparts components, served in the Prometheus text format.
+//
+// Components implement Collector, and report their current values when the metrics are scraped.
+// Register each component once, and serve all of them from one endpoint, such as server.Server.Metrics.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types.
+const (
+	Counter   = "counter"   // cumulative value, such as requests rejected since the server started
+	Gauge     = "gauge"     // current value, such as a queue length
+	Histogram = "histogram" // counts of observations in buckets, such as durations, from Buckets
+)
+
+// Collector is implemented by a component that reports metrics.
+type Collector interface {
+	Metrics() []*Metric
+}
+
+// Metric is a named value, with optional labelled samples.
+type Metric struct {
+	Name    string // e.g. webparts_limithandler_rejects_total
+	Help    string
+	Type    string // Counter, Gauge or Histogram
+	Samples []Sample
+}
+
+// Sample is a value of a metric, with its labels.
+type Sample struct {
+	Labels []string // pairs of label name and value
+	Value  float64
+	Suffix string // for a histogram: _bucket, _sum or _count
+}
+
+// Registry holds the collectors to be reported.
+type Registry struct {
+	// optional check on scrape requests, such as for a bearer token (default: loopback and private addresses only)
+	Allowed func(r *http.Request) bool
+
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewCounter returns a counter metric.
+func NewCounter(name, help string) *Metric {
+	return &Metric{Name: name, Help: help, Type: Counter}
+}
+
+// NewGauge returns a gauge metric.
+func NewGauge(name, help string) *Metric {
+	return &Metric{Name: name, Help: help, Type: Gauge}
+}
+
+// Add appends a sample, with pairs of label names and values. It returns the metric, so that calls can be combined.
+func (m *Metric) Add(value float64, labels ...string) *Metric {
+	m.Samples = append(m.Samples, Sample{Labels: labels, Value: value})
+	return m
+}
+
+// Handler returns a handler that serves the metrics for a scrape request.
+func (rg *Registry) Handler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		allowed := rg.Allowed
+		if allowed == nil {
+			allowed = isLocal
+		}
+		if !allowed(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		rg.Respond(w)
+	})
+}
+
+// Respond writes the metrics as the response to a scrape request, without checking Allowed.
+// It is for a caller that controls access itself, such as webparts/server.
+func (rg *Registry) Respond(w http.ResponseWriter) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rg.Write(w)
+}
+
+// Register adds collectors to the registry.
+func (rg *Registry) Register(cs ...Collector) {
+
+	// SERIALISED
+	rg.mu.Lock()
+	rg.collectors = append(rg.collectors, cs...)
+	rg.mu.Unlock()
+}
+
+// Write writes the metrics from all collectors, in name order.
+// Samples for metrics with the same name from different collectors, such as two rate limiters, are combined.
+func (rg *Registry) Write(w io.Writer) error {
+
+	// SERIALISED
+	rg.mu.Lock()
+	cs := rg.collectors
+	rg.mu.Unlock()
+
+	// collect, combining by name
+	byName := make(map[string]*Metric)
+	var names []string
+	for _, c := range cs {
+		for _, m := range c.Metrics() {
+			if all := byName[m.Name]; all != nil {
+				all.Samples = append(all.Samples, m.Samples...)
+			} else {
+				byName[m.Name] = m
+				names = append(names, m.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		writeMetric(bw, byName[name])
+	}
+	return bw.Flush()
+}
+
+// isLocal returns true for a request from a loopback or private address.
+func isLocal(r *http.Request) bool {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+	return ip[0]&0xfe == 0xfc
+}
+
+// writeMetric writes a metric in the text format.
+func writeMetric(w *bufio.Writer, m *Metric) {
+
+	if m.Help != "" {
+		w.WriteString("# HELP " + m.Name + " " + helpEscaper.Replace(m.Help) + "\n")
+	}
+	if m.Type != "" {
+		w.WriteString("# TYPE " + m.Name + " " + m.Type + "\n")
+	}
+
+	for _, s := range m.Samples {
+		w.WriteString(m.Name + s.Suffix)
+		if len(s.Labels) > 1 {
+			w.WriteByte('{')
+			for i := 0; i+1 < len(s.Labels); i += 2 {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(s.Labels[i] + `="` + labelEscaper.Replace(s.Labels[i+1]) + `"`)
+			}
+			w.WriteByte('}')
+		}
+		w.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
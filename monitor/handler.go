@@ -0,0 +1,61 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package monitor
+
+// HTTP endpoint for clients to register and report that they are alive.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler returns an HTTP handler for clients to register and send heartbeats.
+//
+// A client sends a POST request each tick, with form values "name" and "interval" (the tick interval in seconds),
+// and its token either as form value "token" or in an "Authorization: Bearer" header.
+// The first request registers the client, and later ones show that it is alive.
+// The reply is a JSON object with the client's index.
+//
+// verify is called to check the token for a client, typically issued by the application.
+func (m *Monitor) Handler(verify func(name string, token string) bool) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		name := r.PostForm.Get("name")
+		secs, err := strconv.Atoi(r.PostForm.Get("interval"))
+		if name == "" || err != nil || secs <= 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// token
+		token := r.PostForm.Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if !verify(name, token) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ix := m.Register(name, time.Duration(secs)*time.Second)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Index int `json:"index"`
+		}{Index: ix})
+	})
+}
@@ -0,0 +1,30 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package monitor
+
+// Metrics for monitored clients.
+
+import (
+	"github.com/inchworks/webparts/metrics"
+)
+
+// Metrics implements metrics.Collector.
+func (m *Monitor) Metrics() []*metrics.Metric {
+
+	missed := metrics.NewGauge("webparts_monitor_missed", "Intervals missed in the current outage of a client.")
+	uptime := metrics.NewGauge("webparts_monitor_uptime_percent", "Client uptime over the last 24 hours, if Retain covers it.")
+
+	for _, c := range m.Status() {
+		var p Period
+		if len(c.Periods) > 0 {
+			p = c.Periods[0]
+		}
+		missed.Add(float64(p.Missed), "client", c.Name)
+
+		if c.Uptime.Day >= 0 {
+			uptime.Add(c.Uptime.Day, "client", c.Name)
+		}
+	}
+
+	return []*metrics.Metric{missed, uptime}
+}
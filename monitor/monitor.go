@@ -9,8 +9,8 @@ import (
 )
 
 const (
-	monitorPeriod  = 60 // monitor reporting period (seconds)
-	monitorPeriods = 5  // no of reporing periods
+	monitorPeriod  = 60 // default monitor reporting period (seconds)
+	monitorPeriods = 5  // no of reporting periods
 
 	amberMissed = 0.05 // max proportion missed, for amber status
 	redMissed   = 20   // max number missed consecutively, for red status
@@ -22,22 +22,39 @@ type Period struct {
 	Missed  int64 // missed in current outage
 	Longest int64 // longest outage
 	Status  string
-	start   time.Time // period start
+	Start   time.Time // period start
 }
 
 // Monitored holds the status of a client for a set of monitoring periods.
 type Monitored struct {
 	Name         string
-	Periods      [monitorPeriods]Period
+	Periods      []Period // most recent periods, current period first
+	Uptime       Uptime   // percentages, set by Status
+	Notes        Notes
+	Interval     time.Duration // expected tick interval
 	halfInterval time.Duration
 	last         time.Time
+
+	// history of periods, as a ring buffer
+	ring []Period
+	head int // current period
 }
 
 // Monitor holds the status of a set of clients.
+// Set the parameters before calling Init.
 type Monitor struct {
+
+	// parameters
+	Granularity time.Duration // length of a reporting period (default 1 minute)
+	Retain      time.Duration // history kept (default 5 periods), e.g. 24 hours at 5 minute granularity
+
+	// optional uptime reports
+	Groups map[string][]string // named sets of clients
+
 	mu      sync.Mutex
 	names   map[string]int
 	clients []Monitored
+	nRing   int // periods kept
 }
 
 // Init starts the monitor. It returns function to be called to stop the monitor.
@@ -46,8 +63,17 @@ func (m *Monitor) Init() func() {
 	m.clients = make([]Monitored, 0)
 	m.names = make(map[string]int)
 
+	// size of history
+	if m.Granularity <= 0 {
+		m.Granularity = monitorPeriod * time.Second
+	}
+	m.nRing = int(m.Retain / m.Granularity)
+	if m.nRing < monitorPeriods {
+		m.nRing = monitorPeriods
+	}
+
 	// monitoring periods
-	ticker := time.NewTicker(monitorPeriod * time.Second)
+	ticker := time.NewTicker(m.Granularity)
 	quit := make(chan struct{})
 	go func() {
 
@@ -86,6 +112,30 @@ func (m *Monitor) Alive(clientIx int) {
 	m.aliveLocked(clientIx)
 }
 
+// History returns the periods for a client that started within a time range, oldest first.
+// It returns nil if the client is not known.
+func (m *Monitor) History(name string, from time.Time, to time.Time) []Period {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ix, ok := m.names[name]
+	if !ok {
+		return nil
+	}
+	m.updateStatuses()
+
+	c := &m.clients[ix]
+	ps := make([]Period, 0, len(c.ring))
+	for i := 1; i <= len(c.ring); i++ {
+		p := c.ring[(c.head+i)%len(c.ring)]
+		if !p.Start.IsZero() && !p.Start.Before(from) && p.Start.Before(to) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
 // Register adds a client to monitoring. It may be called for an existing client.
 func (m *Monitor) Register(name string, tickInterval time.Duration) int {
 
@@ -101,10 +151,12 @@ func (m *Monitor) Register(name string, tickInterval time.Duration) int {
 		// new client
 		c := Monitored{
 			Name:         name,
+			Interval:     tickInterval,
 			halfInterval: tickInterval / 2,
 			last:         time.Now(),
+			ring:         make([]Period, m.nRing),
 		}
-		c.Periods[0] = Period{start: time.Now()}
+		c.ring[0] = Period{Start: time.Now()}
 
 		// add to array of clients
 		m.clients = append(m.clients, c)
@@ -125,7 +177,18 @@ func (m *Monitor) Status() []Monitored {
 	// update statuses
 	m.updateStatuses()
 
-	return m.clients // a copy of the client statuses (I trust)
+	// copy the client statuses, with the most recent periods
+	cs := make([]Monitored, len(m.clients))
+	for i, c := range m.clients {
+		c.Periods = make([]Period, monitorPeriods)
+		for j := range c.Periods {
+			c.Periods[j] = c.ring[(c.head-j+len(c.ring))%len(c.ring)]
+		}
+		c.Uptime = m.uptime(&c)
+		c.ring = nil
+		cs[i] = c
+	}
+	return cs
 }
 
 // aliveLocked is called to note that a client is alive (called with lock).
@@ -153,13 +216,9 @@ func (m *Monitor) endPeriod() {
 	for i := range m.clients {
 		c := &m.clients[i]
 
-		// save current period ..
-		for j := monitorPeriods - 1; j >= 1; j-- {
-			c.Periods[j] = c.Periods[j-1] // copy back
-		}
-
-		// .. and start a new one
-		c.Periods[0] = Period{start: now}
+		// keep current period, and start a new one, overwriting the oldest
+		c.head = (c.head + 1) % len(c.ring)
+		c.ring[c.head] = Period{Start: now}
 	}
 }
 
@@ -175,7 +234,7 @@ func (m *Monitor) updateStatuses() {
 		if p.Longest >= redMissed {
 			p.Status = "R"
 
-		} else if since := c.halfIntervalsSince(p.start) / 2; since > 0 &&
+		} else if since := c.halfIntervalsSince(p.Start) / 2; since > 0 &&
 			float32(p.Lost+p.Missed)/float32(since) > amberMissed {
 			p.Status = "A"
 
@@ -194,14 +253,14 @@ func (c *Monitored) halfIntervalsSince(t time.Time) int64 {
 // update is called to update monitoring statistics.
 func (c *Monitored) update(alive bool) *Period {
 
-	p := &c.Periods[0]
+	p := &c.ring[c.head]
 
 	// count missing alive calls from start of period
 	var last time.Time
-	if c.last.Sub(p.start) > 0 {
+	if c.last.Sub(p.Start) > 0 {
 		last = c.last
 	} else {
-		last = p.start
+		last = p.Start
 	}
 
 	// check if ticks are late (ok to be up to one half-interval late)
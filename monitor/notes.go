@@ -0,0 +1,100 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package monitor
+
+// Runtime annotation of clients, and changes to their expected intervals.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Notes describe a client for operators, such as where it is and who to contact.
+type Notes struct {
+	Location string `json:"location,omitempty"`
+	Contact  string `json:"contact,omitempty"` // owner contact
+	Note     string `json:"note,omitempty"`
+}
+
+// SetInterval changes the expected tick interval for a client, without registering it again.
+// It returns false if the client is not known.
+func (m *Monitor) SetInterval(name string, tickInterval time.Duration) bool {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ix, ok := m.names[name]
+	if !ok || tickInterval <= 0 {
+		return false
+	}
+
+	// statistics so far are for the previous interval
+	c := &m.clients[ix]
+	c.update(false)
+	c.Interval = tickInterval
+	c.halfInterval = tickInterval / 2
+	return true
+}
+
+// SetNotes annotates a client. It returns false if the client is not known.
+func (m *Monitor) SetNotes(name string, notes Notes) bool {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ix, ok := m.names[name]
+	if !ok {
+		return false
+	}
+	m.clients[ix].Notes = notes
+	return true
+}
+
+// NotesHandler returns an HTTP handler for operators to annotate a client, and change its expected interval.
+//
+// A POST request specifies form values "name", with "location", "contact" and "note" to replace the client's notes,
+// and optionally "interval" (in seconds). The application should restrict access, as for other administrative pages.
+func (m *Monitor) NotesHandler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		name := r.PostForm.Get("name")
+		var interval time.Duration
+		if s := r.PostForm.Get("interval"); s != "" {
+			secs, err := strconv.Atoi(s)
+			if err != nil || secs <= 0 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			interval = time.Duration(secs) * time.Second
+		}
+
+		notes := Notes{
+			Location: r.PostForm.Get("location"),
+			Contact:  r.PostForm.Get("contact"),
+			Note:     r.PostForm.Get("note"),
+		}
+		if !m.SetNotes(name, notes) || (interval > 0 && !m.SetInterval(name, interval)) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Name  string `json:"name"`
+			Notes Notes  `json:"notes"`
+		}{Name: name, Notes: notes})
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package monitor
+
+// Uptime percentages, for reports on availability.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Uptime reports the availability of a client or group of clients, as percentages over recent time.
+// A percentage is -1 if Monitor.Retain is too short to cover the time.
+type Uptime struct {
+	Name  string  `json:"name"`
+	Day   float64 `json:"day"`   // last 24 hours
+	Week  float64 `json:"week"`  // last 7 days
+	Month float64 `json:"month"` // last 30 days
+
+	Notes *Notes `json:"notes,omitempty"` // for a client
+}
+
+// uptime totals for a client
+type uptimeCount struct {
+	expected int64 // intervals expected
+	missed   int64 // intervals missed
+}
+
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+)
+
+// Uptimes returns the uptime for each client, and for each group in Monitor.Groups, in name order.
+func (m *Monitor) Uptimes() (clients []Uptime, groups []Uptime) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.updateStatuses()
+
+	clients = make([]Uptime, 0, len(m.clients))
+	for i := range m.clients {
+		clients = append(clients, m.uptime(&m.clients[i]))
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+
+	groups = make([]Uptime, 0, len(m.Groups))
+	for name, members := range m.Groups {
+		groups = append(groups, Uptime{
+			Name:  name,
+			Day:   m.percent(m.countGroup(members, day), day),
+			Week:  m.percent(m.countGroup(members, week), week),
+			Month: m.percent(m.countGroup(members, month), month),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	return
+}
+
+// UptimeHandler returns an HTTP handler that reports uptimes in JSON.
+// The application should restrict access, as for other administrative pages.
+func (m *Monitor) UptimeHandler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		clients, groups := m.Uptimes()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Clients []Uptime `json:"clients"`
+			Groups  []Uptime `json:"groups"`
+		}{Clients: clients, Groups: groups})
+	})
+}
+
+// uptime returns the uptime for a client.
+// It must be called with the monitor locked.
+func (m *Monitor) uptime(c *Monitored) Uptime {
+
+	u := Uptime{
+		Name:  c.Name,
+		Day:   m.percent(m.count(c, day), day),
+		Week:  m.percent(m.count(c, week), week),
+		Month: m.percent(m.count(c, month), month),
+	}
+	if c.Notes != (Notes{}) {
+		notes := c.Notes
+		u.Notes = &notes
+	}
+	return u
+}
+
+// count returns the intervals expected and missed for a client over a recent time.
+// It must be called with the monitor locked.
+func (m *Monitor) count(c *Monitored, over time.Duration) (n uptimeCount) {
+
+	now := time.Now()
+	cutoff := now.Add(-over)
+	interval := 2 * c.halfInterval
+
+	// from the current period back, with each period ending when the next one starts
+	end := now
+	for i := 0; i < len(c.ring); i++ {
+		p := &c.ring[(c.head-i+len(c.ring))%len(c.ring)]
+		if p.Start.IsZero() || p.Start.Before(cutoff) {
+			break
+		}
+		n.expected += int64(end.Sub(p.Start) / interval)
+		n.missed += p.Lost + p.Missed
+		end = p.Start
+	}
+	return
+}
+
+// countGroup returns the total intervals expected and missed for a group of clients.
+func (m *Monitor) countGroup(names []string, over time.Duration) (n uptimeCount) {
+
+	for _, nm := range names {
+		if ix, ok := m.names[nm]; ok {
+			cn := m.count(&m.clients[ix], over)
+			n.expected += cn.expected
+			n.missed += cn.missed
+		}
+	}
+	return
+}
+
+// percent returns the uptime percentage for a count, or -1 if history is not kept for long enough.
+func (m *Monitor) percent(n uptimeCount, over time.Duration) float64 {
+
+	if time.Duration(m.nRing)*m.Granularity < over {
+		return -1
+	}
+	if n.expected == 0 {
+		return 100
+	}
+
+	pc := 100 * float64(n.expected-n.missed) / float64(n.expected)
+	if pc < 0 {
+		pc = 0
+	}
+	return pc
+}
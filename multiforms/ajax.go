@@ -0,0 +1,64 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package multiforms
+
+// Server support for forms submitted by fetch, with errors returned as JSON (see multiforms-ajax-01.js).
+// Without JavaScript, the same form is submitted normally and the page is rendered again with errors.
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ajaxHeader is set by the client script on requests submitted by fetch.
+const ajaxHeader = "X-Multiforms"
+
+// ajaxResponse is the JSON response to a form submitted by fetch.
+type ajaxResponse struct {
+	Redirect    string              `json:"redirect,omitempty"`
+	Errors      map[string][]string `json:"errors,omitempty"`      // by field name
+	ChildErrors map[string][]string `json:"childErrors,omitempty"` // by ID, as returned by Child.ChildId
+	Summary     []*SummaryError     `json:"summary,omitempty"`
+}
+
+// IsAjax returns true if a form was submitted by the client script, and expects a JSON response.
+func IsAjax(r *http.Request) bool {
+	return r.Header.Get(ajaxHeader) != ""
+}
+
+// Redirect sends the client to the next page after a successful submission, by a JSON response
+// to a form submitted by fetch, or by an HTTP redirect otherwise.
+func Redirect(w http.ResponseWriter, r *http.Request, url string) {
+
+	if IsAjax(r) {
+		writeJSON(w, http.StatusOK, &ajaxResponse{Redirect: url})
+	} else {
+		http.Redirect(w, r, url, http.StatusSeeOther)
+	}
+}
+
+// WriteErrors sends the form and child errors as JSON, for the client script to show them on the page.
+// Call it instead of rendering the page again, when IsAjax returns true.
+func (f *Form) WriteErrors(w http.ResponseWriter) {
+
+	resp := &ajaxResponse{
+		Errors:      f.Errors,
+		ChildErrors: make(map[string][]string),
+		Summary:     f.ErrorSummary(),
+	}
+	for field, ce := range f.ChildErrors {
+		for ix, msgs := range ce {
+			resp.ChildErrors[childId(field, ix)] = msgs
+		}
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, resp)
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
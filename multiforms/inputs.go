@@ -0,0 +1,109 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package multiforms
+
+// HTML5 range and colour inputs.
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ChildColour returns the value of an HTML colour input from a child form.
+func (f *Form) ChildColour(field string, i int, ix int) color.RGBA {
+
+	// don't validate template
+	if ix == -1 {
+		return color.RGBA{}
+	}
+
+	c, err := parseColour(f.Values[field][i])
+	if err != "" {
+		f.ChildErrors.Add(field, ix, err)
+	}
+	return c
+}
+
+// ChildRange returns the value of an HTML range input from a child form, validated against the input's min, max and step.
+// A step of 0 allows any value.
+func (f *Form) ChildRange(field string, i int, ix int, min float64, max float64, step float64) float64 {
+
+	// don't validate template
+	if ix == -1 {
+		return min
+	}
+
+	n, err := parseRange(f.Values[field][i], min, max, step)
+	if err != "" {
+		f.ChildErrors.Add(field, ix, err)
+	}
+	return n
+}
+
+// Colour returns the value of an HTML colour input.
+func (f *Form) Colour(field string) color.RGBA {
+
+	c, err := parseColour(f.Get(field))
+	if err != "" {
+		f.Errors.Add(field, err)
+	}
+	return c
+}
+
+// ColourValue formats a colour as a value for an HTML colour input.
+func ColourValue(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Range returns the value of an HTML range input, validated against the input's min, max and step.
+// A step of 0 allows any value.
+func (f *Form) Range(field string, min float64, max float64, step float64) float64 {
+
+	n, err := parseRange(f.Get(field), min, max, step)
+	if err != "" {
+		f.Errors.Add(field, err)
+	}
+	return n
+}
+
+// parseColour converts a value in #rrggbb format, returning an error message if it is invalid.
+func parseColour(s string) (color.RGBA, string) {
+
+	s = strings.TrimSpace(s)
+	if len(s) != 7 || s[0] != '#' {
+		return color.RGBA{}, "Must be a colour"
+	}
+
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, "Must be a colour"
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, ""
+}
+
+// parseRange converts a range value, returning an error message if it is invalid.
+// Browsers prevent values out of range, so these errors are unlikely from a legitimate user.
+func parseRange(s string, min float64, max float64, step float64) (float64, string) {
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return min, "Must be a number"
+	}
+
+	if n < min {
+		return min, "Too small"
+	} else if n > max {
+		return max, "Too large"
+	}
+
+	if step > 0 {
+		steps := (n - min) / step
+		if math.Abs(steps-math.Round(steps)) > 0.000001 {
+			return n, "Must be in steps of " + strconv.FormatFloat(step, 'f', -1, 64)
+		}
+	}
+	return n, ""
+}
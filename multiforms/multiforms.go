@@ -43,6 +43,12 @@ type Form struct {
 	CSRFToken   string
 	Errors      formErrors
 	ChildErrors childErrors
+
+	labels []Label // for error summary
+
+	// signed fields (see SetSigning)
+	signingKey []byte
+	scope      string
 }
 
 // Child specifies a child form.
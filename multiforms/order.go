@@ -0,0 +1,53 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package multiforms
+
+// Ordering of child items.
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ChildOrder returns the position of a child item, from an order field set by multiforms-04.js.
+func (f *Form) ChildOrder(field string, i int, ix int) int {
+
+	// template has no position
+	if ix == -1 {
+		return 0
+	}
+
+	n, err := strconv.Atoi(f.Values[field][i])
+	if err != nil {
+		f.ChildErrors.Add(field, ix, "Must be a number")
+	}
+	return n
+}
+
+// CheckOrder validates the positions of a set of child items, specified by their indexes and positions.
+// Positions must be 1 to n, where n is the number of items, with no duplicates.
+func (f *Form) CheckOrder(field string, ixs []int, positions []int) {
+
+	// number of items, excluding the template
+	n := 0
+	for _, ix := range ixs {
+		if ix != -1 {
+			n++
+		}
+	}
+	seen := make(map[int]bool, n)
+
+	for j, pos := range positions {
+		ix := ixs[j]
+		if ix == -1 {
+			continue
+		}
+
+		if pos < 1 || pos > n {
+			f.ChildErrors.Add(field, ix, fmt.Sprintf("Must be 1 to %d", n))
+		} else if seen[pos] {
+			f.ChildErrors.Add(field, ix, "Duplicate position")
+		}
+		seen[pos] = true
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package multiforms
+
+// Hidden fields with values that cannot be changed by the client.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoKey is returned for a signed field on a form without a signing key.
+	ErrNoKey = errors.New("webparts/multiforms: no signing key")
+
+	// ErrTampered is returned for a signed field that has been changed by the client.
+	// Typically it should be reported as a threat.
+	ErrTampered = errors.New("webparts/multiforms: signed field changed")
+)
+
+// SetSigning specifies the secret key for signed hidden fields on the form, and a scope for the values.
+// The scope should identify the form and the user's session, such as a form name and session ID,
+// so that a signed value cannot be copied to another form or session. It must be the same when the form is returned.
+func (f *Form) SetSigning(key []byte, scope string) {
+	f.signingKey = key
+	f.scope = scope
+}
+
+// SignedHidden returns a hidden input for a value that must be returned unchanged, such as a database ID.
+func (f *Form) SignedHidden(field string, value string) (template.HTML, error) {
+	return f.signedInput(field, -1, value)
+}
+
+// Signed returns the value of a signed hidden field.
+// If the value has been changed, it adds a form error and returns ErrTampered.
+func (f *Form) Signed(field string) (string, error) {
+
+	value, err := f.verify(field, -1, f.Get(field))
+	if err == ErrTampered {
+		f.Errors.Add(field, "Value changed")
+	}
+	return value, err
+}
+
+// ChildSigned returns the value of a signed hidden field from a child form.
+// If the value has been changed, or moved from another child, it adds a child error and returns ErrTampered.
+func (f *Form) ChildSigned(field string, i int, ix int) (string, error) {
+
+	// template has no value
+	if ix == -1 {
+		return "", nil
+	}
+
+	value, err := f.verify(field, ix, f.Values[field][i])
+	if err == ErrTampered {
+		f.ChildErrors.Add(field, ix, "Value changed")
+	}
+	return value, err
+}
+
+// ChildSignedHidden returns a hidden input for a child value that must be returned unchanged.
+func (c *Child) ChildSignedHidden(field string, value string) (template.HTML, error) {
+
+	// template has no value
+	if c.ChildIndex == -1 {
+		return c.Parent.signedInput(field, -1, "")
+	}
+	return c.Parent.signedInput(field, c.ChildIndex, value)
+}
+
+// sign returns a signature for a field value. The scope, field name and child index are included
+// so that values cannot be swapped between forms, fields or children.
+func (f *Form) sign(field string, ix int, value string) (string, error) {
+
+	if len(f.signingKey) == 0 {
+		return "", ErrNoKey
+	}
+
+	mac := hmac.New(sha256.New, f.signingKey)
+	for _, s := range []string{f.scope, field, strconv.Itoa(ix), value} {
+		mac.Write([]byte(strconv.Itoa(len(s))))
+		mac.Write([]byte{0})
+		mac.Write([]byte(s))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signedInput returns the HTML for a signed hidden input.
+func (f *Form) signedInput(field string, ix int, value string) (template.HTML, error) {
+
+	sig, err := f.sign(field, ix, value)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML("<input type='hidden' name='" + template.HTMLEscapeString(field) +
+		"' value='" + template.HTMLEscapeString(value+"."+sig) + "'>"), nil
+}
+
+// verify checks a signed value, and returns the value without its signature.
+func (f *Form) verify(field string, ix int, signed string) (string, error) {
+
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		if len(f.signingKey) == 0 {
+			return "", ErrNoKey
+		}
+		return "", ErrTampered
+	}
+	value := signed[:i]
+
+	sig, err := f.sign(field, ix, value)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(signed[i+1:]), []byte(sig)) {
+		return "", ErrTampered
+	}
+	return value, nil
+}
@@ -0,0 +1,115 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package multiforms
+
+// Summary of all form errors, with links to the fields, for display at the top of a page.
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Label names a form field for the error summary.
+type Label struct {
+	Field string // name of form field
+	Text  string // label shown to the user
+}
+
+// SummaryError is an item in the error summary.
+type SummaryError struct {
+	Label   string // field label, with the item number for a child field
+	Message string
+	Anchor  string // ID of the field's input element, empty if the error is not for a single field
+}
+
+// ChildId returns the ID for a child's input element, to be linked from the error summary.
+func (c *Child) ChildId(field string) string {
+	return childId(field, c.ChildIndex)
+}
+
+// ErrorSummary returns all the form and child errors, for the errorSummary partial template.
+// Errors are ordered as the labels set by SetLabels, with form errors first and then child errors in child order.
+// Errors for fields without labels follow, in name order.
+// Anchors for form fields are the field names, and for child fields are as returned by Child.ChildId.
+func (f *Form) ErrorSummary() []*SummaryError {
+
+	var summary []*SummaryError
+
+	// field order and labels
+	labels := make(map[string]string, len(f.labels))
+	order := make([]string, 0, len(f.labels))
+	for _, l := range f.labels {
+		labels[l.Field] = l.Text
+		order = append(order, l.Field)
+	}
+	order = append(order, unlabelled(labels, f.Errors, f.ChildErrors)...)
+
+	// form errors
+	for _, field := range order {
+		for _, msg := range f.Errors[field] {
+			e := &SummaryError{Label: labels[field], Message: msg}
+			if e.Label != "" {
+				e.Anchor = field // generic messages have no label
+			}
+			summary = append(summary, e)
+		}
+	}
+
+	// child errors, by child
+	var ixs []int
+	seen := make(map[int]bool)
+	for _, ce := range f.ChildErrors {
+		for ix := range ce {
+			if !seen[ix] {
+				seen[ix] = true
+				ixs = append(ixs, ix)
+			}
+		}
+	}
+	sort.Ints(ixs)
+
+	for _, ix := range ixs {
+		for _, field := range order {
+			label := labels[field]
+			if label == "" {
+				label = field
+			}
+			for _, msg := range f.ChildErrors[field][ix] {
+				summary = append(summary, &SummaryError{
+					Label:   label + " (" + strconv.Itoa(ix+1) + ")",
+					Message: msg,
+					Anchor:  childId(field, ix),
+				})
+			}
+		}
+	}
+	return summary
+}
+
+// SetLabels specifies the order and labels of fields for the error summary.
+func (f *Form) SetLabels(labels ...Label) {
+	f.labels = labels
+}
+
+// childId returns the ID for a child's input element.
+func childId(field string, ix int) string {
+	return field + "-" + strconv.Itoa(ix)
+}
+
+// unlabelled returns the fields with errors that have no labels, in name order.
+func unlabelled(labels map[string]string, fe formErrors, ce childErrors) []string {
+
+	var fields []string
+	for field := range fe {
+		if _, ok := labels[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	for field := range ce {
+		if _, ok := labels[field]; !ok && len(fe[field]) == 0 {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
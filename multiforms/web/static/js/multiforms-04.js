@@ -0,0 +1,200 @@
+// Copyright © Rob Burke inchworks.com, 2020.
+
+// Client-side functions.
+
+// Add and remove sub-forms from lists of items. It assumes only one set of sub-forms per page.
+// Supports optional confirmation of deletions.
+// Supports optional reordering of sub-forms by dragging, with positions set in inputs of class childOrder.
+
+var $collectionHolder;
+var $prototype;
+var nextID = 1;
+
+jQuery(document).ready(function() {
+
+     // Get the div that holds the collection of items
+    $collectionHolder = $('#formChildren');
+
+    // prototype sub-form is the first one
+    $prototype = $collectionHolder.find('div').first();
+
+    // handle delete button
+    $('.btnDeleteChild').on('click', function(evt) {
+
+       // prevent the link from creating a "#" on the URL
+       evt.preventDefault();
+
+       // remove the div for the deleted item
+       $(this).closest('.childForm').remove();
+       renumberChildren();
+    });
+
+    // handle delete with confirmation
+    $('.btnConfirmDelChild').on('click', function(evt)	{
+      confirmDelete($(this).closest('.childForm'), evt);
+    });
+
+    $('.btnAddChild').on('click', function(evt) {
+        // prevent the link from creating a "#" on the URL
+        evt.preventDefault();
+
+        // add a new child form
+        addChildForm($collectionHolder);
+    });
+
+    // handle reordering
+    enableReorder($collectionHolder);
+ 
+    // add any page-specific processing
+    pageReady();
+ });
+
+function addChildForm($collectionHolder) {
+
+    // clone the prototype
+    var $newForm = $prototype.clone();
+
+ 	  // add change handlers (not copied with prototype, it seems)
+	  $newForm.find('.btnDeleteChild').on('click', function(evt) {
+        // prevent the link from creating a "#" on the URL
+        evt.preventDefault();
+
+        // remove the div for the deleted item
+        $(this).closest('.childForm').remove();
+        renumberChildren();
+    });
+
+    // handle delete with confirmation
+    $newForm.find('.btnConfirmDelChild').on('click', function(evt)	{
+        confirmDelete($(this).closest('.childForm'), evt);
+    });
+
+    // hide any buttons that needs child to exist
+    $newForm.find('.notOnNew').hide();
+
+    // give the new form a unique ID
+    var id = "NF" + nextID++;
+    $newForm.attr("id", id);
+
+    // do any page-specific processing
+    childAdded($prototype, $newForm);
+
+    // display the form in the page, after the final one
+    var $prev = $collectionHolder.children().last();
+    $collectionHolder.append($newForm);
+
+    // set the index, needed so that form shows when redisplayed on error, and for checkbox values
+    var newIx = Number($prev.find('input[name="index"]').val()) + 1
+    $newForm.find('input[name="index"]').val(newIx)
+    
+    // set value of any checkboxes to the child index
+    $newForm.find(':checkbox').val(newIx)
+    
+    // make form visible
+    $newForm.css('display', 'block');
+
+    // position at end
+    renumberChildren();
+ 
+    return $newForm;
+}
+
+// Reordering by drag and drop. Only the handle (class dragHandle) starts a drag.
+
+function enableReorder($collectionHolder) {
+
+    var $dragged = null;
+
+    $collectionHolder.on('mousedown touchstart', '.dragHandle', function() {
+        $(this).closest('.childForm').attr('draggable', 'true');
+    });
+
+    $collectionHolder.on('dragstart', '.childForm', function(evt) {
+        $dragged = $(this);
+        evt.originalEvent.dataTransfer.effectAllowed = 'move';
+        evt.originalEvent.dataTransfer.setData('text/plain', '');
+    });
+
+    $collectionHolder.on('dragover', '.childForm', function(evt) {
+        if ($dragged)
+            evt.preventDefault();
+    });
+
+    $collectionHolder.on('drop', '.childForm', function(evt) {
+        evt.preventDefault();
+        if (!$dragged || this === $dragged[0])
+            return;
+
+        // insert before or after the target, depending on which half it was dropped on
+        var rect = this.getBoundingClientRect();
+        if (evt.originalEvent.clientY < rect.top + rect.height / 2)
+            $dragged.insertBefore(this);
+        else
+            $dragged.insertAfter(this);
+
+        renumberChildren();
+    });
+
+    $collectionHolder.on('dragend', '.childForm', function() {
+        $(this).removeAttr('draggable');
+        $dragged = null;
+    });
+}
+
+// Set positions 1 to n for the child forms, skipping the template.
+function renumberChildren() {
+    var n = 1;
+    $collectionHolder.children('.childForm').each(function() {
+        if ($(this).find('input[name="index"]').val() != "-1")
+            $(this).find('.childOrder').val(n++);
+    });
+}
+
+// confirm deletion
+
+function confirmDelete($child, evt) {
+
+		var callback = function() {
+   			evt.preventDefault();
+
+   			// remove the div for the deleted item
+   			$child.remove();
+   			renumberChildren();
+		};
+
+	  confirm(confirmAsk($child), 'Cancel', 'Confirm', callback);
+}
+
+// Modal confirmation dialog
+// From https://stackoverflow.com/questions/8982295/confirm-deletion-in-modal-dialog-using-twitter-bootstrap/10124151#10124151
+
+function confirm(ask, cancelButtonTxt, okButtonTxt, callback) {
+
+    var confirmModal = 
+      $('<div class="modal fade">' +        
+          '<div class="modal-dialog">' +
+          '<div class="modal-content">' +
+
+          '<div class="modal-body">' +
+            '<p>' + ask + '</p>' +
+          '</div>' +
+
+          '<div class="modal-footer">' +
+            '<a href="#!" class="btn" data-dismiss="modal">' + 
+              cancelButtonTxt + 
+            '</a>' +
+            '<a href="#!" id="okButton" class="btn btn-primary">' + 
+              okButtonTxt + 
+            '</a>' +
+          '</div>' +
+          '</div>' +
+          '</div>' +
+        '</div>');
+
+    confirmModal.find('#okButton').click(function(event) {
+        callback();
+        confirmModal.modal('hide');
+    }); 
+
+    confirmModal.modal('show');    
+}
\ No newline at end of file
@@ -0,0 +1,102 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+// Client-side submission of forms by fetch, with errors shown without reloading the page.
+
+// Add class ajaxForm to a form. The server responds with JSON, using multiforms.Redirect and Form.WriteErrors.
+// Field errors are shown with Bootstrap classes on the input with the field's name (or child ID),
+// and generic errors in an alert at the top of the form. If the request fails, the form is submitted normally.
+
+document.addEventListener('DOMContentLoaded', function() {
+
+    document.querySelectorAll('form.ajaxForm').forEach(function(form) {
+        form.addEventListener('submit', function(evt) {
+            evt.preventDefault();
+            submitAjax(form);
+        });
+    });
+});
+
+function submitAjax(form) {
+
+    fetch(form.action, {
+        method: 'POST',
+        body: new FormData(form),
+        credentials: 'same-origin',
+        headers: { 'X-Multiforms': '1', 'Accept': 'application/json' }
+    })
+    .then(function(response) {
+        var type = response.headers.get('Content-Type') || '';
+        if (type.indexOf('application/json') !== 0) {
+            throw new Error('not JSON');
+        }
+        return response.json();
+    })
+    .then(function(result) {
+        if (result.redirect) {
+            window.location.assign(result.redirect);
+        } else {
+            showErrors(form, result);
+        }
+    })
+    .catch(function() {
+        // fall back to a normal submission
+        form.submit();
+    });
+}
+
+function showErrors(form, result) {
+
+    // remove previous errors
+    form.querySelectorAll('.is-invalid').forEach(function(el) { el.classList.remove('is-invalid'); });
+    form.querySelectorAll('.ajaxFeedback').forEach(function(el) { el.remove(); });
+
+    var generic = [];
+    var first = null;
+
+    function mark(input, msgs) {
+        input.classList.add('is-invalid');
+        var fb = document.createElement('div');
+        fb.className = 'invalid-feedback ajaxFeedback';
+        fb.textContent = msgs.join(' ');
+        input.insertAdjacentElement('afterend', fb);
+        if (first === null) {
+            first = input;
+        }
+    }
+
+    var errors = result.errors || {};
+    Object.keys(errors).forEach(function(field) {
+        var input = form.querySelector('[name="' + CSS.escape(field) + '"]');
+        if (input) {
+            mark(input, errors[field]);
+        } else {
+            generic = generic.concat(errors[field]);
+        }
+    });
+
+    var childErrors = result.childErrors || {};
+    Object.keys(childErrors).forEach(function(id) {
+        var input = document.getElementById(id);
+        if (input && form.contains(input)) {
+            mark(input, childErrors[id]);
+        } else {
+            generic = generic.concat(childErrors[id]);
+        }
+    });
+
+    if (generic.length > 0) {
+        var alert = document.createElement('div');
+        alert.className = 'alert alert-danger ajaxFeedback';
+        alert.setAttribute('role', 'alert');
+        alert.textContent = generic.join(' ');
+        form.insertAdjacentElement('afterbegin', alert);
+        first = alert;
+    }
+
+    if (first !== null) {
+        first.scrollIntoView({ block: 'center' });
+        if (first.focus) {
+            first.focus();
+        }
+    }
+}
@@ -0,0 +1,182 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Limit the size of HTTP request bodies.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// BodyLimits specifies the maximum size of request bodies, so that each handler need not be guarded individually.
+type BodyLimits struct {
+	Default  int64            // limit for paths not listed (0 for no limit)
+	Paths    map[string]int64 // limits for path prefixes, such as a large limit for uploads (longest match applies)
+	TooLarge http.Handler     // optional response to a request that is too large
+
+	errorPage func(w http.ResponseWriter, r *http.Request, status int, msg string) // from Server.ErrorPages
+}
+
+// Handler returns a handler that applies the body size limit for each request path.
+// Requests that declare a body larger than the limit are rejected immediately with status 413.
+// Otherwise the body is read through http.MaxBytesReader, so a handler sees an error if the limit is exceeded,
+// such as for a chunked body without a declared length. Then the same response is sent, unless the handler has already responded.
+func (bl *BodyLimits) Handler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		max := bl.limit(r.URL.Path)
+		if max > 0 {
+			if r.ContentLength > max {
+				if bl.TooLarge != nil {
+					bl.TooLarge.ServeHTTP(w, r)
+				} else {
+					bl.tooLarge(w, r, max)
+				}
+				return
+			}
+			if r.ContentLength >= 0 {
+				// a declared length is enforced by net/http, so the handler sees only the truncated body
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+
+			} else {
+				lb := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max), max: max}
+				r.Body = lb
+				lw := &limitedWriter{ResponseWriter: w, body: lb}
+				next.ServeHTTP(lw, r)
+
+				if lb.exceeded && !lw.wrote {
+					lw.respond(bl, r, max)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody notes if a request body of unknown length exceeded its limit.
+type limitedBody struct {
+	io.ReadCloser
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+// limitedWriter replaces a handler's response by the standard one, if the request body exceeded its limit.
+// It forwards the optional http.Flusher, http.Hijacker and http.Pusher interfaces.
+type limitedWriter struct {
+	http.ResponseWriter
+	body  *limitedBody
+	wrote bool
+}
+
+// Read reads the body, noting if the limit is exceeded.
+func (lb *limitedBody) Read(p []byte) (int, error) {
+
+	n, err := lb.ReadCloser.Read(p)
+	lb.n += int64(n)
+
+	// http.MaxBytesReader fails after returning exactly the limit
+	if err != nil && err != io.EOF && lb.n >= lb.max {
+		lb.exceeded = true
+	}
+	return n, err
+}
+
+// Flush sends any buffered data, if supported.
+func (lw *limitedWriter) Flush() {
+
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok && lw.wrote {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, if supported.
+func (lw *limitedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+
+	h, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("server: connection cannot be hijacked")
+	}
+	lw.wrote = true
+	return h.Hijack()
+}
+
+// Push initiates an HTTP/2 server push, if supported.
+func (lw *limitedWriter) Push(target string, opts *http.PushOptions) error {
+
+	if p, ok := lw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// WriteHeader sends the handler's status, unless the body was too large.
+func (lw *limitedWriter) WriteHeader(status int) {
+
+	if lw.wrote || lw.body.exceeded {
+		return // the standard response is sent when the handler returns
+	}
+	lw.wrote = true
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+// Write sends the handler's response, or discards it if the body was too large.
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+
+	lw.WriteHeader(http.StatusOK)
+	if !lw.wrote {
+		return len(b), nil
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+// respond sends the standard response for a request that is too large.
+func (lw *limitedWriter) respond(bl *BodyLimits, r *http.Request, max int64) {
+
+	lw.wrote = true
+	if bl.TooLarge != nil {
+		bl.TooLarge.ServeHTTP(lw.ResponseWriter, r)
+	} else {
+		bl.tooLarge(lw.ResponseWriter, r, max)
+	}
+}
+
+// limit returns the body size limit for a path.
+func (bl *BodyLimits) limit(path string) int64 {
+
+	max := bl.Default
+	var longest int
+
+	for prefix, n := range bl.Paths {
+		if len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			max = n
+			longest = len(prefix)
+		}
+	}
+	return max
+}
+
+// tooLarge sends the default response for a request that is too large.
+func (bl *BodyLimits) tooLarge(w http.ResponseWriter, r *http.Request, max int64) {
+
+	var sz string
+	if max >= 1<<20 {
+		sz = fmt.Sprintf("%d MB", max>>20)
+	} else {
+		sz = fmt.Sprintf("%d KB", (max+1023)>>10)
+	}
+	msg := "Request too large. The maximum for this page is " + sz + "."
+	if bl.errorPage != nil {
+		bl.errorPage(w, r, http.StatusRequestEntityTooLarge, msg)
+	} else {
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+	}
+}
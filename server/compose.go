@@ -0,0 +1,154 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Composition of middleware, for virtual hosts and path prefixes.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps an HTTP handler with additional processing, such as GeoBlocker.GeoBlock.
+// For a limithandler, use a function that calls Handlers.New with its next parameter.
+type Middleware func(next http.Handler) http.Handler
+
+// Chain is a sequence of middleware, applied in order so that the first is outermost.
+// Groups of requests, for a virtual host or path prefix, add their own middleware to the chain they are made from.
+type Chain struct {
+	host   string // empty for any host
+	prefix string // empty for any path
+	mws    []Middleware
+	parent *Chain
+	groups []*Chain // groups made from the root chain or its descendants
+}
+
+// route is a group's handler, with the middleware applied.
+type route struct {
+	host    string
+	prefix  string
+	handler http.Handler
+}
+
+// NewChain returns a chain of middleware, applied to all requests.
+func NewChain(mws ...Middleware) *Chain {
+	return &Chain{mws: mws}
+}
+
+// Handler returns a handler that passes requests to next, through the middleware for the most specific matching group.
+// A group for a host is more specific than one for any host, and a longer path prefix is more specific than a shorter one.
+// It may be called for any chain, and uses all the groups made from the root chain.
+func (c *Chain) Handler(next http.Handler) http.Handler {
+
+	root := c.root()
+
+	// apply middleware for each group
+	routes := make([]route, 0, len(root.groups))
+	for _, g := range root.groups {
+		routes = append(routes, route{host: g.host, prefix: g.prefix, handler: g.Then(next)})
+	}
+	deflt := root.Then(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		host := requestHost(r)
+		best := -1
+		bestScore := -1
+		for i, rt := range routes {
+			if rt.host != "" && rt.host != host {
+				continue
+			}
+			if !matchPrefix(r.URL.Path, rt.prefix) {
+				continue
+			}
+
+			// host match beats any path
+			score := len(rt.prefix)
+			if rt.host != "" {
+				score += 1 << 16
+			}
+			if score > bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+
+		if best >= 0 {
+			routes[best].handler.ServeHTTP(w, r)
+		} else {
+			deflt.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Host returns a group for requests to a virtual host, with the middleware of this chain.
+func (c *Chain) Host(host string) *Chain {
+	return c.group(strings.ToLower(host), c.prefix)
+}
+
+// Path returns a group for requests with a path prefix, such as "/admin/", with the middleware of this chain.
+// A prefix matches whole path segments, so that "/admin" matches "/admin" and "/admin/users" but not "/administrator".
+func (c *Chain) Path(prefix string) *Chain {
+	return c.group(c.host, prefix)
+}
+
+// Then returns a handler for next with the middleware of this chain and the chains it was made from.
+// Use it, like justinas/alice, to add middleware to individual routes.
+func (c *Chain) Then(next http.Handler) http.Handler {
+
+	// innermost is the last middleware added to this chain, outermost the first added to the root
+	h := next
+	for cc := c; cc != nil; cc = cc.parent {
+		for i := len(cc.mws) - 1; i >= 0; i-- {
+			h = cc.mws[i](h)
+		}
+	}
+	return h
+}
+
+// Use adds middleware to the chain. It returns the chain, so that calls can be combined.
+func (c *Chain) Use(mws ...Middleware) *Chain {
+	c.mws = append(c.mws, mws...)
+	return c
+}
+
+// group adds a group to the root chain.
+func (c *Chain) group(host string, prefix string) *Chain {
+
+	g := &Chain{host: host, prefix: prefix, parent: c}
+	root := c.root()
+	root.groups = append(root.groups, g)
+	return g
+}
+
+// matchPrefix returns true if a path starts with whole segments of a prefix.
+func matchPrefix(path string, prefix string) bool {
+
+	if prefix == "" || path == prefix {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// requestHost returns the host name for a request, without a port.
+func requestHost(r *http.Request) string {
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// root returns the chain from which all groups are made.
+func (c *Chain) root() *Chain {
+
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
@@ -0,0 +1,236 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Verification of requests claiming to be from search engine crawlers.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawlers verifies requests with the user-agent of a search engine crawler, using forward-confirmed reverse DNS.
+// Verified crawlers are exempt from geo-blocking, and impostors are reported, and blocked unless the GeoBlocker is in Observe mode.
+// Addresses are checked in the background, so the first requests from a crawler are treated as ordinary requests.
+type Crawlers struct {
+	Agents     map[string][]string              // user-agent substrings and their permitted host domains (default Googlebot and Bingbot)
+	CacheFor   time.Duration                    // time to remember results for an address (default 24 hours)
+	OnImpostor func(r *http.Request, ip string) // optional report of an impostor, such as a function that calls limithandler Handlers.Ban
+	Resolver   *net.Resolver                    // optional resolver (default net.DefaultResolver)
+
+	mu       sync.Mutex
+	verified map[string]verification // by IP address
+	pending  map[string]bool         // addresses being checked
+}
+
+// verification is a cached result of a DNS check.
+type verification struct {
+	ok bool
+	at time.Time
+}
+
+const (
+	dnsTimeout = 5 * time.Second
+	maxCached  = 10000 // addresses, before expired entries are removed
+	maxPending = 100   // addresses checked at the same time
+)
+
+var defaultCrawlers = map[string][]string{
+	"Googlebot": {"googlebot.com", "google.com", "googleusercontent.com"},
+	"bingbot":   {"search.msn.com"},
+}
+
+// Claimed returns the permitted host domains if a request claims to be from a crawler, or nil otherwise.
+func (cs *Crawlers) Claimed(r *http.Request) []string {
+
+	agents := cs.Agents
+	if agents == nil {
+		agents = defaultCrawlers
+	}
+
+	ua := r.UserAgent()
+	for agent, domains := range agents {
+		if strings.Contains(ua, agent) {
+			return domains
+		}
+	}
+	return nil
+}
+
+// Verify returns true if an IP address has a host name in one of the domains, and that name resolves to the address.
+// It waits for DNS if the result is not cached. Only definite results are cached, and not failures such as a timeout.
+func (cs *Crawlers) Verify(ip string, domains []string) bool {
+
+	if ok, known := cs.cached(ip); known {
+		return ok
+	}
+
+	ok, err := cs.lookup(ip, domains)
+	if err == nil {
+		cs.save(ip, ok)
+	}
+	return ok
+}
+
+// cached returns the cached result for an address, and false if there isn't one.
+func (cs *Crawlers) cached(ip string) (ok bool, known bool) {
+
+	// SERIALISED
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	v, known := cs.verified[ip]
+	if known && time.Since(v.at) < cs.cacheFor() {
+		return v.ok, true
+	}
+	return false, false
+}
+
+// cacheFor returns the time to remember results.
+func (cs *Crawlers) cacheFor() time.Duration {
+
+	if cs.CacheFor == 0 {
+		return 24 * time.Hour
+	}
+	return cs.CacheFor
+}
+
+// check returns 1 if a request is from a verified crawler, -1 for an impostor, and 0 if it doesn't claim to be a crawler.
+// An address not yet verified is checked in the background, so its request is treated as if it made no claim.
+func (cs *Crawlers) check(r *http.Request, ip string) int {
+
+	domains := cs.Claimed(r)
+	if domains == nil {
+		return 0
+	}
+
+	ok, known := cs.cached(ip)
+	if !known {
+		cs.verifyLater(ip, domains)
+		return 0
+	}
+	if ok {
+		return 1
+	}
+
+	if cs.OnImpostor != nil {
+		cs.OnImpostor(r, ip)
+	}
+	return -1
+}
+
+// lookup performs forward-confirmed reverse DNS for an address.
+// It returns an error only if the result is uncertain, such as for a DNS timeout.
+func (cs *Crawlers) lookup(ip string, domains []string) (bool, error) {
+
+	res := cs.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	names, err := res.LookupAddr(ctx, ip)
+	if err != nil {
+		if notFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var uncertain error
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !inDomains(name, domains) {
+			continue
+		}
+
+		// forward confirmation
+		addrs, err := res.LookupHost(ctx, name)
+		if err != nil {
+			if !notFound(err) {
+				uncertain = err
+			}
+			continue
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a).Equal(net.ParseIP(ip)) {
+				return true, nil
+			}
+		}
+	}
+	return false, uncertain
+}
+
+// notFound returns true if a DNS error is a definite answer that the name or address does not exist.
+func notFound(err error) bool {
+
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// save caches a definite result for an address.
+func (cs *Crawlers) save(ip string, ok bool) {
+
+	cacheFor := cs.cacheFor()
+
+	// SERIALISED
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.verified == nil {
+		cs.verified = make(map[string]verification)
+	}
+	if len(cs.verified) >= maxCached {
+		for a, c := range cs.verified {
+			if time.Since(c.at) >= cacheFor {
+				delete(cs.verified, a)
+			}
+		}
+	}
+	cs.verified[ip] = verification{ok: ok, at: time.Now()}
+}
+
+// verifyLater starts a background check on an address, unless one is in progress or too many are running.
+func (cs *Crawlers) verifyLater(ip string, domains []string) {
+
+	// SERIALISED
+	cs.mu.Lock()
+	if cs.pending == nil {
+		cs.pending = make(map[string]bool)
+	}
+	if cs.pending[ip] || len(cs.pending) >= maxPending {
+		cs.mu.Unlock()
+		return
+	}
+	cs.pending[ip] = true
+	cs.mu.Unlock()
+
+	go func() {
+		ok, err := cs.lookup(ip, domains)
+		if err == nil {
+			cs.save(ip, ok)
+		}
+
+		// SERIALISED
+		cs.mu.Lock()
+		delete(cs.pending, ip)
+		cs.mu.Unlock()
+	}()
+}
+
+// inDomains returns true if a host name is in one of the domains.
+func inDomains(name string, domains []string) bool {
+
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Startup plumbing for a self-hosted server.
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// setup does the optional startup actions that are needed before ports are bound.
+func (srv *Server) setup() error {
+
+	// process ID
+	if srv.PidFile != "" {
+		if err := ioutil.WriteFile(srv.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	// file descriptors for media-heavy serving
+	if srv.MinFiles > 0 {
+		n, err := raiseFileLimit(srv.MinFiles)
+		if err != nil {
+			return err
+		}
+		if n < srv.MinFiles {
+			srv.ErrorLog.Printf("Open file limit is %d, %d recommended", n, srv.MinFiles)
+		}
+	}
+	return nil
+}
+
+// started does the optional startup actions needed after ports are bound.
+func (srv *Server) started() error {
+
+	// a replacement process is started by the previous one, already running as the user,
+	// so it must be able to rewrite the process ID file
+	if srv.RunAs != "" && srv.inherited == nil {
+		var owned []string
+		if srv.PidFile != "" {
+			owned = append(owned, srv.PidFile)
+		}
+		if err := dropPrivileges(srv.RunAs, owned...); err != nil {
+			return err
+		}
+		srv.InfoLog.Printf("Running as user %s", srv.RunAs)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package server
+
+import (
+	"errors"
+)
+
+// dropPrivileges is not supported.
+func dropPrivileges(name string, owned ...string) error {
+	return errors.New("server: RunAs is not supported on this system")
+}
+
+// raiseFileLimit does nothing, because there is no limit to check.
+func raiseFileLimit(min uint64) (uint64, error) {
+	return min, nil
+}
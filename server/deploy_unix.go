@@ -0,0 +1,70 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package server
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges changes the process to run as the specified user and the user's primary group,
+// after giving the user ownership of the files that it must be able to change.
+func dropPrivileges(name string, owned ...string) error {
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	// files that the user must be able to change
+	for _, f := range owned {
+		if err := os.Chown(f, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	// group first, while we still have permission to change it
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+// raiseFileLimit increases the limit on open files, as far as permitted, and returns the new limit.
+func raiseFileLimit(min uint64) (uint64, error) {
+
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	if uint64(lim.Cur) >= min {
+		return uint64(lim.Cur), nil
+	}
+
+	// raise the soft limit, up to the hard limit
+	want := min
+	if want > uint64(lim.Max) {
+		want = uint64(lim.Max)
+	}
+	lim.Cur = want
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	return want, nil
+}
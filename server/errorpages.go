@@ -0,0 +1,104 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Error pages that match the site.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// ErrorPages renders error responses using the site's templates, instead of plain text.
+// Other packages accept its Error method, for example:
+//
+//	gb.ErrorPage = ep.Error
+//	lhs.SetErrorPage(ep.Error)
+type ErrorPages struct {
+	Templates map[string]*template.Template // template cache, such as from stack.NewTemplates
+	Page      string                        // page template, given an ErrorPage (default "error.page.tmpl")
+	ErrorLog  *log.Logger
+}
+
+// ErrorPage is the template data for an error page.
+type ErrorPage struct {
+	Status  int    // HTTP status code
+	Title   string // status text
+	Message string // explanation, if any
+}
+
+// Error writes an error page with the specified status. msg is an optional explanation for the user.
+// It falls back to a plain text response if the page cannot be rendered.
+func (ep *ErrorPages) Error(w http.ResponseWriter, r *http.Request, status int, msg string) {
+
+	page := ep.Page
+	if page == "" {
+		page = "error.page.tmpl"
+	}
+
+	data := &ErrorPage{
+		Status:  status,
+		Title:   http.StatusText(status),
+		Message: msg,
+	}
+	if msg == "" {
+		msg = data.Title
+	}
+
+	ts := ep.Templates[page]
+	if ts == nil {
+		ep.log(fmt.Errorf("server: error page template %s not found", page))
+		http.Error(w, msg, status)
+		return
+	}
+
+	// render to a buffer, so that a template error doesn't give a partial page
+	var buf bytes.Buffer
+	if err := ts.Execute(&buf, data); err != nil {
+		ep.log(err)
+		http.Error(w, msg, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// Handler returns a handler that writes an error page, such as for page not found.
+func (ep *ErrorPages) Handler(status int, msg string) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ep.Error(w, r, status, msg)
+	})
+}
+
+// Recover returns a handler that sends an error page, instead of closing the connection, if a later handler panics.
+func (ep *ErrorPages) Recover(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // deliberate abort
+				}
+				w.Header().Set("Connection", "close")
+				ep.log(fmt.Errorf("%v\n%s", err, debug.Stack()))
+				ep.Error(w, r, http.StatusInternalServerError, "")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// log records an error, if there is a log.
+func (ep *ErrorPages) log(err error) {
+	if ep.ErrorLog != nil {
+		ep.ErrorLog.Output(2, err.Error())
+	}
+}
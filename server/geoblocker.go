@@ -12,9 +12,12 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/inchworks/webparts/metrics"
 )
 
 // put context key in its own type, to avoid collision with other packages using request context
@@ -26,23 +29,41 @@ type location struct {
 	country    string
 	registered string
 	ip         string
+	asn        uint   // autonomous system number, if known
+	org        string // autonomous system organisation
 }
 
 // GeoBlocker holds the parameters and state for geo-blocking. Typically only one is needed.
 type GeoBlocker struct {
 	Allow        bool // permit only specified countries, instead of blocking them
+	ASN          bool // also look up autonomous systems, from GeoLite2-ASN.mmdb
+	Observe      bool // locate requests and count them, but block none
 	ErrorLog     *log.Logger
 	Reporter     func(r *http.Request, location string, ip net.IP) string
 	ReportSingle bool   // report just location or registered country, not both
 	Store        string // storage location for database
 
+	// optional page for blocked requests, such as ErrorPages.Error
+	ErrorPage func(w http.ResponseWriter, r *http.Request, status int, msg string)
+
+	// optional verification of search engine crawlers, which are exempt from blocking, with impostors blocked
+	Crawlers *Crawlers
+
 	file    string          // source file for database
+	fileASN string          // source file for ASN database
 	listed  map[string]bool // specified countries
 	rejects int             // rejected requests (statistic)
 
-	// geoBlocking database
+	rejectsAll int64 // rejected requests since start (metric, updated atomically)
+
+	// requests by location (statistic)
+	muCounts sync.Mutex
+	counts   map[string]int
+
+	// geoBlocking databases
 	mutex sync.RWMutex
 	db    *maxminddb.Reader
+	dbASN *maxminddb.Reader
 
 	chDone chan bool
 }
@@ -58,18 +79,23 @@ func (gb *GeoBlocker) Start(countries []string) {
 
 	// reload geo database regularly
 	gb.file = filepath.Join(gb.Store, "GeoLite2-Country.mmdb")
+	gb.fileASN = filepath.Join(gb.Store, "GeoLite2-ASN.mmdb")
+	gb.counts = make(map[string]int)
 	gb.chDone = make(chan bool, 1)
 
 	go gb.reloader(24*time.Hour, gb.chDone)
 }
 
 // GeoBlock initialises and returns a handler to block IPs for some locations.
+// In Observe mode, locations are added to the request context and counted, but no requests are blocked.
 func (gb *GeoBlocker) GeoBlock(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		var ip net.IP
 		var ctry, reg string
+		var asn uint
+		var org string
 		var blocked bool
 
 		// location of request
@@ -77,17 +103,35 @@ func (gb *GeoBlocker) GeoBlock(next http.Handler) http.Handler {
 		ipStr, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err == nil {
 			ctry, reg, ip = gb.Locate(ipStr)
+			if gb.ASN {
+				asn, org = gb.LocateASN(ip)
+			}
 		}
 
 		// save for threat reporting
 		ctx := context.WithValue(
 			r.Context(),
 			contextKeyLocation,
-			location{country: ctry, registered: reg, ip: ipStr})
+			location{country: ctry, registered: reg, ip: ipStr, asn: asn, org: org})
 
-		// blocked location?
-		listed := gb.listed[ctry] || gb.listed[reg]
-		blocked = (listed == !gb.Allow) // blacklist or whitelist?
+		// claimed crawler?
+		var crawler int
+		if gb.Crawlers != nil && ipStr != "" {
+			crawler = gb.Crawlers.check(r, ipStr)
+		}
+
+		if gb.Observe {
+			gb.count(location2(reg, ctry))
+
+		} else if crawler < 0 {
+			gb.block(w, r, http.StatusForbidden, "Not a verified crawler")
+			return
+
+		} else if crawler == 0 {
+			// blocked location?
+			listed := gb.listed[ctry] || gb.listed[reg]
+			blocked = (listed == !gb.Allow) // blacklist or whitelist?
+		}
 
 		if blocked {
 			var loc, msg string
@@ -108,13 +152,14 @@ func (gb *GeoBlocker) GeoBlock(next http.Handler) http.Handler {
 				msg = gb.Reporter(r, loc, ip)
 			}
 			gb.rejects++ // statistic
+			atomic.AddInt64(&gb.rejectsAll, 1)
 
 			// default message
 			if msg == "" {
 				msg = "Access from " + loc + " not allowed"
 			}
 
-			http.Error(w, msg, http.StatusForbidden)
+			gb.block(w, r, http.StatusForbidden, msg)
 		} else {
 
 			next.ServeHTTP(w, r.WithContext(ctx))
@@ -123,6 +168,17 @@ func (gb *GeoBlocker) GeoBlock(next http.Handler) http.Handler {
 	})
 }
 
+// ASN returns the autonomous system number and organisation for the current request, if known.
+func ASN(r *http.Request) (asn uint, org string) {
+	v := r.Context().Value(contextKeyLocation)
+	if v != nil {
+		loc := v.(location)
+		asn = loc.asn
+		org = loc.org
+	}
+	return
+}
+
 // Country returns the location country code for the current request.
 func Country(r *http.Request) (loc string) {
 	v := r.Context().Value(contextKeyLocation)
@@ -166,6 +222,29 @@ func (gb *GeoBlocker) Locate(ipStr string) (country, registered string, ip net.I
 	return
 }
 
+// LocateASN looks up an IP address in the ASN database, and returns the autonomous system number and organisation.
+func (gb *GeoBlocker) LocateASN(ip net.IP) (asn uint, org string) {
+
+	// lock database against reload
+	gb.mutex.RLock()
+	defer gb.mutex.RUnlock()
+
+	if gb.dbASN != nil && ip != nil {
+
+		var rec struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := gb.dbASN.Lookup(ip, &rec); err != nil && gb.ErrorLog != nil {
+			gb.ErrorLog.Print("ASN lookup:", err)
+		} else {
+			asn = rec.Number
+			org = rec.Organization
+		}
+	}
+	return
+}
+
 // Location returns both the registered and location country codes for the current request, if they are different.
 func Location(r *http.Request) (loc string) {
 	v := r.Context().Value(contextKeyLocation)
@@ -185,6 +264,28 @@ func Registered(r *http.Request) (loc string) {
 	return
 }
 
+// LocationsCounted returns a statistic of the number of requests from each location, in Observe mode, and resets the counts.
+// Locations are formatted as for Location.
+func (gb *GeoBlocker) LocationsCounted() map[string]int {
+
+	// SERIALISED
+	gb.muCounts.Lock()
+	defer gb.muCounts.Unlock()
+
+	counts := gb.counts
+	gb.counts = make(map[string]int)
+	return counts
+}
+
+// Metrics implements metrics.Collector.
+func (gb *GeoBlocker) Metrics() []*metrics.Metric {
+
+	return []*metrics.Metric{
+		metrics.NewCounter("webparts_geoblocker_rejects_total", "Requests rejected by location.").
+			Add(float64(atomic.LoadInt64(&gb.rejectsAll))),
+	}
+}
+
 // RejectsCounted returns a statistic of the total number of requests rejected, and resets the count.
 func (gb *GeoBlocker) RejectsCounted() (rejects int) {
 
@@ -211,6 +312,25 @@ func (gb *GeoBlocker) Stop() {
 	close(gb.chDone)
 }
 
+// block rejects a request.
+func (gb *GeoBlocker) block(w http.ResponseWriter, r *http.Request, status int, msg string) {
+
+	if gb.ErrorPage != nil {
+		gb.ErrorPage(w, r, status, msg)
+	} else {
+		http.Error(w, msg, status)
+	}
+}
+
+// count adds a request to the statistics for a location.
+func (gb *GeoBlocker) count(loc string) {
+
+	// SERIALISED
+	gb.muCounts.Lock()
+	gb.counts[loc]++
+	gb.muCounts.Unlock()
+}
+
 // location2 returns both the registered and country codes for the current request, if they are different.
 func location2(reg string, ctry string) string {
 
@@ -230,7 +350,7 @@ func (gb *GeoBlocker) reloadGeoDB() {
 	gb.mutex.Lock()
 	defer gb.mutex.Unlock()
 
-	// close in-use database
+	// close in-use databases
 	if gb.db != nil {
 		err = gb.db.Close()
 		gb.db = nil
@@ -238,14 +358,24 @@ func (gb *GeoBlocker) reloadGeoDB() {
 	if err != nil && gb.ErrorLog != nil {
 		gb.ErrorLog.Print("Closing geo-location database:", err)
 	}
+	if gb.dbASN != nil {
+		gb.dbASN.Close()
+		gb.dbASN = nil
+	}
 
-	// reopen latest one, if geo-blocking is specified
-	if len(gb.listed) > 0 {
+	// reopen latest one, if geo-blocking or observation is specified
+	if len(gb.listed) > 0 || gb.Observe {
 		gb.db, err = maxminddb.Open(gb.file)
 		if err != nil && gb.ErrorLog != nil {
 			gb.ErrorLog.Print("No geo-location database:", err) // continue operation without geo-blocking
 		}
 	}
+	if gb.ASN {
+		gb.dbASN, err = maxminddb.Open(gb.fileASN)
+		if err != nil && gb.ErrorLog != nil {
+			gb.ErrorLog.Print("No ASN database:", err)
+		}
+	}
 }
 
 // reloader performs periodic updates.
@@ -264,12 +394,16 @@ func (gb *GeoBlocker) reloader(d time.Duration, done <-chan bool) {
 			gb.reloadGeoDB()
 
 		case <-done:
+			gb.mutex.Lock()
 			if gb.db != nil {
-				gb.mutex.Lock()
 				gb.db.Close()
 				gb.db = nil
-				gb.mutex.Unlock()
 			}
+			if gb.dbASN != nil {
+				gb.dbASN.Close()
+				gb.dbASN = nil
+			}
+			gb.mutex.Unlock()
 			return
 		}
 	}
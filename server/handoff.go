@@ -0,0 +1,213 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Handoff of listening sockets to a replacement process, so that a new version can be deployed without dropping requests.
+//
+// On a signal (SIGUSR2), the server starts a copy of its executable, passing the bound listeners as inherited files,
+// and waits for the replacement to confirm that it is ready. It then stops accepting connections, waits for requests
+// in progress (such as uploads) to finish, calls OnShutdown, and Serve returns.
+//
+// The replacement calls OnStart only when the previous process has exited, so that recovery of incomplete
+// operations cannot run while the previous process is still doing them.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// envHandoff is the environment variable that names the listeners passed to a replacement process.
+const envHandoff = "WEBPARTS_HANDOFF"
+
+// listener is a bound listener, named by its port type.
+type listener struct {
+	name string
+	net.Listener
+}
+
+// inherit gets the listeners passed by the process that started this one, if any.
+// Inherited files start at descriptor 3, in the order named, followed by a pipe to confirm readiness
+// and a pipe that is closed when the previous process exits.
+func (srv *Server) inherit() error {
+
+	names := os.Getenv(envHandoff)
+	if names == "" {
+		return nil
+	}
+	os.Unsetenv(envHandoff)
+
+	srv.inherited = make(map[string]net.Listener)
+	ns := strings.Split(names, ",")
+	for i, name := range ns {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		srv.inherited[name] = l
+	}
+	srv.ready = os.NewFile(uintptr(3+len(ns)), "ready")
+	srv.previous = os.NewFile(uintptr(4+len(ns)), "previous")
+	return nil
+}
+
+// listen returns a listener for an address, inherited or newly bound, with a default port if none is specified.
+func (srv *Server) listen(addr string, port string) (net.Listener, error) {
+
+	l := srv.inherited[port]
+	if l == nil {
+		if addr == "" {
+			addr = ":" + port
+		}
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	srv.listeners = append(srv.listeners, listener{name: port, Listener: l})
+	return l, nil
+}
+
+// confirmReady tells the process that started this one that it is now serving requests.
+// It calls OnStart now, or in the background when the previous process has exited.
+func (srv *Server) confirmReady() {
+
+	if srv.ready == nil {
+		if srv.OnStart != nil {
+			srv.OnStart()
+		}
+		return
+	}
+	if _, err := srv.ready.Write([]byte("ready\n")); err != nil {
+		srv.ErrorLog.Print("Handoff not confirmed: ", err.Error())
+	}
+	srv.ready.Close()
+	srv.ready = nil
+	srv.InfoLog.Print("Listeners taken over from previous process")
+
+	go func() {
+		// nothing is written, so this returns when the previous process exits
+		io.Copy(ioutil.Discard, srv.previous)
+		srv.previous.Close()
+		srv.InfoLog.Print("Previous process finished")
+
+		if srv.OnStart != nil {
+			srv.OnStart()
+		}
+	}()
+}
+
+// handoff starts a replacement process and, when it is ready, shuts down this server gracefully.
+func (srv *Server) handoff(servers ...*http.Server) {
+
+	if err := srv.startReplacement(); err != nil {
+		srv.ErrorLog.Print("Handoff failed, still serving: ", err.Error())
+		return
+	}
+	srv.InfoLog.Print("Handed off to replacement process, finishing requests")
+
+	timeout := srv.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			srv.ErrorLog.Print("Shutdown: ", err.Error())
+		}
+	}
+	if srv.OnShutdown != nil {
+		srv.OnShutdown()
+	}
+	close(srv.stopped)
+}
+
+// startReplacement runs a copy of this executable with the same arguments, passing it the listeners,
+// and waits for it to confirm that it is serving.
+func (srv *Server) startReplacement() error {
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range srv.listeners {
+		fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.New("server: listener " + l.name + " cannot be passed")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	// pipe for the replacement to confirm readiness
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// pipe held open by this process until it exits
+	rRunning, wRunning, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	defer rRunning.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envHandoff+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = append(files, w, rRunning)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		wRunning.Close()
+		return err
+	}
+
+	// wait for confirmation
+	timeout := srv.HandoffTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	r.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 6)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "ready\n" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		wRunning.Close()
+		if err == nil {
+			err = errors.New("server: unexpected confirmation from replacement process")
+		}
+		return err
+	}
+
+	// the replacement continues independently
+	srv.running = wRunning
+	go cmd.Wait()
+	return nil
+}
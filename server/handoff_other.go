@@ -0,0 +1,15 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package server
+
+import (
+	"net/http"
+)
+
+// watchHandoff is not supported.
+func (srv *Server) watchHandoff(servers ...*http.Server) {
+	srv.ErrorLog.Print("Handoff is not supported on this system")
+}
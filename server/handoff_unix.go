@@ -0,0 +1,34 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package server
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchHandoff waits for a signal to hand off the listeners to a replacement process.
+func (srv *Server) watchHandoff(servers ...*http.Server) {
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	go func() {
+		for range ch {
+			srv.handoff(servers...)
+
+			select {
+			case <-srv.stopped:
+				signal.Stop(ch)
+				return
+			default:
+				// failed, so wait for another attempt
+			}
+		}
+	}()
+}
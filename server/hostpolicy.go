@@ -0,0 +1,105 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Decide which domains may have certificates.
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// HostPolicy allows certificates to be obtained on demand for domains not listed in Server.Domains,
+// so that a multi-tenant server can add domains without a restart.
+type HostPolicy struct {
+	Wildcards []string                                     // domain patterns such as "*.example.com", matching one level of subdomain
+	Allow     func(ctx context.Context, host string) error // optional check by the application, such as a lookup of tenants
+
+	// limit on new certificates, to protect the account's Let's Encrypt quota from probes for random names
+	Every time.Duration // minimum interval between new domains (0 for no limit)
+	Burst int
+
+	// state
+	mu      sync.Mutex
+	allowed map[string]bool // domains approved since the server started
+	limiter *rate.Limiter
+}
+
+var errHostRate = errors.New("server: too many new domains requested")
+var errHostNotAllowed = errors.New("server: domain not allowed")
+
+// policy returns an autocert host policy, for the specified fixed domains and the on-demand policy.
+func (hp *HostPolicy) policy(domains []string) func(ctx context.Context, host string) error {
+
+	fixed := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		fixed[strings.ToLower(d)] = true
+	}
+
+	if hp.Every > 0 {
+		burst := hp.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		hp.limiter = rate.NewLimiter(rate.Every(hp.Every), burst)
+	}
+	hp.allowed = make(map[string]bool)
+
+	return func(ctx context.Context, host string) error {
+
+		host = strings.ToLower(host)
+		if fixed[host] {
+			return nil
+		}
+
+		// SERIALISED
+		hp.mu.Lock()
+		known := hp.allowed[host]
+		hp.mu.Unlock()
+		if known {
+			return nil
+		}
+
+		// check domain
+		if !hp.matchWildcard(host) {
+			if hp.Allow == nil {
+				return errHostNotAllowed
+			}
+			if err := hp.Allow(ctx, host); err != nil {
+				return err
+			}
+		}
+
+		// rate limit for new domains
+		if hp.limiter != nil && !hp.limiter.Allow() {
+			return errHostRate
+		}
+
+		hp.mu.Lock()
+		hp.allowed[host] = true
+		hp.mu.Unlock()
+		return nil
+	}
+}
+
+// matchWildcard returns true if a host matches one of the wildcard patterns.
+func (hp *HostPolicy) matchWildcard(host string) bool {
+
+	for _, w := range hp.Wildcards {
+		w = strings.ToLower(w)
+		if strings.HasPrefix(w, "*.") {
+			sub := strings.TrimSuffix(host, w[1:])
+			if sub != host && sub != "" && !strings.Contains(sub, ".") {
+				return true
+			}
+		} else if host == w {
+			return true
+		}
+	}
+	return false
+}
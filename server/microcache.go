@@ -0,0 +1,239 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Short-lived caching of anonymous page views, coalescing concurrent requests.
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MicroCache caches responses to anonymous GET requests for a few seconds. Concurrent identical requests wait
+// for the first to complete and share its response, so that a sudden spike of views for one page costs a single render.
+// Use MicroCache.Handler as middleware for the public pages of a site.
+type MicroCache struct {
+	TTL        time.Duration // time to keep responses (1 to 10 seconds, default 1 second)
+	MaxBody    int           // largest response cached (default 1 MB)
+	MaxEntries int           // maximum responses cached (default 1000)
+
+	// optional test for requests not to be cached, such as from logged-in users
+	Bypass func(r *http.Request) bool
+
+	// cache requests with cookies, relying on Bypass to identify users (default is to cache only cookie-less requests)
+	AllowCookies bool
+
+	// state
+	mu      sync.Mutex
+	entries map[string]*cached
+}
+
+// cached holds a response, or a response being generated.
+type cached struct {
+	ready   chan struct{} // closed when the response is complete
+	ok      bool          // response may be shared
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// recorder copies a response as it is written.
+type recorder struct {
+	w        http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	max      int
+	overflow bool
+}
+
+// Handler returns a handler that serves cached responses when possible, and otherwise calls next.
+func (mc *MicroCache) Handler(next http.Handler) http.Handler {
+
+	mc.setDefaults()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !mc.cacheable(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := requestHost(r) + r.URL.RequestURI() + "|" + r.Header.Get("Accept-Encoding")
+
+		// SERIALISED
+		mc.mu.Lock()
+		c := mc.entries[key]
+		if c != nil {
+			select {
+			case <-c.ready:
+				if time.Now().After(c.expires) {
+					c = nil // stale
+				}
+			default:
+			}
+		}
+		if c == nil {
+			// generate the response for everyone asking
+			c = &cached{ready: make(chan struct{})}
+			if len(mc.entries) >= mc.MaxEntries {
+				mc.removeExpired()
+			}
+			store := len(mc.entries) < mc.MaxEntries
+			if store {
+				mc.entries[key] = c
+			}
+			mc.mu.Unlock()
+
+			mc.generate(key, c, store, next, w, r)
+			return
+		}
+		mc.mu.Unlock()
+
+		// wait for the response being generated
+		select {
+		case <-c.ready:
+		case <-r.Context().Done():
+			return
+		}
+
+		if c.ok {
+			c.serve(w)
+		} else {
+			next.ServeHTTP(w, r) // not shareable
+		}
+	})
+}
+
+// generate calls the next handler, and saves its response in the cache entry.
+func (mc *MicroCache) generate(key string, c *cached, stored bool, next http.Handler, w http.ResponseWriter, r *http.Request) {
+
+	rec := &recorder{w: w, max: mc.MaxBody}
+
+	// waiting requests must be released, even if the handler panics
+	defer func() {
+		if !c.ok && stored {
+			mc.mu.Lock()
+			if mc.entries[key] == c {
+				delete(mc.entries, key)
+			}
+			mc.mu.Unlock()
+		}
+		close(c.ready)
+	}()
+
+	next.ServeHTTP(rec, r)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	h := w.Header()
+	if rec.status != http.StatusOK || rec.overflow || h.Get("Set-Cookie") != "" || private(h.Get("Cache-Control")) {
+		return
+	}
+
+	c.status = rec.status
+	c.header = h.Clone()
+	c.body = rec.body.Bytes()
+	c.expires = time.Now().Add(mc.TTL)
+	c.ok = true
+}
+
+// cacheable returns true if a request may be served from the cache.
+func (mc *MicroCache) cacheable(r *http.Request) bool {
+
+	if r.Method != "GET" || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	if !mc.AllowCookies && r.Header.Get("Cookie") != "" {
+		return false
+	}
+	if mc.Bypass != nil && mc.Bypass(r) {
+		return false
+	}
+	return true
+}
+
+// removeExpired deletes stale responses. It must be called with mu locked.
+func (mc *MicroCache) removeExpired() {
+
+	now := time.Now()
+	for key, c := range mc.entries {
+		select {
+		case <-c.ready:
+			if now.After(c.expires) {
+				delete(mc.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+// setDefaults sets default values for the cache.
+func (mc *MicroCache) setDefaults() {
+
+	if mc.TTL <= 0 {
+		mc.TTL = time.Second
+	} else if mc.TTL > 10*time.Second {
+		mc.TTL = 10 * time.Second
+	}
+	if mc.MaxBody <= 0 {
+		mc.MaxBody = 1 << 20
+	}
+	if mc.MaxEntries <= 0 {
+		mc.MaxEntries = 1000
+	}
+	mc.entries = make(map[string]*cached)
+}
+
+// serve writes a cached response.
+func (c *cached) serve(w http.ResponseWriter) {
+
+	h := w.Header()
+	for k, v := range c.header {
+		h[k] = v
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// private returns true if Cache-Control forbids sharing a response.
+func private(cc string) bool {
+
+	cc = strings.ToLower(cc)
+	return strings.Contains(cc, "private") || strings.Contains(cc, "no-store") || strings.Contains(cc, "no-cache")
+}
+
+// Header returns the header of the underlying response.
+func (rec *recorder) Header() http.Header {
+	return rec.w.Header()
+}
+
+// Write copies the response body, up to the limit for caching.
+func (rec *recorder) Write(b []byte) (int, error) {
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > rec.max {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.w.Write(b)
+}
+
+// WriteHeader records the status of the response.
+func (rec *recorder) WriteHeader(status int) {
+
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.w.WriteHeader(status)
+}
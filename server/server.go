@@ -5,13 +5,18 @@
 package server
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/inchworks/webparts/metrics"
 )
 
 // App is the interface provided by the web application.
@@ -33,14 +38,67 @@ type Server struct {
 	CertPath  string   // folder for certificates
 	Domains   []string // domains to be served (empty for HTTP)
 
+	// optional domains added on demand (Domains must still specify the default domain)
+	HostPolicy *HostPolicy
+
 	// port addresses
 	AddrHTTP  string
 	AddrHTTPS string
+
+	// optional limits on request sizes
+	BodyLimits *BodyLimits
+
+	// optional robots.txt, sitemap and other standard files
+	WellKnown *WellKnown
+
+	// optional error pages in the site's style, also used to recover from panics
+	ErrorPages *ErrorPages
+
+	// optional middleware for the application's routes, such as geo-blocking and rate limits, by virtual host and path
+	Middleware *Chain
+
+	// optional metrics from webparts components, served at /metrics for Prometheus (access set by OpsAllow and OpsToken, not Allowed)
+	Metrics *metrics.Registry
+
+	// optional readiness check, served at /ready for orchestration (nil error if ready)
+	Ready func() error
+
+	// access to /metrics and /ready, for addresses or CIDR blocks (default loopback only), or with a bearer token
+	OpsAllow []string
+	OpsToken string
+
+	// optional deployment settings
+	PidFile  string // file to hold process ID
+	MinFiles uint64 // minimum limit for open files, raised if possible
+	RunAs    string // user to run as after binding ports, if started as root (must be able to write CertPath)
+
+	// optional handoff of listeners to a replacement process on SIGUSR2, to restart without dropping requests
+	Handoff         bool
+	HandoffTimeout  time.Duration // time for the replacement to start serving (default 1 minute)
+	ShutdownTimeout time.Duration // time for requests in progress to finish after handoff (default 5 minutes)
+	OnShutdown      func()        // called after handoff when requests have finished, to stop application components
+	OnStart         func()        // called when no previous process is running, to start recovery such as etx Recover
+
+	// handoff state
+	inherited map[string]net.Listener
+	listeners []listener
+	ready     *os.File
+	previous  *os.File // closed when the previous process exits
+	running   *os.File // held open until this process exits
+	stopped   chan struct{}
 }
 
-// Serve runs the web server. It never returns.
+// Serve runs the web server. It returns only after handing off to a replacement process.
 func (srv *Server) Serve(app App) {
 
+	if err := srv.inherit(); err != nil {
+		srv.ErrorLog.Fatal(err)
+	}
+	if err := srv.setup(); err != nil {
+		srv.ErrorLog.Fatal(err)
+	}
+	srv.stopped = make(chan struct{})
+
 	// live server if we have a domain specified
 	if len(srv.Domains) > 0 {
 
@@ -51,12 +109,15 @@ func (srv *Server) Serve(app App) {
 			Cache:      autocert.DirCache(srv.CertPath),
 			Email:      srv.CertEmail,
 		}
+		if srv.HostPolicy != nil {
+			m.HostPolicy = srv.HostPolicy.policy(srv.Domains)
+		}
 
 		// web server
 		srv.InfoLog.Printf("Starting server %s", srv.AddrHTTPS)
 
 		// HTTPS server, with certificate from manager
-		srv1 := newServer(srv.AddrHTTPS, app.Routes(), srv.ErrorLog, true)
+		srv1 := newServer(srv.AddrHTTPS, srv.routes(app), srv.ErrorLog, true)
 		srv1.TLSConfig = &tls.Config{
 			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 				// GoogleBot wants to connect without SNI. Use default name.
@@ -80,12 +141,30 @@ func (srv *Server) Serve(app App) {
 		}
 
 		// HTTP server : accept http-01 challenges, and redirect HTTP -> HTTPS
-		srv2 := newServer(srv.AddrHTTP, m.HTTPHandler(http.HandlerFunc(handleHTTPRedirect)), srv.ErrorLog, false)
-		go srv2.ListenAndServe()
+		srv2 := newServer(srv.AddrHTTP, m.HTTPHandler(http.HandlerFunc(srv.handleHTTPRedirect)), srv.ErrorLog, false)
+
+		// bind ports before dropping privileges
+		l1, err := srv.listen(srv.AddrHTTPS, "https")
+		if err != nil {
+			srv.ErrorLog.Fatal(err)
+		}
+		l2, err := srv.listen(srv.AddrHTTP, "http")
+		if err != nil {
+			srv.ErrorLog.Fatal(err)
+		}
+		if err := srv.started(); err != nil {
+			srv.ErrorLog.Fatal(err)
+		}
+		if srv.Handoff {
+			srv.watchHandoff(srv1, srv2)
+		}
+		srv.confirmReady()
+
+		go srv2.Serve(l2)
 
 		// HTTPS server
-		err := srv1.ListenAndServeTLS("", "")
-		srv.ErrorLog.Fatal(err)
+		err = srv1.ServeTLS(l1, "", "")
+		srv.served(err)
 
 	} else {
 
@@ -93,10 +172,22 @@ func (srv *Server) Serve(app App) {
 		srv.InfoLog.Printf("Starting server %s", srv.AddrHTTP)
 
 		// just an HTTP server
-		srv1 := newServer(srv.AddrHTTP, app.Routes(), srv.ErrorLog, true)
+		srv1 := newServer(srv.AddrHTTP, srv.routes(app), srv.ErrorLog, true)
 
-		err := srv1.ListenAndServe()
-		srv.ErrorLog.Fatal(err)
+		l, err := srv.listen(srv.AddrHTTP, "http")
+		if err != nil {
+			srv.ErrorLog.Fatal(err)
+		}
+		if err := srv.started(); err != nil {
+			srv.ErrorLog.Fatal(err)
+		}
+		if srv.Handoff {
+			srv.watchHandoff(srv1)
+		}
+		srv.confirmReady()
+
+		err = srv1.Serve(l)
+		srv.served(err)
 	}
 
 	// ## Add option with self-signed certificates
@@ -104,11 +195,25 @@ func (srv *Server) Serve(app App) {
 
 }
 
+// served waits for a graceful shutdown after handoff, or reports why the server stopped.
+func (srv *Server) served(err error) {
+
+	if err == http.ErrServerClosed {
+		<-srv.stopped
+		return
+	}
+	srv.ErrorLog.Fatal(err)
+}
+
 // handleHTTPRedirect redirects HTTP requests to HTTPS.
 // Copied from autocert and changed to do 301 redirect.
-func handleHTTPRedirect(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) handleHTTPRedirect(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" && r.Method != "HEAD" {
-		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		if srv.ErrorPages != nil {
+			srv.ErrorPages.Error(w, r, http.StatusBadRequest, "Use HTTPS")
+		} else {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		}
 		return
 	}
 	target := "https://" + stripPort(r.Host) + r.URL.RequestURI()
@@ -152,3 +257,108 @@ func newServer(addr string, handler http.Handler, log *log.Logger, main bool) *h
 
 	return s
 }
+
+// routes returns the application's handlers, with any server-level handling added.
+func (srv *Server) routes(app App) http.Handler {
+
+	h := app.Routes()
+	if srv.Metrics != nil {
+		h = srv.metricsHandler(h)
+	}
+	if srv.Ready != nil {
+		h = srv.readyHandler(h)
+	}
+	if srv.Middleware != nil {
+		h = srv.Middleware.Handler(h)
+	}
+	if srv.WellKnown != nil {
+		if srv.WellKnown.Origin == "" && len(srv.Domains) > 0 {
+			srv.WellKnown.Origin = "https://" + srv.Domains[0]
+		}
+		h = srv.WellKnown.Handler(h)
+	}
+	if srv.BodyLimits != nil {
+		h = srv.BodyLimits.Handler(h)
+	}
+	if srv.ErrorPages != nil {
+		if srv.BodyLimits != nil && srv.BodyLimits.TooLarge == nil {
+			srv.BodyLimits.errorPage = srv.ErrorPages.Error
+		}
+		h = srv.ErrorPages.Recover(h)
+	}
+	return h
+}
+
+// metricsHandler serves metrics ahead of the application's routes.
+func (srv *Server) metricsHandler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/metrics" && (r.Method == "GET" || r.Method == "HEAD") {
+			if !srv.isOperator(r) {
+				http.NotFound(w, r)
+				return
+			}
+			srv.Metrics.Respond(w)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// readyHandler serves the readiness check ahead of the application's routes.
+func (srv *Server) readyHandler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/ready" && (r.Method == "GET" || r.Method == "HEAD") {
+			if !srv.isOperator(r) {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			if err := srv.Ready(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, "not ready") // the reason is for the application to log, not to publish
+			} else {
+				fmt.Fprintln(w, "ok")
+			}
+		} else {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// isOperator returns true if a request for /metrics or /ready has the bearer token, or is from an allowed address.
+func (srv *Server) isOperator(r *http.Request) bool {
+
+	if srv.OpsToken != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+srv.OpsToken)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if len(srv.OpsAllow) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, a := range srv.OpsAllow {
+		if _, block, err := net.ParseCIDR(a); err == nil {
+			if block.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package server
+
+// Standard files for crawlers and security researchers.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WellKnown specifies standard files to be served ahead of the application's routes.
+type WellKnown struct {
+	Robots   string            // content of robots.txt (empty for none)
+	Security string            // content of /.well-known/security.txt (empty for none)
+	Files    map[string]string // content of other files, indexed by path, e.g. "/.well-known/change-password"
+
+	// Sitemap optionally returns the URLs for sitemap.xml. Relative URLs are made absolute using Origin.
+	Sitemap func(r *http.Request) []SitemapURL
+
+	// Origin is the scheme and host for absolute URLs, e.g. "https://example.com", so that they do not depend
+	// on the Host header sent by a client. The default for Server is its first domain. Without it, no sitemap is served.
+	Origin string
+}
+
+// SitemapURL is an entry in sitemap.xml. Only Loc is required.
+type SitemapURL struct {
+	Loc        string    // URL of page
+	LastMod    time.Time // time of last change
+	ChangeFreq string    // e.g. "daily", "weekly"
+	Priority   float32   // relative to other pages, 0.0 to 1.0
+}
+
+// sitemap entry, as XML
+type sitemapURL struct {
+	Loc        string  `xml:"loc"`
+	LastMod    string  `xml:"lastmod,omitempty"`
+	ChangeFreq string  `xml:"changefreq,omitempty"`
+	Priority   float32 `xml:"priority,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// Handler returns a handler that serves the standard files, and passes other requests to the application.
+func (wk *WellKnown) Handler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method == "GET" || r.Method == "HEAD" {
+			switch p := r.URL.Path; {
+			case p == "/robots.txt" && (wk.Robots != "" || wk.hasSitemap()):
+				wk.serveRobots(w, r)
+				return
+
+			case p == "/sitemap.xml" && wk.hasSitemap():
+				wk.serveSitemap(w, r)
+				return
+
+			case p == "/.well-known/security.txt" && wk.Security != "":
+				serveText(w, wk.Security)
+				return
+
+			default:
+				if content, ok := wk.Files[p]; ok {
+					serveText(w, content)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRobots writes robots.txt, with a reference to the sitemap.
+func (wk *WellKnown) serveRobots(w http.ResponseWriter, r *http.Request) {
+
+	content := wk.Robots
+	if wk.hasSitemap() {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += "Sitemap: " + wk.absURL("/sitemap.xml") + "\n"
+	}
+	serveText(w, content)
+}
+
+// serveSitemap writes sitemap.xml, from the URLs specified by the application.
+func (wk *WellKnown) serveSitemap(w http.ResponseWriter, r *http.Request) {
+
+	set := sitemapURLSet{}
+	for _, u := range wk.Sitemap(r) {
+		su := sitemapURL{
+			Loc:        wk.absURL(u.Loc),
+			ChangeFreq: u.ChangeFreq,
+			Priority:   u.Priority,
+		}
+		if !u.LastMod.IsZero() {
+			su.LastMod = u.LastMod.UTC().Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, su)
+	}
+
+	// encode first, so that an error can still be reported
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(set); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// absURL returns an absolute URL for a path at the origin.
+func (wk *WellKnown) absURL(path string) string {
+
+	if strings.Contains(path, "://") {
+		return path
+	}
+	return strings.TrimSuffix(wk.Origin, "/") + path
+}
+
+// hasSitemap returns true if a sitemap can be served.
+func (wk *WellKnown) hasSitemap() bool {
+	return wk.Sitemap != nil && wk.Origin != ""
+}
+
+// serveText writes a plain text file.
+func serveText(w http.ResponseWriter, content string) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(content))
+}
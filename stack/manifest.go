@@ -0,0 +1,99 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package stack
+
+// Check that customisation has not removed resources that a package needs.
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Manifest lists the resources provided by a package, which must still be available after app and site customisation.
+type Manifest struct {
+	Package     string              // package name, for reports
+	Files       []string            // static files
+	Definitions map[string][]string // template definitions, indexed by template file
+}
+
+// definition matches a template definition
+var definition = regexp.MustCompile(`{{-?\s*(?:define|block)\s+"([^"]+)"`)
+
+// NewManifest records the resources in a package's file system.
+// Files under static are expected to be served from the stacked file system,
+// and definitions in template files are expected in the template cache.
+// For example: NewManifest("uploader", uploader.WebFiles, "web").
+func NewManifest(pkg string, resources fs.FS, dir string) (*Manifest, error) {
+
+	m := &Manifest{
+		Package:     pkg,
+		Definitions: make(map[string][]string),
+	}
+
+	err := fs.WalkDir(resources, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+
+		switch {
+		case strings.HasPrefix(rel, "static/"):
+			m.Files = append(m.Files, rel)
+
+		case strings.HasSuffix(rel, ".tmpl"):
+			content, err := fs.ReadFile(resources, p)
+			if err != nil {
+				return err
+			}
+			for _, def := range definition.FindAllStringSubmatch(string(content), -1) {
+				m.Definitions[path.Base(rel)] = append(m.Definitions[path.Base(rel)], def[1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Verify checks that the resources in the manifest are available.
+// Static files must be in the stacked file system, with the same paths as in the package,
+// and each template definition must be found in the template cache.
+// Typically a missing definition is the result of a site override of a template file, that removed a needed partial.
+// It returns a description of each problem found.
+func (m *Manifest) Verify(stacked fs.FS, cache map[string]*template.Template) []string {
+
+	var problems []string
+
+	for _, f := range m.Files {
+		if _, err := fs.Stat(stacked, f); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: missing file %s", m.Package, f))
+		}
+	}
+
+	// names defined anywhere in the cache
+	defined := make(map[string]bool)
+	for _, ts := range cache {
+		for _, t := range ts.Templates() {
+			defined[t.Name()] = true
+		}
+	}
+
+	for file, defs := range m.Definitions {
+		for _, def := range defs {
+			if !defined[def] {
+				problems = append(problems, fmt.Sprintf("%s: no template defines \"%s\" (from %s)", m.Package, def, file))
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
@@ -3,11 +3,18 @@
 package stack
 
 import (
+	"fmt"
 	"html/template"
 	"io/fs"
 	"path/filepath"
 )
 
+// layer is a file system of templates, with a name for diagnostics.
+type layer struct {
+	fsys fs.FS
+	name string
+}
+
 // NewTemplates returns a cache of HTML page templates for an application, with added package and site templates.
 //
 // The cache is built using the file organisation suggested by Let's Go by Alex Edwards:
@@ -18,24 +25,43 @@ import (
 // Application template definitions override package templates of the same name.
 // Similarly, site template definitions override application templates by name.
 func NewTemplates(forPkgs []fs.FS, forApp fs.FS, forSite fs.FS, funcs template.FuncMap) (map[string]*template.Template, error) {
+	return newTemplates(forPkgs, forApp, forSite, funcs, false)
+}
+
+// NewTemplatesTraced is NewTemplates for development. Each template definition that produces HTML elements
+// is wrapped in HTML comments naming the layer and file that defined it, to show site customisers which
+// template produced each fragment of a page.
+func NewTemplatesTraced(forPkgs []fs.FS, forApp fs.FS, forSite fs.FS, funcs template.FuncMap) (map[string]*template.Template, error) {
+	return newTemplates(forPkgs, forApp, forSite, funcs, true)
+}
+
+// newTemplates returns a cache of page templates, optionally traced.
+func newTemplates(forPkgs []fs.FS, forApp fs.FS, forSite fs.FS, funcs template.FuncMap, trace bool) (map[string]*template.Template, error) {
 
 	// cache of templates indexed by page name
 	cache := map[string]*template.Template{}
 
+	app := layer{forApp, "app"}
+	site := layer{forSite, "site"}
+	if trace {
+		funcs = withTrace(funcs)
+	}
+
 	// add library page templates
-	for _, forPkg := range forPkgs {
-		if err := addTemplates(cache, forPkg, funcs, forPkg, forApp, forSite); err != nil {
+	for i, forPkg := range forPkgs {
+		pkg := layer{forPkg, fmt.Sprintf("package %d", i)}
+		if err := addTemplates(cache, pkg, funcs, trace, pkg, app, site); err != nil {
 			return nil, err
 		}
 	}
 
 	// add application page templates
-	if err := addTemplates(cache, forApp, funcs, forApp, forSite); err != nil {
+	if err := addTemplates(cache, app, funcs, trace, app, site); err != nil {
 		return nil, err
 	}
 
 	// add site-specific page templates
-	if err := addTemplates(cache, forSite, funcs, forApp, forSite); err != nil {
+	if err := addTemplates(cache, site, funcs, trace, app, site); err != nil {
 		return nil, err
 	}
 
@@ -45,10 +71,10 @@ func NewTemplates(forPkgs []fs.FS, forApp fs.FS, forSite fs.FS, funcs template.F
 
 // addTemplates parses a set of template files for HTML pages.
 // It adds template definitions from a number of layers (typically a package, the app, and site customisation).
-func addTemplates(cache map[string]*template.Template, pages fs.FS, funcs template.FuncMap, layers ...fs.FS) error {
+func addTemplates(cache map[string]*template.Template, pages layer, funcs template.FuncMap, trace bool, layers ...layer) error {
 
 	// get the set of 'page' templates
-	pgs, err := fs.Glob(pages, "*.page.tmpl")
+	pgs, err := fs.Glob(pages.fsys, "*.page.tmpl")
 	if err != nil {
 		return err
 	}
@@ -62,7 +88,7 @@ func addTemplates(cache map[string]*template.Template, pages fs.FS, funcs templa
 		// So we create an empty template set, use the Funcs() method to register the map, and then parse the file.
 
 		// parse the page template file in to a template set
-		ts, err := template.New(name).Funcs(funcs).ParseFS(pages, pg)
+		ts, err := template.New(name).Funcs(funcs).ParseFS(pages.fsys, pg)
 		if err != nil {
 			return err
 		}
@@ -70,14 +96,20 @@ func addTemplates(cache map[string]*template.Template, pages fs.FS, funcs templa
 		// add 'layout' template files to the template set
 		// (Typically only one of these will be needed, but we leave the template implementation to link it.)
 		for _, l := range layers {
-			if ts, err = parseIf(ts, l, "*.layout.tmpl"); err != nil {
+			if ts, err = parseIf(ts, l.fsys, "*.layout.tmpl"); err != nil {
 				return err
 			}
 		}
 
 		// add 'partial' template files to the template set
 		for _, l := range layers {
-			if ts, err = parseIf(ts, l, "*.partial.tmpl"); err != nil {
+			if ts, err = parseIf(ts, l.fsys, "*.partial.tmpl"); err != nil {
+				return err
+			}
+		}
+
+		if trace {
+			if err = traceTemplates(ts, pages, pg, layers); err != nil {
 				return err
 			}
 		}
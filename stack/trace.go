@@ -0,0 +1,105 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package stack
+
+// Diagnostic comments showing the source of each template definition.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"text/template/parse"
+)
+
+// traceFunc is the template function that writes a diagnostic comment.
+const traceFunc = "stackTrace"
+
+// withTrace returns a copy of the template functions, with the addition of the trace function.
+func withTrace(funcs template.FuncMap) template.FuncMap {
+
+	traced := make(template.FuncMap, len(funcs)+1)
+	for n, f := range funcs {
+		traced[n] = f
+	}
+	traced[traceFunc] = func(s string) template.HTML {
+		return template.HTML("<!-- " + s + " -->")
+	}
+	return traced
+}
+
+// traceTemplates wraps each markup definition in a page's template set with comments naming its source.
+// Sources are found in the same order as the files were parsed, so that a later definition overrides an earlier one.
+func traceTemplates(ts *template.Template, pages layer, page string, layers []layer) error {
+
+	origin := make(map[string]string)
+	if err := addOrigins(origin, pages, page); err != nil {
+		return err
+	}
+	origin[ts.Name()] = pages.name + ": " + page
+
+	for _, pattern := range []string{"*.layout.tmpl", "*.partial.tmpl"} {
+		for _, l := range layers {
+			fns, _ := fs.Glob(l.fsys, pattern)
+			for _, fn := range fns {
+				if err := addOrigins(origin, l, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, t := range ts.Templates() {
+		src, ok := origin[t.Name()]
+		if !ok || t.Tree == nil || !isMarkup(t.Tree.Root) {
+			continue
+		}
+		desc := fmt.Sprintf("%s from %s", t.Name(), src)
+		begin, err := traceNode(t.Name(), "begin "+desc)
+		if err != nil {
+			return err
+		}
+		end, err := traceNode(t.Name(), "end "+desc)
+		if err != nil {
+			return err
+		}
+
+		root := t.Tree.Root
+		root.Nodes = append(append([]parse.Node{begin}, root.Nodes...), end)
+	}
+	return nil
+}
+
+// addOrigins records the source of the definitions in a template file.
+func addOrigins(origin map[string]string, l layer, fn string) error {
+
+	content, err := fs.ReadFile(l.fsys, fn)
+	if err != nil {
+		return err
+	}
+	for _, def := range definition.FindAllStringSubmatch(string(content), -1) {
+		origin[def[1]] = l.name + ": " + fn
+	}
+	return nil
+}
+
+// isMarkup returns true if a definition starts with an HTML element or comment.
+// Other definitions may be used in attributes or scripts, where a comment would not be valid.
+func isMarkup(root *parse.ListNode) bool {
+
+	if root == nil || len(root.Nodes) == 0 {
+		return false
+	}
+	text, ok := root.Nodes[0].(*parse.TextNode)
+	return ok && bytes.HasPrefix(bytes.TrimSpace(text.Text), []byte("<"))
+}
+
+// traceNode returns a parsed action that calls the trace function.
+func traceNode(name string, comment string) (parse.Node, error) {
+
+	trees, err := parse.Parse(name, fmt.Sprintf("{{%s %q}}", traceFunc, comment), "", "", map[string]interface{}{traceFunc: true})
+	if err != nil {
+		return nil, err
+	}
+	return trees[name].Root.Nodes[0], nil
+}
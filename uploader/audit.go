@@ -0,0 +1,133 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Audit of stored media files against the files referenced by the parent application.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AuditReport lists the inconsistencies found by Audit. Names are relative to FilePath,
+// except that stale files in a separate TempPath are listed with their full path.
+type AuditReport struct {
+	Files    int      // files scanned
+	Orphans  []string // files not referenced, either as media files or their thumbnails, renditions and other variants
+	Missing  []string // referenced media files that do not exist
+	Variants []string // thumbnails, renditions and HLS files missing for referenced media files
+	Stale    []string // temporary files left by uploads, chunked uploads, copies and migrations that did not complete
+	Removed  int      // orphans and temporary files deleted
+}
+
+// Audit scans FilePath, and TempPath if separate, and checks them against the names of media files referenced
+// by the parent application, as returned by Bind. If remove is set, orphans and stale temporary files are deleted.
+//
+// Files changed within MaxAge are not reported, so that files for a parent update in progress are not mistaken for orphans.
+// Even so, the list of referenced files should be read after any update that would add to it.
+// Variants may be reported missing after configuration changes, such as adding renditions, and are never deleted.
+func (up *Uploader) Audit(referenced []string, remove bool) (*AuditReport, error) {
+
+	dir, temp := up.filePath(), up.tempPath()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-1 * up.MaxAge)
+	rpt := &AuditReport{Files: len(fis)}
+
+	// existing files
+	stored := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			stored[fi.Name()] = true
+		}
+	}
+
+	// referenced media files and the variants saved with them
+	known := make(map[string]bool, len(referenced)*3)
+	for _, nm := range referenced {
+		if nm == "" {
+			continue
+		}
+		known[nm] = true
+		if !stored[nm] {
+			rpt.Missing = append(rpt.Missing, nm)
+		}
+		for _, v := range up.variants(nm) {
+			known[v] = true
+			if !stored[v] && !isCaptions(v) && v != Original(nm) {
+				rpt.Variants = append(rpt.Variants, v) // captions and originals are optional
+			}
+		}
+	}
+
+	for _, fi := range fis {
+		nm := fi.Name()
+		if fi.IsDir() || known[nm] || fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		switch {
+		case isManaged(nm):
+			// deduplication cache and quarantine, managed separately
+
+		case isStale(nm):
+			rpt.Stale = append(rpt.Stale, nm)
+
+		default:
+			rpt.Orphans = append(rpt.Orphans, nm)
+		}
+	}
+
+	// uploads not yet bound, in a separate directory
+	var tempStale []string
+	if temp != dir {
+		tfis, err := ioutil.ReadDir(temp)
+		if err != nil {
+			return nil, err
+		}
+		rpt.Files += len(tfis)
+
+		for _, fi := range tfis {
+			nm := fi.Name()
+			if !fi.IsDir() && !isManaged(nm) && fi.ModTime().Before(cutoff) {
+				tempStale = append(tempStale, filepath.Join(temp, nm))
+			}
+		}
+	}
+
+	var paths []string
+	for _, nm := range append(rpt.Orphans, rpt.Stale...) {
+		paths = append(paths, filepath.Join(dir, nm))
+	}
+	rpt.Stale = append(rpt.Stale, tempStale...)
+
+	if remove {
+		for _, p := range append(paths, tempStale...) {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return rpt, err
+			}
+			rpt.Removed++
+		}
+	}
+	return rpt, nil
+}
+
+// isManaged returns true for files in the deduplication cache and in quarantine, which are not audited.
+func isManaged(fileName string) bool {
+	return strings.HasPrefix(fileName, "H-") || strings.HasPrefix(fileName, "Q-")
+}
+
+// isStale returns true for partial uploads, partial copies, and uploads that should have been removed as orphans.
+func isStale(fileName string) bool {
+
+	return strings.HasPrefix(fileName, "C-") ||
+		strings.HasPrefix(fileName, ".copy-") ||
+		strings.HasPrefix(fileName, ".migrate-") ||
+		isUpload(fileName)
+}
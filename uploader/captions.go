@@ -0,0 +1,60 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Subtitles extracted from videos, as WebVTT captions.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Captions returns the file name for WebVTT captions extracted from a video.
+// The file exists only if Uploader.Subtitles is set and the uploaded video had a subtitle track (see HasCaptions).
+func Captions(fileName string) string {
+	return "V" + changeExt(fileName, ".vtt")[1:]
+}
+
+// HasCaptions returns true if captions were extracted for a video, so that the parent can add a track element.
+func (up *Uploader) HasCaptions(fileName string) bool {
+
+	_, err := os.Stat(up.mediaPath(Captions(fileName)))
+	return err == nil
+}
+
+// isCaptions returns true for a captions file name. Captions are an optional variant of a video.
+func isCaptions(name string) bool {
+	return strings.HasPrefix(name, "V") && filepath.Ext(name) == ".vtt"
+}
+
+// isVideo returns true for the name of a saved video.
+func isVideo(fileName string) bool {
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".mp4", ".m3u8":
+		return true
+	default:
+		return false
+	}
+}
+
+// saveCaptions extracts the first subtitle track from a video as WebVTT captions, if there is one.
+// Conversion to MP4 would otherwise lose it.
+func (up *Uploader) saveCaptions(videoName string) {
+
+	if !up.Subtitles || up.VideoPackage == "" {
+		return
+	}
+	to := Captions(videoName)
+	toPath := filepath.Join(up.tempPath(), to)
+
+	// the captions may have already been extracted, if we are redoing the operations, and FFmpeg will not overwrite them
+	if exists, err := exists(toPath); err != nil || exists {
+		return
+	}
+
+	if err := up.ffmpeg("-v", "quiet", "-i", videoName, "-map", "0:s:0", "-c:s", "webvtt", to); err != nil {
+		os.Remove(toPath) // no subtitles, or a type that cannot be converted, such as bitmaps from a DVD
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Resumable uploads, sent in chunks.
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// maxChunked is the size limit for a chunked upload, if there is no limit for its media type.
+// The completed file is held in memory for processing, as for Save, so this is modest.
+const maxChunked = 256 << 20
+
+// chunkLock serialises the requests for a chunked upload.
+type chunkLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// SaveChunk saves part of a media file that is being uploaded in chunks, so that a client can retry a failed chunk
+// instead of restarting the whole upload. offset is the position of the chunk in the file.
+// version is chosen by the client to identify the content, such as from the file's size and modification time,
+// so that chunks of a different file with the same name are not combined. It is limited to 32 letters and digits.
+// It returns the number of bytes received so far. Call EndChunks when all chunks have been saved.
+func (up *Uploader) SaveChunk(r io.Reader, name string, version string, tx etx.TxId, offset int64) (received int64, err error, byClient bool) {
+
+	name = CleanName(name)
+	mt := up.MediaType(name)
+	if mt == 0 {
+		return 0, errors.New("File format not supported"), true
+	}
+
+	// SERIALISED
+	up.muUploads.Lock()
+	late := up.isLate(tx)
+	up.muUploads.Unlock()
+	if late {
+		return 0, ErrLate, true
+	}
+	defer up.lockChunks(tx, name)()
+
+	// a new file replaces any other version
+	path := up.chunksPath(tx, name, version)
+	if offset == 0 {
+		if other, _ := up.chunksFound(tx, name); other != "" && other != path {
+			os.Remove(other)
+		}
+	}
+
+	// size limit for the media type, and storage allowance, checked before writing
+	limit := up.maxBytes(mt)
+	if limit == 0 {
+		limit = maxChunked
+	}
+	remaining, err := up.quotaRemaining(tx, name)
+	if err != nil {
+		return 0, err, false
+	}
+	errLimit := errTooLarge
+	if remaining >= 0 && remaining < limit {
+		limit = remaining
+		errLimit = errQuota
+	}
+	if offset > limit {
+		os.Remove(path)
+		return 0, errLimit, true
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err, false // could be a bad name?
+	}
+	defer f.Close()
+
+	// the chunk must follow what we have already, or replace a chunk that is being retried
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err, false
+	}
+	if offset > fi.Size() || offset < 0 {
+		return fi.Size(), errors.New("Upload chunk out of sequence"), true
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err, false
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err, false
+	}
+
+	lr := &limitReader{r: r, n: limit - offset}
+	n, err := io.Copy(f, lr)
+	if lr.exceeded {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, errLimit, true
+	} else if err != nil {
+		return offset + n, err, true // probably a broken connection
+	}
+
+	return offset + n, nil, true
+}
+
+// ChunksReceived returns the number of bytes received for a version of a chunked upload, so that a client can resume it.
+func (up *Uploader) ChunksReceived(name string, version string, tx etx.TxId) int64 {
+
+	fi, err := os.Stat(up.chunksPath(tx, CleanName(name), version))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// EndChunks completes a chunked upload, and schedules the file to be processed, as for Save.
+func (up *Uploader) EndChunks(name string, version string, tx etx.TxId) (err error, byClient bool) {
+
+	name = CleanName(name)
+	path := up.chunksPath(tx, name, version)
+	defer up.lockChunks(tx, name)()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err, true // no chunks received
+	}
+	err, byClient = up.save(f, name, tx, hints{})
+	f.Close()
+
+	// the saved file has been buffered for processing
+	if errRm := os.Remove(path); err == nil && errRm != nil {
+		return errRm, false
+	}
+	return err, byClient
+}
+
+// chunksFound returns the path and size of any version of a chunked upload.
+func (up *Uploader) chunksFound(tx etx.TxId, name string) (string, int64) {
+
+	prefix := "C-" + etx.String(tx) + "-"
+	paths, _ := filepath.Glob(filepath.Join(up.tempPath(), prefix+"*-"+name))
+	for _, p := range paths {
+		// the version has no hyphens, so the rest must be exactly the name
+		v := strings.TrimPrefix(filepath.Base(p), prefix)
+		if i := strings.IndexByte(v, '-'); i >= 0 && v[i+1:] == name {
+			if fi, err := os.Stat(p); err == nil {
+				return p, fi.Size()
+			}
+		}
+	}
+	return "", 0
+}
+
+// chunksPath returns the path for a version of an upload being received in chunks.
+func (up *Uploader) chunksPath(tx etx.TxId, name string, version string) string {
+	return filepath.Join(up.tempPath(), "C-"+etx.String(tx)+"-"+cleanVersion(version)+"-"+name)
+}
+
+// cleanVersion returns a client's version for a chunked upload, safe for a file name.
+func cleanVersion(version string) string {
+
+	s := []byte(version)
+	j := 0
+	for _, b := range s {
+		if j < 32 && (('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')) {
+			s[j] = b
+			j++
+		}
+	}
+	if j == 0 {
+		return "0"
+	}
+	return string(s[:j])
+}
+
+// lockChunks waits for other requests for a chunked upload to finish, and returns a function to release the upload.
+func (up *Uploader) lockChunks(tx etx.TxId, name string) func() {
+
+	key := etx.String(tx) + "-" + name
+
+	// SERIALISED
+	up.muChunks.Lock()
+	if up.chunking == nil {
+		up.chunking = make(map[string]*chunkLock)
+	}
+	cl := up.chunking[key]
+	if cl == nil {
+		cl = &chunkLock{}
+		up.chunking[key] = cl
+	}
+	cl.users++
+	up.muChunks.Unlock()
+
+	cl.mu.Lock()
+
+	return func() {
+		cl.mu.Unlock()
+
+		up.muChunks.Lock()
+		cl.users--
+		if cl.users == 0 {
+			delete(up.chunking, key)
+		}
+		up.muChunks.Unlock()
+	}
+}
+
+// removeChunks deletes any incomplete chunked uploads for a transaction.
+func (up *Uploader) removeChunks(tx etx.TxId) error {
+
+	partial, _ := filepath.Glob(filepath.Join(up.tempPath(), "C-"+etx.String(tx)+"-*"))
+	for _, p := range partial {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaleChunks deletes chunked uploads not changed since the cutoff time, such as uploads abandoned after their
+// transaction was committed, when they can no longer be completed.
+func (up *Uploader) removeStaleChunks(cutoff time.Time) {
+
+	partial, _ := filepath.Glob(filepath.Join(up.tempPath(), "C-*"))
+	for _, p := range partial {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().Before(cutoff) {
+			os.Remove(p)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Uploads with the same name in one transaction.
+
+import (
+	"errors"
+	"mime/multipart"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Policies for an upload with the same name as an earlier one in the same transaction.
+const (
+	CollisionReplace = iota // the later upload replaces the earlier one
+	CollisionReject         // the later upload is rejected
+	CollisionSuffix         // the later upload is renamed with a numeric suffix, such as "photo-2.jpg"
+)
+
+var errCollision = errors.New("A file with this name has already been uploaded")
+
+// SaveAs is like Save, and also returns the name for the upload. The name is different from the client's name
+// if the upload has been renamed by the CollisionSuffix policy, and the client must then refer to it by the new name.
+func (up *Uploader) SaveAs(fh *multipart.FileHeader, tx etx.TxId) (name string, err error, byClient bool) {
+
+	file, err := fh.Open()
+	if err != nil {
+		return "", err, false
+	}
+	defer file.Close()
+
+	return up.saveAs(file, fh.Filename, tx, hints{})
+}
+
+// collision applies the collision policy to an upload name, and reserves the name.
+// Names collide if they would be stored as the same file, ignoring case and after any conversion of type.
+// It must be called with muUploads locked.
+func (up *Uploader) collision(tx etx.TxId, name string, mediaType int) (string, error) {
+
+	uploads := up.progress[tx]
+	if uploads == nil {
+		uploads = make(map[string]Progress)
+		up.progress[tx] = uploads
+	}
+
+	if up.inUse(uploads, name, mediaType) {
+		switch up.Collisions {
+		case CollisionReject:
+			return "", errCollision
+
+		case CollisionSuffix:
+			ext := filepath.Ext(name)
+			base := strings.TrimSuffix(name, ext)
+			for n := 2; up.inUse(uploads, name, mediaType); n++ {
+				name = base + "-" + strconv.Itoa(n) + ext
+			}
+		}
+	}
+
+	uploads[name] = Progress{State: StateQueued}
+	return name, nil
+}
+
+// inUse returns true if an upload name, or one stored as the same file, has been used by an upload that has not failed.
+func (up *Uploader) inUse(uploads map[string]Progress, name string, mediaType int) bool {
+
+	stored := strings.ToLower(up.uploadName(name, mediaType))
+	for nm, p := range uploads {
+		if p.State == StateFailed || p.State == StateRejected {
+			continue
+		}
+		if nm == name || strings.ToLower(up.uploadName(nm, up.MediaType(nm))) == stored {
+			return true
+		}
+	}
+	return false
+}
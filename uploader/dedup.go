@@ -0,0 +1,124 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Deduplication of uploads with identical content.
+//
+// Processed media files are kept under a name derived from a hash of the uploaded content, for the Dedup period.
+// An identical upload is linked to the processed files, instead of being processed again.
+// Files are linked rather than copied, so identical media is stored once, and deleted when the last link is removed.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// contentHash returns a hash of uploaded content, if deduplication is enabled.
+func (up *Uploader) contentHash(data []byte) string {
+
+	if up.Dedup == 0 {
+		return ""
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// cachePath returns the path for a processed file cached by content hash.
+// The prefix, such as P for the media or S for the thumbnail, and the file extension are part of the name,
+// because the same content could be processed differently for a different type.
+func (up *Uploader) cachePath(hash string, fileName string) string {
+
+	prefix := strings.SplitN(fileName, "-", 2)[0]
+	return filepath.Join(up.tempPath(), "H-"+hash+"-"+prefix+filepath.Ext(fileName))
+}
+
+// fromCache links an upload to previously processed media with the same content, and returns true if found.
+func (up *Uploader) fromCache(hash string, tx etx.TxId, name string) bool {
+
+	fn := up.FileFromName(tx, name)
+	files := append([]string{fn}, up.variants(fn)...)
+
+	for i, f := range files {
+		if err := linkVariant(up.cachePath(hash, f), filepath.Join(up.tempPath(), f)); err != nil {
+			// incomplete
+			for _, f := range files[:i] {
+				os.Remove(filepath.Join(up.tempPath(), f))
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// cachedMetadata reports the metadata for an upload found in the cache.
+func (up *Uploader) cachedMetadata(req reqSave, name string) {
+
+	if up.OnMetadata == nil {
+		return
+	}
+	switch req.mediaType {
+	case MediaImage:
+		up.OnMetadata(req.tx, req.name, imageMetadata(req.fullsize.Bytes(), req.img))
+
+	case MediaVideo:
+		up.OnMetadata(req.tx, req.name, up.probeVideo(up.FileFromName(req.tx, name)))
+	}
+}
+
+// removeCached deletes cache names older than the deduplication period.
+// Media still referenced by uploads or parents are not deleted, because they have other links.
+func (up *Uploader) removeCached() {
+
+	if up.Dedup == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-1 * up.Dedup)
+
+	cached, _ := filepath.Glob(filepath.Join(up.tempPath(), "H-*"))
+	for _, c := range cached {
+		if fi, err := os.Stat(c); err == nil && fi.ModTime().Before(cutoff) {
+			if err := os.Remove(c); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+		}
+	}
+}
+
+// toCache adds names for processed media, so that they can be found from the hash of the uploaded content.
+func (up *Uploader) toCache(hash string, fileName string) {
+
+	// an existing entry is fine, and a failure just means content won't be deduplicated
+	for _, f := range append([]string{fileName}, up.variants(fileName)...) {
+		err := os.Link(filepath.Join(up.tempPath(), f), up.cachePath(hash, f))
+		if err != nil && !os.IsExist(err) && !(os.IsNotExist(err) && isCaptions(f)) {
+			up.errorLog.Print(err.Error())
+			return
+		}
+	}
+}
+
+// uploadName returns the stored name for an upload after processing, including any conversion of type.
+func (up *Uploader) uploadName(name string, mediaType int) string {
+
+	switch mediaType {
+	case MediaAudio:
+		name, _ = changeType(name, up.AudioTypes, []string{})
+
+	case MediaImage:
+		name, _ = changeType(name, []string{}, []string{})
+		name = up.imageName(name)
+
+	case MediaVideo:
+		nm, convert := changeType(name, []string{}, up.VideoTypes)
+		if !convert || up.VideoPackage != "" {
+			name = up.streamName(nm)
+		}
+	}
+	return name
+}
@@ -0,0 +1,98 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Document file processing.
+
+import (
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// isDoc returns true if a file is an accepted document type.
+func (up *Uploader) isDoc(name string) bool {
+
+	t := strings.ToLower(filepath.Ext(name))
+	for _, dt := range up.DocTypes {
+		if t == dt {
+			return true
+		}
+	}
+	return false
+}
+
+// saveDoc saves a document file and a thumbnail of its first page.
+func (up *Uploader) saveDoc(req reqSave) error {
+
+	// path for saved file
+	fn := up.FileFromName(req.tx, req.name)
+	path := filepath.Join(up.tempPath(), fn)
+
+	// save uploaded document file
+	doc, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err // could be a bad name?
+	}
+	_, err = io.Copy(doc, &req.fullsize)
+	doc.Close()
+	if err != nil {
+		return err
+	}
+
+	return up.saveDocThumbnail(fn, "web/static/doc.png")
+}
+
+// saveDocThumbnail saves a thumbnail for a document or SVG image, rendered from the first page if possible,
+// or else a copy of the specified icon.
+func (up *Uploader) saveDocThumbnail(docName string, icon string) error {
+
+	var err error
+	thumbPath := filepath.Join(up.tempPath(), Thumbnail(docName))
+
+	if up.DocPackage != "" {
+
+		// render first page at full size
+		err = up.docTool(docName+"[0]", "-background", "white", "-flatten", Thumbnail(docName))
+
+		// read first page
+		var pg *os.File
+		var img image.Image
+		if err == nil {
+			pg, err = os.Open(thumbPath)
+		}
+		if err == nil {
+			img, err = imaging.Decode(pg)
+			pg.Close()
+		}
+
+		if err == nil {
+			// save thumbnail, overwriting the full-sized image
+			err = up.saveThumbnail(img, thumbPath)
+		}
+
+		if err != nil {
+			up.errorLog.Print(err.Error())
+		}
+	}
+
+	if up.DocPackage == "" || err != nil {
+		// icon thumbnail, instead
+		err = copyStatic(up.tempPath(), Thumbnail(docName), WebFiles, icon)
+	}
+	return err
+}
+
+// docTool executes ImageMagick, or a specified executable with the same arguments, to render a document.
+func (up *Uploader) docTool(from string, arg ...string) error {
+
+	c := exec.Command(up.DocPackage, append([]string{"-density", "96", from}, arg...)...)
+	c.Dir = up.tempPath()
+	c.Stderr = up.errorLog.Writer()
+	return c.Run()
+}
@@ -0,0 +1,164 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Video encoding, with configurable profiles, optionally using hardware acceleration.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultVAAPI = "/dev/dri/renderD128"
+	rawAudio     = ".raw" // suffix for an audio file before loudness normalisation
+)
+
+// Profile specifies FFmpeg options for conversions of a media type, overriding FFmpeg's defaults.
+type Profile struct {
+	Codec        string   // video codec, such as "libx264" (ignored if Uploader.VideoEncoder is set)
+	Preset       string   // encoder preset, such as "fast"
+	CRF          int      // constant rate factor for software encoding (0 for default)
+	Bitrate      string   // video bitrate, such as "4M"
+	AudioCodec   string   // such as "aac"
+	AudioBitrate string   // such as "128k"
+	Filters      []string // video filters, such as "scale=-2:720", applied before any watermark
+	Extra        []string // other output options
+}
+
+// convertVideo saves a video file as MP4, with any watermark, using the configured profile and encoder.
+func (up *Uploader) convertVideo(fromName string, progress func(int)) error {
+
+	var inOpts, outOpts []string
+	p := up.profile(MediaVideo)
+
+	// filters from the profile, applied first, after correcting the orientation
+	filters := p.Filters
+	if rf := rotationFilter(up.probeVideo(fromName).Rotation); rf != "" {
+		inOpts = append(inOpts, "-noautorotate")
+		outOpts = append(outOpts, "-metadata:s:v:0", "rotate=0")
+		filters = append([]string{rf}, filters...)
+	}
+	filter := strings.Join(filters, ",")
+	video := "[0]"
+	if filter != "" {
+		video = "[main]"
+	}
+
+	// watermark is a second input
+	if wf := up.watermarkFilter(video); wf != "" {
+		outOpts = append(outOpts, "-i", watermarkFile)
+		if filter != "" {
+			wf = "[0]" + filter + video + ";" + wf
+		}
+		filter = wf
+	}
+
+	enc := up.VideoEncoder
+	switch {
+	case enc == "":
+		// software encoding
+		if p.Codec != "" {
+			outOpts = append(outOpts, "-c:v", p.Codec)
+		}
+		if p.CRF > 0 {
+			outOpts = append(outOpts, "-crf", strconv.Itoa(p.CRF))
+		}
+
+	case strings.HasSuffix(enc, "_vaapi"):
+		// frames must be uploaded to the device, after any software filters
+		dev := up.VideoDevice
+		if dev == "" {
+			dev = defaultVAAPI
+		}
+		inOpts = append(inOpts, "-vaapi_device", dev)
+		if filter != "" {
+			filter += ",format=nv12,hwupload"
+		} else {
+			filter = "format=nv12,hwupload"
+		}
+		outOpts = append(outOpts, "-c:v", enc)
+
+	case strings.HasSuffix(enc, "_videotoolbox"):
+		// default bitrate is too low for acceptable quality
+		outOpts = append(outOpts, "-c:v", enc, "-allow_sw", "1")
+		if p.Bitrate == "" {
+			outOpts = append(outOpts, "-b:v", "6M")
+		}
+
+	default:
+		// such as h264_nvenc, which uploads frames itself
+		outOpts = append(outOpts, "-c:v", enc)
+	}
+
+	if filter != "" {
+		if strings.HasPrefix(filter, "[") {
+			outOpts = append(outOpts, "-filter_complex", filter)
+		} else {
+			outOpts = append(outOpts, "-vf", filter)
+		}
+	}
+	if up.Loudness != 0 {
+		outOpts = append(outOpts, "-af", up.loudnorm())
+	}
+	outOpts = append(outOpts, p.options()...)
+
+	return up.convertWith(fromName, ".mp4", inOpts, outOpts, progress)
+}
+
+// loudnorm returns the FFmpeg filter for EBU R128 loudness normalisation.
+func (up *Uploader) loudnorm() string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", up.Loudness)
+}
+
+// normaliseAudio saves an audio file with normalised loudness, in the same format.
+// The original has a temporary suffix, removed for the output file. Any cover art is copied unchanged.
+func (up *Uploader) normaliseAudio(fromName string, progress func(int)) error {
+	return up.convertWith(fromName, "", nil, []string{"-af", up.loudnorm(), "-c:v", "copy"}, progress)
+}
+
+// rotationFilter returns the FFmpeg filter to display a video upright, for a rotation in its metadata.
+// We apply it ourselves, rather than leave it to FFmpeg's autorotation, so that it happens before
+// filters from the profile and the watermark, and so that the rotation is not left in the converted file.
+func rotationFilter(degrees int) string {
+
+	switch degrees {
+	case 90:
+		return "transpose=clock"
+	case 180:
+		return "hflip,vflip"
+	case 270:
+		return "transpose=cclock"
+	default:
+		return ""
+	}
+}
+
+// options returns the FFmpeg output options from a profile, other than codec, CRF and filters.
+func (p *Profile) options() []string {
+
+	var opts []string
+	if p.Preset != "" {
+		opts = append(opts, "-preset", p.Preset)
+	}
+	if p.Bitrate != "" {
+		opts = append(opts, "-b:v", p.Bitrate)
+	}
+	if p.AudioCodec != "" {
+		opts = append(opts, "-c:a", p.AudioCodec)
+	}
+	if p.AudioBitrate != "" {
+		opts = append(opts, "-b:a", p.AudioBitrate)
+	}
+	return append(opts, p.Extra...)
+}
+
+// profile returns the conversion profile for a media type, or an empty profile for FFmpeg's defaults.
+func (up *Uploader) profile(mediaType int) *Profile {
+
+	if p := up.Profiles[mediaType]; p != nil {
+		return p
+	}
+	return &Profile{}
+}
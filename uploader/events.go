@@ -0,0 +1,48 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Event log of the lifecycle of media files.
+
+import (
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Media lifecycle events.
+const (
+	EventUploaded  = iota // upload received and queued for processing
+	EventProcessed        // processing complete, ready to be bound to a parent
+	EventBound            // new media bound to a parent
+	EventReplaced         // media bound to a parent, replacing a previous version
+	EventDeleted          // media no longer referenced by its parent, and removed
+	EventFailed           // processing failed, or upload rejected
+)
+
+// MediaEvent records a change in the lifecycle of a media file.
+// Events may be repeated if an operation is redone on recovery.
+type MediaEvent struct {
+	Event  int
+	At     time.Time
+	Tx     etx.TxId // transaction for uploads (0 for a deletion when the parent is deleted)
+	Parent int64    // parent ID, when bound (otherwise 0)
+	Name   string   // media name, as given by the client
+	File   string   // media file name, if known
+	Detail string   // reason for failure
+}
+
+// event reports a media event to the application.
+func (up *Uploader) event(e *MediaEvent) {
+
+	if up.MediaEvents == nil && len(up.subscribers) == 0 {
+		return
+	}
+	e.At = time.Now()
+	if up.MediaEvents != nil {
+		up.MediaEvents(e)
+	}
+	for _, fn := range up.subscribers {
+		fn(e)
+	}
+}
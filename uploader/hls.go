@@ -0,0 +1,143 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// HLS renditions of videos, for streamed playback.
+//
+// Each rendition is a playlist and a single file of segments, addressed by byte ranges,
+// so that it can be linked and removed with its video in the same way as a thumbnail.
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HLS options.
+const (
+	HLSNone = iota // MP4 only
+	HLSAlso        // HLS rendition alongside the MP4
+	HLSOnly        // HLS rendition instead of the MP4
+)
+
+// Playlist returns the file name for the HLS playlist of a video.
+// With HLSOnly, the playlist is the media file, as returned by Bind.File.
+// Otherwise the playlist exists only if Uploader.HLS is HLSAlso.
+func Playlist(fileName string) string {
+
+	if isPlaylist(fileName) {
+		return fileName
+	}
+	return "L" + changeExt(fileName, ".m3u8")[1:]
+}
+
+// isPlaylist returns true for an HLS playlist name.
+func isPlaylist(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".m3u8"
+}
+
+// linkPlaylist adds a name for a playlist, referring to the segments file with the corresponding name.
+func linkPlaylist(from, to string) error {
+
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+
+	// replace segment references
+	seg := segments(filepath.Base(to))
+	var out bytes.Buffer
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		ln := sc.Text()
+		if ln != "" && !strings.HasPrefix(ln, "#") {
+			ln = seg
+		}
+		out.WriteString(ln + "\n")
+	}
+
+	return ioutil.WriteFile(to, out.Bytes(), 0666)
+}
+
+// linkVariant adds a name for a file saved with a media file, rewriting it if it is a playlist.
+func linkVariant(from, to string) error {
+
+	if isCaptions(to) {
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			return nil // optional
+		}
+	}
+
+	if isPlaylist(to) {
+		if _, err := os.Stat(to); err == nil {
+			return nil // already linked, if we are redoing the operation
+		}
+		return linkPlaylist(from, to)
+	}
+	return linkOrCopy(from, to)
+}
+
+// hlsOptions returns FFmpeg output options for a single-file HLS rendition, written as the specified playlist.
+func hlsOptions(playlist string) []string {
+
+	return []string{
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_flags", "single_file",
+		"-hls_segment_filename", segments(playlist),
+	}
+}
+
+// saveStream adds an HLS rendition for an MP4 video, if configured.
+// For HLSOnly, the playlist replaces the video.
+func (up *Uploader) saveStream(videoName string) error {
+
+	switch up.HLS {
+	case HLSAlso:
+		// the playlist may already exist, if we are redoing the operations, and FFmpeg will not overwrite it
+		pl := Playlist(videoName)
+		if exists, err := exists(filepath.Join(up.tempPath(), pl)); err != nil || exists {
+			return err
+		}
+		args := append([]string{"-v", "error", "-i", videoName, "-c", "copy"}, hlsOptions(pl)...)
+		return up.ffmpeg(append(args, pl)...)
+
+	case HLSOnly:
+		return up.convert(videoName, ".m3u8", append([]string{"-c", "copy"}, hlsOptions(changeExt(videoName, ".m3u8"))...)...)
+
+	default:
+		return nil
+	}
+}
+
+// segments returns the name of the segments file for a playlist, or for the video it was made from.
+func segments(fileName string) string {
+	return "T" + changeExt(fileName, ".ts")[1:]
+}
+
+// streamName changes the file type for a video name, if videos are replaced by HLS renditions.
+func (up *Uploader) streamName(name string) string {
+
+	if up.HLS == HLSOnly && strings.ToLower(filepath.Ext(name)) == ".mp4" {
+		return changeExt(name, ".m3u8")
+	}
+	return name
+}
+
+// streamVariants returns the names of the HLS files saved with a video.
+func (up *Uploader) streamVariants(fileName string) []string {
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".mp4":
+		if up.HLS == HLSAlso {
+			return []string{Playlist(fileName), segments(fileName)}
+		}
+	case ".m3u8":
+		return []string{segments(fileName)}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Rejection of uploads received after the parent form has been submitted.
+
+import (
+	"errors"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// ErrLate is returned by Save and similar functions for an upload received after DoNext has been called for its transaction.
+// A client may continue to send uploads after its form has been submitted, and they would not be bound to the parent.
+var ErrLate = errors.New("Upload received after the form was submitted")
+
+// commit records that the parent update for a transaction has been submitted. It must be called with muUploads locked.
+func (up *Uploader) commit(tx etx.TxId) {
+	up.committed[tx] = true
+}
+
+// forgetCommitted discards committed transactions started before the cutoff time, when their codes are no longer valid.
+func (up *Uploader) forgetCommitted(cutoff time.Time) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	defer up.muUploads.Unlock()
+
+	for tx := range up.committed {
+		if etx.Timestamp(tx).Before(cutoff) {
+			delete(up.committed, tx)
+		}
+	}
+}
+
+// isLate returns true if an upload is for a transaction that has been committed. It must be called with muUploads locked.
+func (up *Uploader) isLate(tx etx.TxId) bool {
+	return up.committed[tx]
+}
@@ -0,0 +1,57 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Renaming of media files saved by earlier implementations.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RenameLegacy renames media files saved by earlier implementations, such as the images package, with file types
+// that are not normalised (".jpeg", ".JPG", ".PNG" and ".JPEG"), and their thumbnails. Names in the form "P-owner$rev-name"
+// are otherwise unchanged, because they are the same for the uploader. It returns a map of old to new file names,
+// so that the application can update its database. Call it at startup, before any parent is updated.
+func (up *Uploader) RenameLegacy() (map[string]string, error) {
+
+	fis, err := ioutil.ReadDir(up.filePath())
+	if err != nil {
+		return nil, err
+	}
+
+	renamed := make(map[string]string)
+	for _, fi := range fis {
+		old := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(old, "P-") || isUpload(old) {
+			continue // only saved media files
+		}
+
+		var ext string
+		switch filepath.Ext(old) {
+		case ".jpeg", ".JPG", ".JPEG":
+			ext = ".jpg"
+		case ".PNG":
+			ext = ".png"
+		default:
+			continue
+		}
+		nm := changeExt(old, ext)
+
+		// don't overwrite a file saved with the normalised type
+		if _, err := os.Stat(filepath.Join(up.filePath(), nm)); err == nil {
+			continue
+		}
+
+		if err := os.Rename(filepath.Join(up.filePath(), old), filepath.Join(up.filePath(), nm)); err != nil {
+			return renamed, err
+		}
+		if err := os.Rename(filepath.Join(up.filePath(), Thumbnail(old)), filepath.Join(up.filePath(), Thumbnail(nm))); err != nil && !os.IsNotExist(err) {
+			return renamed, err
+		}
+		renamed[old] = nm
+	}
+	return renamed, nil
+}
@@ -0,0 +1,114 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Checks that file content matches its type, using magic numbers.
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// signature is a magic number at an offset in a file.
+type signature struct {
+	offset int
+	magic  string
+}
+
+var (
+	isoMedia = []signature{{4, "ftyp"}, {4, "moov"}, {4, "mdat"}, {4, "wide"}, {4, "free"}, {4, "skip"}}
+	matroska = []signature{{0, "\x1A\x45\xDF\xA3"}}
+	mpegTS   = []signature{{0, "\x47"}}
+	ogg      = []signature{{0, "OggS"}}
+	riff     = []signature{{0, "RIFF"}}
+	asf      = []signature{{0, "\x30\x26\xB2\x75\x8E\x66\xCF\x11"}}
+	msOffice = []signature{{0, "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"}}
+	zip      = []signature{{0, "PK\x03\x04"}}
+
+	// signatures for file types, by extension
+	signatures = map[string][]signature{
+		".3gp":  isoMedia,
+		".aac":  {{0, "\xFF\xF1"}, {0, "\xFF\xF9"}, {0, "ADIF"}},
+		".avi":  riff,
+		".doc":  msOffice,
+		".docx": zip,
+		".flac": {{0, "fLaC"}},
+		".flv":  {{0, "FLV"}},
+		".m4a":  isoMedia,
+		".m4v":  isoMedia,
+		".mkv":  matroska,
+		".mov":  isoMedia,
+		".mp4":  isoMedia,
+		".mpeg": {{0, "\x00\x00\x01\xBA"}, {0, "\x00\x00\x01\xB3"}},
+		".mpg":  {{0, "\x00\x00\x01\xBA"}, {0, "\x00\x00\x01\xB3"}},
+		".mts":  mpegTS,
+		".odp":  zip,
+		".ods":  zip,
+		".odt":  zip,
+		".oga":  ogg,
+		".ogg":  ogg,
+		".ogv":  ogg,
+		".opus": ogg,
+		".ppt":  msOffice,
+		".pptx": zip,
+		".ts":   mpegTS,
+		".wav":  riff,
+		".webm": matroska,
+		".wma":  asf,
+		".wmv":  asf,
+		".xls":  msOffice,
+		".xlsx": zip,
+	}
+
+	// executable content, never accepted
+	executables = []signature{
+		{0, "MZ"},               // Windows
+		{0, "\x7FELF"},          // Linux
+		{0, "\xFE\xED\xFA\xCE"}, // Mach-O
+		{0, "\xFE\xED\xFA\xCF"},
+		{0, "\xCE\xFA\xED\xFE"},
+		{0, "\xCF\xFA\xED\xFE"},
+		{0, "\xCA\xFE\xBA\xBE"}, // Mach-O universal, or Java class
+		{0, "#!"},               // script
+	}
+)
+
+// validContent returns true if file content is acceptable for the type indicated by its name.
+// Types with no known signature are accepted unless they appear to be executable.
+func validContent(name string, data []byte) bool {
+
+	if matches(data, executables) {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".mp3":
+		// ID3 tag, or MPEG audio frame sync
+		return bytes.HasPrefix(data, []byte("ID3")) || (len(data) > 1 && data[0] == 0xFF && data[1]&0xE0 == 0xE0)
+
+	case ".pdf":
+		// header may follow other bytes, within the first 1024
+		if len(data) > 1024 {
+			data = data[:1024]
+		}
+		return bytes.Contains(data, []byte("%PDF-"))
+	}
+
+	if sigs, ok := signatures[ext]; ok {
+		return matches(data, sigs)
+	}
+	return true
+}
+
+// matches returns true if data matches any of a set of signatures.
+func matches(data []byte, sigs []signature) bool {
+
+	for _, s := range sigs {
+		if len(data) >= s.offset+len(s.magic) && string(data[s.offset:s.offset+len(s.magic)]) == s.magic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Image metadata, such as EXIF.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata holds details of an uploaded media file, for the parent application.
+// Fields are zero if not known.
+type Metadata struct {
+	Taken    time.Time     // capture date
+	Make     string        // camera maker
+	Model    string        // camera model
+	Width    int           // pixels, as displayed
+	Height   int           //  ..
+	Duration time.Duration // video length
+	Rotation int           // clockwise rotation for display of a video, in degrees (0, 90, 180 or 270)
+}
+
+var errBadMetadata = errors.New("uploader: cannot parse image metadata")
+
+// JPEG markers
+const (
+	jpegSOI  = 0xD8 // start of image
+	jpegSOS  = 0xDA // start of scan
+	jpegAPP1 = 0xE1 // EXIF or XMP
+	jpegAPPD = 0xED // Photoshop, including IPTC
+	jpegCOM  = 0xFE // comment
+)
+
+// stripMetadata returns an image file with metadata removed. It returns false if the image must be re-encoded instead.
+// (Resized and converted images are saved without metadata anyway.)
+func stripMetadata(name string, data []byte) ([]byte, bool) {
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		stripped, orientation, err := stripJPEG(data)
+		if err != nil || orientation != 1 {
+			return nil, false // re-encode the image, already decoded upright
+		}
+		return stripped, true
+
+	case ".png":
+		stripped, err := stripPNG(data)
+		if err != nil {
+			return nil, false
+		}
+		return stripped, true
+
+	default:
+		return nil, false
+	}
+}
+
+// stripJPEG removes metadata segments from a JPEG file, without decoding the image.
+// ICC colour profiles and other segments needed for display are kept.
+// It also returns the orientation specified by the EXIF data, or 1 if none.
+func stripJPEG(data []byte) ([]byte, int, error) {
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, 0, errBadMetadata
+	}
+
+	orientation := 1
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+
+	for {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return nil, 0, errBadMetadata
+		}
+		marker := data[i+1]
+		if marker == jpegSOS {
+			// the rest is image data
+			return append(out, data[i:]...), orientation, nil
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + n
+		if n < 2 || end > len(data) {
+			return nil, 0, errBadMetadata
+		}
+
+		switch marker {
+		case jpegAPP1:
+			if exif := data[i+4 : end]; bytes.HasPrefix(exif, []byte("Exif\x00\x00")) {
+				if o := exifOrientation(exif[6:]); o != 0 {
+					orientation = o
+				}
+			}
+
+		case jpegAPPD, jpegCOM:
+
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+}
+
+// stripPNG removes metadata chunks from a PNG file, without decoding the image.
+func stripPNG(data []byte) ([]byte, error) {
+
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(sig)) {
+		return nil, errBadMetadata
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, sig...)
+	i := len(sig)
+
+	for i < len(data) {
+		// length, type, data and CRC
+		if i+12 > len(data) {
+			return nil, errBadMetadata
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) {
+			return nil, errBadMetadata
+		}
+
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "iTXt", "zTXt", "tIME":
+
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// EXIF tags
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// exifData is a parsed EXIF structure, in TIFF format.
+type exifData struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+// imageMetadata returns the metadata for an image, from its EXIF data if any.
+func imageMetadata(data []byte, img image.Image) *Metadata {
+
+	md := &Metadata{}
+	if img != nil {
+		size := img.Bounds().Size()
+		md.Width = size.X
+		md.Height = size.Y
+	}
+
+	if ex := findExif(data); ex != nil {
+		ifd0 := ex.ifd(ex.first())
+		md.Make = ex.text(ifd0, tagMake)
+		md.Model = ex.text(ifd0, tagModel)
+
+		taken := ex.text(ex.ifd(ex.uint(ifd0, tagExifIFD)), tagDateTimeOriginal)
+		if taken == "" {
+			taken = ex.text(ifd0, tagDateTime)
+		}
+		if t, err := time.ParseInLocation("2006:01:02 15:04:05", taken, time.Local); err == nil {
+			md.Taken = t
+		}
+	}
+	return md
+}
+
+// findExif returns the EXIF data from a JPEG file, or nil.
+func findExif(data []byte) *exifData {
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF && data[i+1] != jpegSOS; {
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil
+		}
+		if seg := data[i+4 : end]; data[i+1] == jpegAPP1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return newExif(seg[6:])
+		}
+		i = end
+	}
+	return nil
+}
+
+// newExif returns parsed EXIF data, or nil if the format is not recognised.
+func newExif(tiff []byte) *exifData {
+
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		return &exifData{tiff: tiff, order: binary.LittleEndian}
+	case "MM\x00*":
+		return &exifData{tiff: tiff, order: binary.BigEndian}
+	default:
+		return nil
+	}
+}
+
+// entry returns the offset of a tag's entry in an IFD, or 0 if not found.
+func (ex *exifData) entry(ifd []byte, tag uint16) int {
+
+	if len(ifd) < 2 {
+		return 0
+	}
+	n := int(ex.order.Uint16(ifd))
+	for e := 2; e+12 <= len(ifd) && n > 0; e, n = e+12, n-1 {
+		if ex.order.Uint16(ifd[e:]) == tag {
+			return e
+		}
+	}
+	return 0
+}
+
+// first returns the offset of the first IFD.
+func (ex *exifData) first() int {
+	return int(ex.order.Uint32(ex.tiff[4:]))
+}
+
+// ifd returns the IFD at an offset, or nil.
+func (ex *exifData) ifd(offset int) []byte {
+	if offset < 8 || offset+2 > len(ex.tiff) {
+		return nil
+	}
+	return ex.tiff[offset:]
+}
+
+// text returns an ASCII value from an IFD.
+func (ex *exifData) text(ifd []byte, tag uint16) string {
+
+	e := ex.entry(ifd, tag)
+	if e == 0 || ex.order.Uint16(ifd[e+2:]) != 2 {
+		return ""
+	}
+
+	// short values are inline
+	n := int(ex.order.Uint32(ifd[e+4:]))
+	var v []byte
+	if n <= 4 {
+		v = ifd[e+8 : e+8+n]
+	} else {
+		off := int(ex.order.Uint32(ifd[e+8:]))
+		if off+n > len(ex.tiff) {
+			return ""
+		}
+		v = ex.tiff[off : off+n]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(v), "\x00"))
+}
+
+// uint returns a SHORT or LONG value from an IFD.
+func (ex *exifData) uint(ifd []byte, tag uint16) int {
+
+	e := ex.entry(ifd, tag)
+	if e == 0 {
+		return 0
+	}
+	switch ex.order.Uint16(ifd[e+2:]) {
+	case 3:
+		return int(ex.order.Uint16(ifd[e+8:]))
+	case 4:
+		return int(ex.order.Uint32(ifd[e+8:]))
+	default:
+		return 0
+	}
+}
+
+// probeVideo returns the metadata for a video, using ffprobe.
+func (up *Uploader) probeVideo(fileName string) *Metadata {
+
+	md := &Metadata{}
+
+	var out bytes.Buffer
+	if err := up.videoTool("ffprobe", &out, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", fileName); err != nil {
+		up.errorLog.Print(err.Error())
+		return md
+	}
+
+	var probe struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			Tags      struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+			SideData []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		up.errorLog.Print(err.Error())
+		return md
+	}
+
+	if secs, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		md.Duration = time.Duration(secs * float64(time.Second))
+	}
+	tags := probe.Format.Tags
+	if t, err := time.Parse(time.RFC3339Nano, tags["creation_time"]); err == nil {
+		md.Taken = t
+	}
+	md.Make = tags["com.apple.quicktime.make"]
+	md.Model = tags["com.apple.quicktime.model"]
+
+	for _, st := range probe.Streams {
+		if st.CodecType == "video" {
+			md.Width = st.Width
+			md.Height = st.Height
+
+			// rotation is a tag from older versions of FFmpeg, and a display matrix (anticlockwise) from newer ones
+			if r, err := strconv.Atoi(st.Tags.Rotate); err == nil {
+				md.Rotation = r
+			} else {
+				for _, sd := range st.SideData {
+					md.Rotation = -int(sd.Rotation)
+				}
+			}
+			r := (md.Rotation%360 + 360) % 360
+			md.Rotation = (r + 45) / 90 % 4 * 90 // nearest quarter turn
+			if md.Rotation == 90 || md.Rotation == 270 {
+				md.Width, md.Height = md.Height, md.Width
+			}
+			break
+		}
+	}
+	return md
+}
+
+// exifOrientation returns the orientation tag from EXIF data in TIFF format, or 0 if not found.
+func exifOrientation(tiff []byte) int {
+
+	ex := newExif(tiff)
+	if ex == nil {
+		return 0
+	}
+	return ex.uint(ex.ifd(ex.first()), tagOrientation)
+}
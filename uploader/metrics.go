@@ -0,0 +1,138 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Metrics for uploads.
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/inchworks/webparts/metrics"
+)
+
+// stats holds cumulative statistics for metrics.
+type stats struct {
+	received    [MediaDoc + 1]int64 // uploads received, by media type (atomic)
+	failed      int64               // uploads failed or rejected (atomic)
+	storedBytes int64               // size of stored media, measured periodically (atomic)
+
+	conversions *metrics.Buckets     // conversion durations, in seconds
+	converting  map[string]time.Time // conversions in progress, by file, protected by muUploads
+}
+
+// mediaTypeNames label metrics by media type.
+var mediaTypeNames = []string{"unknown", "image", "video", "audio", "document"}
+
+// Metrics implements metrics.Collector.
+func (up *Uploader) Metrics() []*metrics.Metric {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	var uploads int
+	for _, op := range up.ops {
+		uploads += op.uploads
+	}
+	var longest time.Duration
+	now := time.Now()
+	for _, started := range up.stats.converting {
+		if d := now.Sub(started); d > longest {
+			longest = d
+		}
+	}
+	up.muUploads.Unlock()
+
+	received := metrics.NewCounter("webparts_uploader_received_total", "Uploads received, by media type.")
+	for mt := MediaImage; mt <= MediaDoc; mt++ {
+		received.Add(float64(atomic.LoadInt64(&up.stats.received[mt])), "type", mediaTypeNames[mt])
+	}
+
+	ms := []*metrics.Metric{
+		received,
+		metrics.NewGauge("webparts_uploader_uploads", "Uploads being processed.").Add(float64(uploads)),
+		metrics.NewGauge("webparts_uploader_queued", "Uploads waiting for processing, by worker.").
+			Add(float64(len(up.chSave)), "worker", "media").
+			Add(float64(len(up.chSaveAV)), "worker", "av").
+			Add(float64(len(up.chConvert)), "worker", "video"),
+		metrics.NewCounter("webparts_uploader_failures_total", "Uploads failed or rejected.").
+			Add(float64(atomic.LoadInt64(&up.stats.failed))),
+		metrics.NewGauge("webparts_uploader_converting_seconds", "Time taken so far by the longest conversion in progress.").
+			Add(longest.Seconds()),
+		metrics.NewGauge("webparts_uploader_stored_bytes", "Size of stored media files.").
+			Add(float64(atomic.LoadInt64(&up.stats.storedBytes))),
+	}
+	if up.stats.conversions != nil {
+		ms = append(ms, up.stats.conversions.Metric("webparts_uploader_conversion_seconds", "Duration of video conversions."))
+	}
+	return ms
+}
+
+// countFailed counts an upload that failed or was rejected.
+func (up *Uploader) countFailed() {
+	atomic.AddInt64(&up.stats.failed, 1)
+}
+
+// countReceived counts an upload received.
+func (up *Uploader) countReceived(mediaType int) {
+	if mediaType > 0 && mediaType < len(up.stats.received) {
+		atomic.AddInt64(&up.stats.received[mediaType], 1)
+	}
+}
+
+// initMetrics prepares the statistics for metrics.
+func (up *Uploader) initMetrics() {
+
+	up.stats.converting = make(map[string]time.Time)
+	if up.VideoPackage != "" {
+		up.stats.conversions = metrics.NewBuckets(10, 30, 60, 120, 300, 600, 1200, 3600)
+	}
+}
+
+// measureStorage totals the size of stored media files.
+func (up *Uploader) measureStorage() {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	dir := up.filePath()
+	up.muUploads.Unlock()
+
+	var n int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		// exclude chunks, the deduplication cache and quarantine
+		if nm := d.Name(); strings.HasPrefix(nm, "C-") || strings.HasPrefix(nm, "H-") || strings.HasPrefix(nm, "Q-") {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			n += fi.Size()
+		}
+		return nil
+	})
+	atomic.StoreInt64(&up.stats.storedBytes, n)
+}
+
+// startConversion records a conversion in progress, and returns a function to be called when it ends.
+func (up *Uploader) startConversion(file string) func() {
+
+	started := time.Now()
+
+	// SERIALISED
+	up.muUploads.Lock()
+	up.stats.converting[file] = started
+	up.muUploads.Unlock()
+
+	return func() {
+		up.muUploads.Lock()
+		delete(up.stats.converting, file)
+		up.muUploads.Unlock()
+
+		if up.stats.conversions != nil {
+			up.stats.conversions.Observe(time.Since(started).Seconds())
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Migration of media files to a new location, while the server is running.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+const opMigrate = 1 // operation type
+
+// OpMigrate is the logged operation to migrate media files, so that a migration interrupted by a restart is resumed.
+type OpMigrate struct {
+	To          string // new location
+	BytesPerSec int64  // copying rate limit (0 for none)
+}
+
+// migration holds the state of a migration in progress.
+type migration struct {
+	from    string
+	to      string
+	flipped bool
+	copied  map[string]int64 // sizes of files copied
+}
+
+// mediaFS serves media files, from either location during a migration.
+type mediaFS struct {
+	up *Uploader
+}
+
+// FileSystem returns media files for an HTTP file server, such as http.FileServer.
+// During a migration it serves files from both the old and new locations.
+func (up *Uploader) FileSystem() http.FileSystem {
+	return mediaFS{up: up}
+}
+
+// Migrate copies media files to a new location, such as a mounted object storage volume, in the background.
+// Files are checked after copying, and copying is limited to bytesPerSec (0 for no limit).
+// When all files have been copied and no uploads are in progress, the uploader switches to the new location,
+// and OnMigrated is called so that the application can record it. Files are not removed from the old location.
+// The migration is an etx operation, resumed if the server is restarted.
+// It expects that a database transaction (needed to write redo records) has been started,
+// and returns the transaction ID, for the caller to start the migration with TM.DoNext after committing.
+func (up *Uploader) Migrate(to string, bytesPerSec int64) (etx.TxId, error) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	migrating := up.migration != nil
+	up.muUploads.Unlock()
+	if migrating {
+		return 0, errors.New("uploader: migration already in progress")
+	}
+
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return 0, err
+	}
+
+	tx := up.tm.Begin()
+	if err := up.tm.SetNext(tx, up, opMigrate, &OpMigrate{To: to, BytesPerSec: bytesPerSec}); err != nil {
+		return 0, err
+	}
+	return tx, nil
+}
+
+// Open returns a media file, from the new location if it has been copied, or the old location otherwise.
+func (fs mediaFS) Open(name string) (http.File, error) {
+
+	up := fs.up
+	name = filepath.Base(filepath.FromSlash(name))
+	if name == "." || name == string(filepath.Separator) {
+		return nil, os.ErrNotExist // no directory listing
+	}
+
+	f, err := os.Open(up.mediaPath(name))
+	if err != nil && os.IsNotExist(err) {
+
+		// SERIALISED
+		up.muUploads.Lock()
+		m := up.migration
+		var from string
+		if m != nil && m.flipped {
+			from = m.from
+		}
+		up.muUploads.Unlock()
+
+		if from != "" {
+			f, err = os.Open(filepath.Join(from, name))
+		}
+	}
+	return f, err
+}
+
+// copyChecked copies a file, and verifies the copy against a checksum of the original.
+// The copy is made under a temporary name, so that a partial copy is never seen.
+func copyChecked(from, to string) (int64, error) {
+
+	src, err := os.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(to), ".migrate-*")
+	if err != nil {
+		return 0, err
+	}
+
+	// copy with checksum
+	h := sha256.New()
+	n, err := io.Copy(dst, io.TeeReader(src, h))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if errC := dst.Close(); err == nil {
+		err = errC
+	}
+
+	// verify
+	if err == nil {
+		var sum []byte
+		if sum, err = fileSum(dst.Name()); err == nil && !bytes.Equal(sum, h.Sum(nil)) {
+			err = fmt.Errorf("uploader: checksum mismatch copying %s", filepath.Base(from))
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(dst.Name(), to)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return n, err
+}
+
+// fileSum returns the SHA-256 checksum of a file.
+func fileSum(path string) ([]byte, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// flip switches to the new location if no uploads are in progress, after copying any files added since the last pass.
+// It returns false if the uploader is busy. Files saved while it copies are copied by a final pass after the switch.
+func (up *Uploader) flip(m *migration) (bool, error) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	busy := len(up.ops) > 0
+	up.muUploads.Unlock()
+	if busy {
+		return false, nil
+	}
+
+	// final copy, without a rate limit
+	if _, err := up.migratePass(m, 0); err != nil {
+		return false, err
+	}
+
+	// remove copies of files deleted since they were copied
+	fs, err := ioutil.ReadDir(m.to)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range fs {
+		if _, err := os.Stat(filepath.Join(m.from, f.Name())); os.IsNotExist(err) {
+			os.Remove(filepath.Join(m.to, f.Name()))
+		}
+	}
+
+	// SERIALISED
+	up.muUploads.Lock()
+	defer up.muUploads.Unlock()
+
+	if len(up.ops) > 0 {
+		return false, nil // busy again
+	}
+
+	// switch locations
+	up.muPaths.Lock()
+	if up.paths.temp == up.paths.file {
+		up.paths.temp = m.to
+	}
+	up.paths.file = m.to
+	up.muPaths.Unlock()
+
+	m.flipped = true
+	return true, nil
+}
+
+// migrate copies files to the new location and switches to it, called as a background operation.
+func (up *Uploader) migrate(tx etx.TxId, op *OpMigrate) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	if up.migration != nil {
+		up.muUploads.Unlock()
+		return // already running
+	}
+	m := &migration{
+		from:   up.filePath(),
+		to:     op.To,
+		copied: make(map[string]int64),
+	}
+	up.migration = m
+	up.muUploads.Unlock()
+
+	err := up.migrateAll(m, op.BytesPerSec)
+
+	// SERIALISED
+	up.muUploads.Lock()
+	up.migration = nil
+	up.muUploads.Unlock()
+
+	if err != nil {
+		// leave the operation to be resumed on restart
+		up.errorLog.Print("Migration to ", op.To, " stopped: ", err.Error())
+		return
+	}
+
+	if up.OnMigrated != nil {
+		up.OnMigrated(op.To)
+	}
+	up.endMigrate(tx)
+}
+
+// endMigrate ends the transaction for a migration.
+func (up *Uploader) endMigrate(tx etx.TxId) {
+
+	// make a database transaction (needed by TM to delete redo record)
+	defer up.db.Begin()()
+
+	if err := up.tm.End(tx); err != nil {
+		up.errorLog.Print(err.Error())
+	}
+}
+
+// migrateAll copies files until the location can be switched, and then copies any files saved at the old location during the switch.
+func (up *Uploader) migrateAll(m *migration, bytesPerSec int64) error {
+
+	if m.from == m.to {
+		return nil // nothing to do, perhaps because the migration was complete when the server stopped
+	}
+
+	for {
+		n, err := up.migratePass(m, bytesPerSec)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			if done, err := up.flip(m); err != nil {
+				return err
+			} else if done {
+				break
+			}
+		}
+		time.Sleep(time.Second)
+	}
+
+	// files saved by operations that started before the switch
+	time.Sleep(up.MaxAge / 8)
+
+	_, err := up.migratePass(m, 0)
+	return err
+}
+
+// migratePass copies files not yet copied, returning the number copied.
+func (up *Uploader) migratePass(m *migration, bytesPerSec int64) (int, error) {
+
+	fs, err := ioutil.ReadDir(m.from)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, f := range fs {
+		name := f.Name()
+		if f.IsDir() || name[0] == '.' {
+			continue
+		}
+		if size, ok := m.copied[name]; ok && size == f.Size() {
+			continue // media files are not changed once saved
+		}
+
+		sz, err := copyChecked(filepath.Join(m.from, name), filepath.Join(m.to, name))
+		if os.IsNotExist(err) {
+			continue // deleted since the directory was read
+		} else if err != nil {
+			return n, err
+		}
+		m.copied[name] = sz
+		n++
+
+		if bytesPerSec > 0 {
+			time.Sleep(time.Duration(sz * int64(time.Second) / bytesPerSec))
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,83 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Opaque file names, so that users' names for media are not visible in URLs.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+const (
+	opaqueLen    = 24  // hex digits in an opaque name
+	opaquePrefix = "~" // marks an opaque name, never in a name from CleanName
+)
+
+// NameStore is implemented by the parent application to hold users' names for media stored under opaque names.
+type NameStore interface {
+	DisplayName(stored string) string                // user's name for a stored name, or "" if not known
+	SetDisplayName(stored string, name string) error // record the user's name for a stored name
+}
+
+// FileFromName returns a stored file name from a user's name for a newly uploaded file, as for the FileFromName function.
+// If NameKey is set, the user's name is replaced by an opaque name.
+func (up *Uploader) FileFromName(id etx.TxId, name string) string {
+	return FileFromName(id, up.storedName(name))
+}
+
+// NameFromFile returns the owner ID, media file name and revision from a file name, as for the NameFromFile function.
+// For opaque names, the media name is the user's name from Names, if known.
+func (up *Uploader) NameFromFile(fileName string) (string, string, int) {
+
+	owner, name, rev := NameFromFile(fileName)
+	if up.Names != nil && isOpaque(name) {
+		if dn := up.Names.DisplayName(name); dn != "" {
+			name = dn
+		}
+	}
+	return owner, name, rev
+}
+
+// isOpaque returns true if a name is already opaque.
+func isOpaque(name string) bool {
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if len(base) != len(opaquePrefix)+opaqueLen || !strings.HasPrefix(base, opaquePrefix) {
+		return false
+	}
+	_, err := hex.DecodeString(base[len(opaquePrefix):])
+	return err == nil
+}
+
+// setDisplayName records the user's name for an upload stored under an opaque name.
+func (up *Uploader) setDisplayName(name string, mediaType int) {
+
+	if up.NameKey == nil || up.Names == nil {
+		return
+	}
+	name = up.uploadName(name, mediaType)
+	if err := up.Names.SetDisplayName(up.storedName(name), name); err != nil {
+		up.errorLog.Print(err.Error())
+	}
+}
+
+// storedName returns the name used in file names for a user's name for media.
+// An opaque name is a keyed hash of the name without its type, so that it is unchanged when a file is converted,
+// with the type in lower case. Names are matched case-blind, so the hash is too.
+func (up *Uploader) storedName(name string) string {
+
+	if up.NameKey == nil || name == "" || isOpaque(name) {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	mac := hmac.New(sha256.New, up.NameKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSuffix(name, ext))))
+	return opaquePrefix + hex.EncodeToString(mac.Sum(nil))[:opaqueLen] + strings.ToLower(ext)
+}
@@ -0,0 +1,26 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Retention of uploads as received, before resizing or conversion.
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Original returns the file name for the upload retained with a media file, if Uploader.KeepOriginals is set.
+// Its content is the file as uploaded, which may be in a different format from the media file's type,
+// so that it can be processed again when display limits change.
+func Original(fileName string) string {
+	return "O" + fileName[1:]
+}
+
+// saveOriginal saves an upload as received, to be kept with the processed media file.
+func (up *Uploader) saveOriginal(req reqSave, name string) error {
+
+	if !up.KeepOriginals || req.mediaType == MediaDoc {
+		return nil // documents are saved unchanged
+	}
+	return ioutil.WriteFile(filepath.Join(up.tempPath(), Original(up.FileFromName(req.tx, name))), req.fullsize.Bytes(), 0666)
+}
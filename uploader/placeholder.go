@@ -0,0 +1,198 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Placeholders to be shown while media is loading.
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // thumbnails converted to WebP
+)
+
+const (
+	blurX = 4 // BlurHash components, horizontal
+	blurY = 3 // BlurHash components, vertical
+
+	base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// Placeholder returns the dominant colour (as #rrggbb) and a BlurHash string for a media file,
+// so that a page can show an instant placeholder while the media loads.
+// It is computed from the thumbnail, so it works for video posters as well as images.
+// (Thumbnails converted to AVIF cannot be decoded.)
+func (up *Uploader) Placeholder(fileName string) (colour string, blurHash string, err error) {
+
+	img, err := imaging.Open(up.mediaPath(Thumbnail(fileName)))
+	if err != nil {
+		return "", "", err
+	}
+
+	// a small image is enough
+	img = imaging.Fit(img, 64, 64, imaging.Box)
+
+	return dominantColour(img), encodeBlurHash(img, blurX, blurY), nil
+}
+
+// Placeholder returns the dominant colour and BlurHash for a file referenced by the parent, as for Uploader.Placeholder.
+// Call it after File, so that the parent can save the placeholder with its reference instead of computing it for each page.
+// It accepts the name passed to File or the new name returned, and uses the version of the file to be kept.
+func (b *Bind) Placeholder(fileName string) (colour string, blurHash string, err error) {
+
+	if fileName == "" {
+		return "", "", nil
+	}
+
+	// current version, as for File
+	_, name, _ := NameFromFile(fileName)
+	if cv := b.versions[strings.ToLower(b.up.mediaName(name))]; cv.fileName != "" {
+		fileName = cv.fileName
+	}
+	return b.up.Placeholder(fileName)
+}
+
+// dominantColour returns the most common colour in an image, as #rrggbb.
+// Colours are grouped coarsely, and the average of the largest group is returned.
+func dominantColour(img image.Image) string {
+
+	type sum struct{ n, r, g, b uint32 }
+	var groups [4096]sum
+	var best int
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+
+			k := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			s := &groups[k]
+			s.n++
+			s.r += r
+			s.g += g
+			s.b += b
+
+			if s.n > groups[best].n {
+				best = k
+			}
+		}
+	}
+
+	s := groups[best]
+	if s.n == 0 {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", s.r/s.n, s.g/s.n, s.b/s.n)
+}
+
+// encodeBlurHash returns the BlurHash for an image, as specified by https://github.com/woltapp/blurhash.
+func encodeBlurHash(img image.Image, nx int, ny int) string {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// pixels in linear colour space
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*w+x] = [3]float64{toLinear(r >> 8), toLinear(g >> 8), toLinear(b >> 8)}
+		}
+	}
+
+	// cosine transform
+	factors := make([][3]float64, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+
+			scale := 2 / float64(w*h)
+			if i == 0 && j == 0 {
+				scale = 1 / float64(w*h)
+			}
+			factors[j*nx+i] = [3]float64{f[0] * scale, f[1] * scale, f[2] * scale}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((nx-1)+(ny-1)*9, 1))
+
+	// maximum AC component
+	maxValue := 1.0
+	if len(factors) > 1 {
+		var actualMax float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		sb.WriteString(encode83(quantised, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+
+	// DC component
+	dc := factors[0]
+	sb.WriteString(encode83(toSRGB(dc[0])<<16|toSRGB(dc[1])<<8|toSRGB(dc[2]), 4))
+
+	// AC components
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+
+	return sb.String()
+}
+
+// encode83 returns a number in base 83, with the specified number of digits.
+func encode83(n int, length int) string {
+
+	s := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		s[i] = base83[n%83]
+		n /= 83
+	}
+	return string(s)
+}
+
+// signPow returns |v|^exp, with the sign of v.
+func signPow(v float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// toLinear converts an sRGB value (0-255) to linear colour space.
+func toLinear(v uint32) float64 {
+
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// toSRGB converts a linear value to sRGB (0-255).
+func toSRGB(v float64) int {
+
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
@@ -0,0 +1,172 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Progress of uploads.
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Upload states, reported by Progress.
+const (
+	StateUnknown    = iota // not uploaded, or completed by binding to a parent
+	StateReceiving         // chunks being received
+	StateQueued            // waiting for processing
+	StateProcessing        // image being resized, or video snapshot
+	StateConverting        // video format being converted
+	StateDone              // ready to be bound to parent
+	StateFailed            // processing failed
+	StateRejected          // rejected by virus scan, or exceeding video limits
+)
+
+// Progress is the state of an upload, so that a parent application can show progress to a user.
+type Progress struct {
+	State    int
+	Received int64  // bytes received
+	Percent  int    // processing complete, 0 to 100, including video conversion
+	Reason   string // why an upload was rejected
+}
+
+// Progress returns the state of an upload, identified by its transaction code and the name given by the client.
+func (up *Uploader) Progress(tx etx.TxId, name string) Progress {
+
+	name = CleanName(name)
+
+	// SERIALISED
+	up.muUploads.Lock()
+	p, ok := up.progress[tx][name]
+	up.muUploads.Unlock()
+
+	if !ok {
+		// perhaps still being received in chunks
+		if _, n := up.chunksFound(tx, name); n > 0 {
+			p = Progress{State: StateReceiving, Received: n}
+		}
+	}
+	return p
+}
+
+// doneProgress records the completion of processing for an upload.
+func (up *Uploader) doneProgress(tx etx.TxId, name string, err error) {
+	if err != nil {
+		up.setProgress(tx, name, StateFailed, -1, 0)
+		up.event(&MediaEvent{Event: EventFailed, Tx: tx, Name: name, Detail: err.Error()})
+		up.countFailed()
+	} else {
+		up.setProgress(tx, name, StateDone, -1, 100)
+		up.event(&MediaEvent{Event: EventProcessed, Tx: tx, Name: name})
+	}
+}
+
+// forgetProgress discards the progress of uploads for a transaction.
+func (up *Uploader) forgetProgress(tx etx.TxId) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	delete(up.progress, tx)
+	delete(up.limits, tx)
+	up.muUploads.Unlock()
+}
+
+// reject records the rejection of an upload, and reports it to the application.
+func (up *Uploader) reject(tx etx.TxId, name string, reason string) {
+
+	up.rejectProgress(tx, name, reason)
+	if up.OnRejected != nil {
+		up.OnRejected(tx, name, reason)
+	}
+}
+
+// rejectProgress records the rejection of an upload.
+func (up *Uploader) rejectProgress(tx etx.TxId, name string, reason string) {
+
+	up.setProgress(tx, name, StateRejected, -1, 0)
+
+	// SERIALISED
+	up.muUploads.Lock()
+	p := up.progress[tx][name]
+	p.Reason = reason
+	up.progress[tx][name] = p
+	up.muUploads.Unlock()
+
+	up.event(&MediaEvent{Event: EventFailed, Tx: tx, Name: name, Detail: reason})
+	up.countFailed()
+}
+
+// setProgress records a change in the state of an upload. A negative received count leaves it unchanged.
+func (up *Uploader) setProgress(tx etx.TxId, name string, state int, received int64, percent int) {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	defer up.muUploads.Unlock()
+
+	uploads := up.progress[tx]
+	if uploads == nil {
+		uploads = make(map[string]Progress)
+		up.progress[tx] = uploads
+	}
+
+	p := uploads[name]
+	p.State = state
+	if received >= 0 {
+		p.Received = received
+	}
+	p.Percent = percent
+	uploads[name] = p
+}
+
+// progressWriter parses the progress output from FFmpeg, and reports the percentage of a video converted.
+type progressWriter struct {
+	duration time.Duration
+	report   func(int)
+	percent  int
+	partial  []byte
+}
+
+// Write implements io.Writer, for key=value lines from FFmpeg's -progress option.
+func (pw *progressWriter) Write(p []byte) (int, error) {
+
+	pw.partial = append(pw.partial, p...)
+	for {
+		i := bytes.IndexByte(pw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSpace(pw.partial[:i])
+		pw.partial = pw.partial[i+1:]
+
+		// out_time_us is the output position in microseconds (out_time_ms is the same, mis-named)
+		kv := bytes.SplitN(line, []byte("="), 2)
+		if len(kv) != 2 || string(kv[0]) != "out_time_us" {
+			continue
+		}
+		us, err := strconv.ParseInt(string(kv[1]), 10, 64)
+		if err != nil {
+			continue // "N/A" at the start
+		}
+		percent := int(time.Duration(us) * time.Microsecond * 100 / pw.duration)
+		if percent > 99 {
+			percent = 99 // 100 when saved
+		}
+		if percent > pw.percent {
+			pw.percent = percent
+			pw.report(percent)
+		}
+	}
+	return len(p), nil
+}
+
+// ffmpegProgress executes an FFmpeg command, reporting progress as a percentage of the duration of the input.
+func (up *Uploader) ffmpegProgress(duration time.Duration, report func(int), arg ...string) error {
+
+	if duration <= 0 {
+		return up.ffmpeg(arg...)
+	}
+	pw := &progressWriter{duration: duration, report: report}
+	return up.ffmpegOut(pw, append([]string{"-progress", "pipe:1", "-nostats"}, arg...)...)
+}
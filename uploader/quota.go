@@ -0,0 +1,129 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Storage quotas, and limits on upload sizes.
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Quota is the interface to storage allowances, implemented by the parent application.
+type Quota interface {
+	// Allowance returns the current storage used and the limit for the user making a set of uploads.
+	// A limit of 0 means no limit.
+	Allowance(tx etx.TxId) (used int64, limit int64, err error)
+}
+
+var (
+	errQuota    = errors.New("Storage quota exceeded")
+	errTooLarge = errors.New("File too large")
+)
+
+// limitReader reads up to a limit, and records if the limit was exceeded.
+type limitReader struct {
+	r        io.Reader
+	n        int64 // bytes remaining
+	exceeded bool
+}
+
+// DiskUsage returns the storage used by a set of media files, including their thumbnails, renditions and HLS files.
+// The parent application may use it to calculate a user's usage.
+func (up *Uploader) DiskUsage(fileNames ...string) (n int64) {
+
+	for _, fn := range fileNames {
+		for _, f := range append([]string{fn}, up.variants(fn)...) {
+			if fi, err := os.Stat(up.mediaPath(f)); err == nil {
+				n += fi.Size()
+			}
+		}
+	}
+	return
+}
+
+// checkQuota returns an error if an upload of the specified size, for a file name, would exceed the user's allowance.
+func (up *Uploader) checkQuota(tx etx.TxId, name string, size int64) (err error, byClient bool) {
+
+	remaining, err := up.quotaRemaining(tx, name)
+	if err != nil {
+		return err, false
+	}
+	if remaining >= 0 && size > remaining {
+		return errQuota, true
+	}
+	return nil, true
+}
+
+// quotaRemaining returns the storage allowance remaining for an upload, for a file name, or -1 if there is no limit.
+func (up *Uploader) quotaRemaining(tx etx.TxId, name string) (int64, error) {
+
+	if up.Quota == nil {
+		return -1, nil
+	}
+
+	used, limit, err := up.Quota.Allowance(tx)
+	if err != nil {
+		return 0, err
+	}
+	if limit == 0 {
+		return -1, nil
+	}
+
+	// other uploads not yet bound to the parent (a replacement for this name doesn't count)
+	// SERIALISED
+	up.muUploads.Lock()
+	for nm, p := range up.progress[tx] {
+		if nm != name {
+			used += p.Received
+		}
+	}
+	up.muUploads.Unlock()
+
+	if used > limit {
+		return 0, nil
+	}
+	return limit - used, nil
+}
+
+// Read implements io.Reader, returning errTooLarge if there is more data than the limit.
+func (l *limitReader) Read(p []byte) (int, error) {
+
+	if l.n <= 0 {
+		// at the limit, check if there is any more
+		var b [1]byte
+		if k, err := l.r.Read(b[:]); k > 0 {
+			l.exceeded = true
+			return 0, errTooLarge
+		} else {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	k, err := l.r.Read(p)
+	l.n -= int64(k)
+	return k, err
+}
+
+// maxBytes returns the size limit for a media type, or 0 for no limit.
+func (up *Uploader) maxBytes(mediaType int) int64 {
+
+	switch mediaType {
+	case MediaImage:
+		return up.MaxImageBytes
+	case MediaVideo:
+		return up.MaxVideoBytes
+	case MediaAudio:
+		return up.MaxAudioBytes
+	case MediaDoc:
+		return up.MaxDocBytes
+	default:
+		return 0
+	}
+}
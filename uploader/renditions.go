@@ -0,0 +1,103 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Image renditions at different sizes, for responsive images.
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Rendition returns the file name for an image rendition of the specified width.
+// The rendition exists only if the width is one of Uploader.Renditions.
+func Rendition(fileName string, width int) string {
+	return "R" + strconv.Itoa(width) + fileName[1:]
+}
+
+// Srcset returns the value of an HTML srcset attribute for an image, listing its renditions and the full image.
+// Add it to the template functions for the application.
+func (up *Uploader) Srcset(fileName string, fullWidth int) string {
+
+	var b strings.Builder
+	for _, w := range up.Renditions {
+		if w < fullWidth {
+			b.WriteString(Rendition(fileName, w))
+			b.WriteString(" ")
+			b.WriteString(strconv.Itoa(w))
+			b.WriteString("w, ")
+		}
+	}
+	b.WriteString(fileName)
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(fullWidth))
+	b.WriteString("w")
+	return b.String()
+}
+
+// isImage returns true if a media file is an image.
+func isImage(fileName string) bool {
+
+	if _, err := imaging.FormatFromFilename(fileName); err == nil {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".webp", ".avif":
+		return true
+	default:
+		return false
+	}
+}
+
+// saveRenditions saves resized copies of an image narrower than the saved image, returning their names.
+// It returns the widths of renditions that would not be smaller than the saved image.
+func (up *Uploader) saveRenditions(img image.Image, fileName string, savedWidth int) (resized []string, linked []int, err error) {
+
+	for _, w := range up.Renditions {
+		if w < savedWidth {
+			rn := Rendition(fileName, w)
+			if err = imaging.Save(imaging.Resize(img, w, 0, imaging.Lanczos), filepath.Join(up.tempPath(), rn)); err != nil {
+				return
+			}
+			resized = append(resized, rn)
+
+		} else {
+			linked = append(linked, w)
+		}
+	}
+	return
+}
+
+// linkRenditions adds rendition names for the saved image, for widths where it needs no resizing.
+func (up *Uploader) linkRenditions(fileName string, widths []int) error {
+
+	for _, w := range widths {
+		if err := os.Link(filepath.Join(up.tempPath(), fileName), filepath.Join(up.tempPath(), Rendition(fileName, w))); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// variants returns the names of the files saved with a media file: its thumbnail and any renditions, captions, original or HLS files.
+func (up *Uploader) variants(fileName string) []string {
+
+	vs := []string{Thumbnail(fileName)}
+	if len(up.Renditions) > 0 && isImage(fileName) {
+		for _, w := range up.Renditions {
+			vs = append(vs, Rendition(fileName, w))
+		}
+	}
+	if up.Subtitles && isVideo(fileName) {
+		vs = append(vs, Captions(fileName))
+	}
+	if up.KeepOriginals && !up.isDoc(fileName) {
+		vs = append(vs, Original(fileName))
+	}
+	return append(vs, up.streamVariants(fileName)...)
+}
@@ -0,0 +1,96 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Retries of failed video conversions.
+
+import (
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+const opRetry = 2 // operation type
+
+// OpRetry is the logged operation to retry a failed conversion, so that a retry is not lost on a restart.
+type OpRetry struct {
+	Tx      etx.TxId // upload transaction
+	File    string   // file to be converted
+	Name    string   // upload name, for progress
+	Hash    string   // content hash, for deduplication
+	Stream  bool     // HLS rendition only
+	Audio   bool     // audio loudness normalisation
+	Attempt int      // retry number, from 1
+}
+
+// retryConversion schedules another attempt at a failed conversion, and returns false if no more attempts are allowed.
+func (up *Uploader) retryConversion(req reqConvert, err error) bool {
+
+	if req.attempt >= up.ConvertRetries {
+		return false
+	}
+	up.errorLog.Printf("Conversion of %s for %s failed, attempt %d: %s", req.name, etx.String(req.tx), req.attempt+1, err.Error())
+
+	// log the retry, as a new transaction or an update to the previous one
+	commit := up.db.Begin()
+	id := req.retry
+	if id == 0 {
+		id = up.tm.Begin()
+	}
+	op := &OpRetry{Tx: req.tx, File: req.file, Name: req.name, Hash: req.hash, Stream: req.stream, Audio: req.audio, Attempt: req.attempt + 1}
+	err = up.tm.SetNext(id, up, opRetry, op)
+	commit()
+	if err != nil {
+		up.errorLog.Print(err.Error())
+		return false
+	}
+
+	up.setProgress(req.tx, req.name, StateQueued, -1, 0)
+	up.tm.DoNext(id)
+	return true
+}
+
+// retry queues a conversion again, after a delay that doubles for each attempt.
+func (up *Uploader) retry(id etx.TxId, op *OpRetry) {
+
+	delay := up.RetryAfter << (op.Attempt - 1)
+	time.AfterFunc(delay, func() {
+
+		// leave the operation to be redone on restart, if the worker has stopped
+		up.muUploads.Lock()
+		stopping := up.stopping
+		up.muUploads.Unlock()
+		if stopping || up.chConvert == nil {
+			return
+		}
+
+		req := reqConvert{
+			file:    op.File,
+			name:    op.Name,
+			hash:    op.Hash,
+			tx:      op.Tx,
+			stream:  op.Stream,
+			audio:   op.Audio,
+			attempt: op.Attempt,
+			retry:   id,
+		}
+
+		// don't wait for a queue that will never be read
+		select {
+		case up.chConvert <- req:
+		case <-up.chVideosDone:
+		}
+	})
+}
+
+// endRetry ends the transaction for retries of a conversion, if there were any.
+func (up *Uploader) endRetry(id etx.TxId) {
+
+	if id == 0 {
+		return
+	}
+	defer up.db.Begin()()
+	if err := up.tm.End(id); err != nil {
+		up.errorLog.Print(err.Error())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Virus scanning of uploads.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// Scanner is the interface to a virus scanner.
+type Scanner interface {
+	// Scan returns a description of any threat found in the content, or an empty string if it is clean.
+	Scan(r io.Reader) (threat string, err error)
+}
+
+// ClamAV scans uploads using a ClamAV daemon, clamd.
+type ClamAV struct {
+	Network string        // "unix" or "tcp"
+	Address string        // socket path, or host:port
+	Timeout time.Duration // for each scan (default 1 minute)
+}
+
+const clamChunk = 64 * 1024 // size of chunks sent to clamd
+
+// Scan sends content to clamd using its INSTREAM command.
+func (c *ClamAV) Scan(r io.Reader) (string, error) {
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+
+	conn, err := net.DialTimeout(c.Network, c.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// command, then chunks each prefixed by their length, and a zero length to end
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, clamChunk)
+	var size [4]byte
+	for {
+		n, errR := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return "", err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if errR == io.EOF {
+			break
+		} else if errR != nil {
+			return "", errR
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return "", err
+	}
+
+	// reply is "stream: OK", "stream: <threat> FOUND" or "<reason> ERROR"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return "", nil
+
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scan checks an upload for viruses, and returns false if it is rejected.
+// A rejected upload is discarded, or kept in QuarantinePath, and reported to the application.
+func (up *Uploader) scan(req reqSave) (bool, error) {
+
+	if up.Scanner == nil {
+		return true, nil
+	}
+
+	threat, err := up.Scanner.Scan(bytes.NewReader(req.fullsize.Bytes()))
+	if err != nil {
+		return false, errors.New("uploader: virus scan failed: " + err.Error())
+	}
+	if threat == "" {
+		return true, nil
+	}
+
+	up.errorLog.Printf("Upload %s for %s rejected: %s", req.name, etx.String(req.tx), threat)
+	if up.QuarantinePath != "" {
+		fn := "Q-" + etx.String(req.tx) + "-" + req.name
+		if err := ioutil.WriteFile(filepath.Join(up.QuarantinePath, fn), req.fullsize.Bytes(), 0600); err != nil {
+			up.errorLog.Print(err.Error())
+		}
+	}
+
+	up.reject(req.tx, req.name, "Virus detected: "+threat)
+	return false, nil
+}
@@ -0,0 +1,90 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Locations for media files.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isUpload returns true if a file name is for an upload not yet bound to a parent, or a thumbnail for one.
+func isUpload(fileName string) bool {
+
+	sf := strings.SplitN(fileName, "-", 3)
+	return len(sf) == 3 && !strings.Contains(sf[1], "$")
+}
+
+// linkOrCopy adds a name for a file. It copies the file if it cannot be linked, such as when uploads are on a different volume.
+// The copy is made under a temporary name, so that a partial copy is never seen.
+func linkOrCopy(from, to string) error {
+
+	err := os.Link(from, to)
+	if err == nil || os.IsExist(err) || os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(to), ".copy-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if errC := dst.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), to) // same volume
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// paths are the current locations for media files.
+type paths struct {
+	file string // bound files
+	temp string // uploads
+}
+
+// filePath returns the current location for files bound to a parent.
+func (up *Uploader) filePath() string {
+
+	// SERIALISED
+	up.muPaths.RLock()
+	defer up.muPaths.RUnlock()
+
+	return up.paths.file
+}
+
+// tempPath returns the current location for uploads not yet bound to a parent.
+func (up *Uploader) tempPath() string {
+
+	// SERIALISED
+	up.muPaths.RLock()
+	defer up.muPaths.RUnlock()
+
+	return up.paths.temp
+}
+
+// mediaPath returns the path for a media file, which depends on whether it is an upload or bound to a parent.
+func (up *Uploader) mediaPath(fileName string) string {
+
+	if isUpload(fileName) {
+		return filepath.Join(up.tempPath(), fileName)
+	}
+	return filepath.Join(up.filePath(), fileName)
+}
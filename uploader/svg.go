@@ -0,0 +1,238 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// SVG images, sanitised to remove scripts and external references.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	errSVG = errors.New("Not a valid SVG image")
+
+	// elements allowed, other than filter primitives
+	svgElements = map[string]bool{
+		"circle": true, "clipPath": true, "defs": true, "desc": true, "ellipse": true,
+		"filter": true, "g": true, "image": true, "line": true, "linearGradient": true, "marker": true,
+		"mask": true, "path": true, "pattern": true, "polygon": true, "polyline": true, "radialGradient": true,
+		"rect": true, "stop": true, "style": true, "svg": true, "symbol": true, "text": true,
+		"textPath": true, "title": true, "tspan": true, "use": true,
+	}
+
+	// references allowed: fragments within the document, and embedded raster images
+	safeRef = regexp.MustCompile(`^(#|data:image/(png|jpeg|gif|webp);)`)
+
+	// CSS that might fetch or execute anything, matched after escapes are decoded
+	unsafeCSS = regexp.MustCompile(`(?i)@import|expression\s*\(|javascript:|image-set\s*\(|src\s*\(|url\s*\(\s*['"]?\s*[^#'"\s]`)
+
+	// escapes for text and attribute values, keeping line breaks
+	xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// decodeCSS replaces CSS escapes, such as `\75` for "u", by the characters they represent.
+func decodeCSS(s string) string {
+
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+
+		// up to 6 hex digits, and an optional white space, or else an escaped character
+		j := i + 1
+		for j < len(s) && j < i+7 && isHex(s[j]) {
+			j++
+		}
+		if j > i+1 {
+			r, _ := strconv.ParseUint(s[i+1:j], 16, 32)
+			b.WriteRune(rune(r))
+			if j < len(s) && strings.IndexByte(" \t\n\r\f", s[j]) >= 0 {
+				j++
+			}
+			i = j - 1
+		} else {
+			b.WriteByte(s[i+1])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// isHex returns true for a hexadecimal digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// isSVG returns true for an SVG file name.
+func isSVG(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".svg"
+}
+
+// sanitiseSVG returns an SVG image with scripts, event handlers and external references removed.
+// Only known SVG elements are kept, and elements in other namespaces, such as editor data, are removed.
+func sanitiseSVG(data []byte) ([]byte, error) {
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+
+	skip := 0 // depth within a removed element
+	depth := 0
+	root := false
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errSVG
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if t.Name.Space != "" || t.Name.Local != "svg" {
+					return nil, errSVG
+				}
+				root = true
+			}
+			if skip > 0 || !safeElement(t.Name) {
+				skip++
+				continue
+			}
+			writeStart(&out, t)
+
+		case xml.EndElement:
+			depth--
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + qualified(t.Name) + ">")
+
+		case xml.CharData:
+			if skip == 0 && depth > 0 {
+				if unsafeCSS.MatchString(decodeCSS(string(t))) {
+					return nil, errSVG // probably within a style element, and not worth rescuing
+				}
+				xmlEscaper.WriteString(&out, string(t))
+			}
+
+		default:
+			// comments, processing instructions and directives such as DOCTYPE are removed
+		}
+	}
+
+	if !root || depth != 0 {
+		return nil, errSVG
+	}
+	return out.Bytes(), nil
+}
+
+// saveSVG saves a sanitised SVG image and a rasterised thumbnail.
+func (up *Uploader) saveSVG(req reqSave) error {
+
+	// path for saved file
+	fn := up.FileFromName(req.tx, req.name)
+	path := filepath.Join(up.tempPath(), fn)
+
+	// save sanitised image, as checked on upload
+	if err := ioutil.WriteFile(path, req.fullsize.Bytes(), 0666); err != nil {
+		return err
+	}
+
+	return up.saveDocThumbnail(fn, "web/static/doc.png")
+}
+
+// qualified returns the name of an element or attribute, as written.
+func qualified(name xml.Name) string {
+
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// readSVG reads and sanitises an uploaded SVG image into a buffer.
+func readSVG(r io.Reader, buffered *bytes.Buffer) (err error, byClient bool) {
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err, false
+	}
+
+	if data, err = sanitiseSVG(data); err != nil {
+		return err, true // this is a bad image from client
+	}
+	buffered.Write(data)
+	return nil, true
+}
+
+// safeAttr returns true if an attribute can be kept.
+func safeAttr(a xml.Attr) bool {
+
+	switch a.Name.Space {
+	case "":
+		if strings.HasPrefix(strings.ToLower(a.Name.Local), "on") {
+			return false // event handler
+		}
+		if a.Name.Local == "href" {
+			return safeRef.MatchString(strings.TrimSpace(a.Value))
+		}
+
+		// style, and presentation attributes such as fill, filter, mask, clip-path and marker-start, may hold CSS
+		return !unsafeCSS.MatchString(decodeCSS(a.Value))
+
+	case "xlink":
+		return a.Name.Local == "href" && safeRef.MatchString(strings.TrimSpace(a.Value))
+
+	case "xml":
+		return a.Name.Local == "space" || a.Name.Local == "lang"
+
+	case "xmlns":
+		return a.Name.Local == "xlink"
+
+	default:
+		return false // editor data, and anything else we don't understand
+	}
+}
+
+// safeElement returns true if an element can be kept.
+func safeElement(name xml.Name) bool {
+
+	if name.Space != "" {
+		return false
+	}
+	return svgElements[name.Local] || strings.HasPrefix(name.Local, "fe")
+}
+
+// writeStart writes a start element with its safe attributes.
+func writeStart(out *bytes.Buffer, t xml.StartElement) {
+
+	out.WriteString("<" + qualified(t.Name))
+	for _, a := range t.Attr {
+		if safeAttr(a) {
+			out.WriteString(" " + qualified(a.Name) + `="`)
+			xmlEscaper.WriteString(out, a.Value)
+			out.WriteString(`"`)
+		}
+	}
+	out.WriteString(">")
+}
@@ -0,0 +1,77 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSanitiseSVG checks that external references are removed from attributes, and rejected in CSS.
+func TestSanitiseSVG(t *testing.T) {
+
+	const open = `<svg xmlns="http://www.w3.org/2000/svg">`
+
+	// attributes that must be removed
+	removed := []struct {
+		name string
+		elem string
+	}{
+		{"fill", `<rect fill="url(https://evil/x)"/>`},
+		{"filter", `<rect filter="url(https://evil/f)"/>`},
+		{"mask", `<rect mask="url('https://evil/m')"/>`},
+		{"clip-path", `<rect clip-path=" url( &quot;//evil/c&quot; )"/>`},
+		{"marker-start", `<path marker-start="url(https://evil/m)"/>`},
+		{"marker-end", `<path marker-end="URL(https://evil/m)"/>`},
+		{"style escaped url", `<rect style="fill: \75rl(https://evil/x)"/>`},
+		{"style escaped url with space", `<rect style="fill: \000075 rl(https://evil/x)"/>`},
+		{"fill escaped character", `<rect fill="u\rl(https://evil/x)"/>`},
+		{"style import", `<rect style="@\69mport 'https://evil/x.css'"/>`},
+		{"href", `<use href="https://evil/x.svg#a"/>`},
+		{"event handler", `<rect onclick="alert(1)"/>`},
+	}
+	for _, tc := range removed {
+		out, err := sanitiseSVG([]byte(open + tc.elem + `</svg>`))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if strings.Contains(string(out), "evil") || strings.Contains(string(out), "alert") {
+			t.Errorf("%s: not removed, got %s", tc.name, out)
+		}
+	}
+
+	// style sheets that must be rejected
+	rejected := []struct {
+		name  string
+		style string
+	}{
+		{"import", `@import url(https://evil/x.css);`},
+		{"escaped import", `@\69mport 'https://evil/x.css';`},
+		{"escaped url", `rect { fill: \75rl(https://evil/x) }`},
+		{"image-set", `rect { fill: image-set("https://evil/x.png" 1x) }`},
+	}
+	for _, tc := range rejected {
+		if _, err := sanitiseSVG([]byte(open + `<style>` + tc.style + `</style></svg>`)); err != errSVG {
+			t.Errorf("%s: not rejected", tc.name)
+		}
+	}
+
+	// local references that must be kept
+	kept := []string{
+		`<rect fill="url(#grad)"/>`,
+		`<rect clip-path="url( '#clip' )"/>`,
+		`<rect style="fill: red; mask: url(#m)"/>`,
+		`<use href="#shape"/>`,
+	}
+	for _, elem := range kept {
+		out, err := sanitiseSVG([]byte(open + elem + `</svg>`))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", elem, err)
+			continue
+		}
+		if !strings.Contains(string(out), "#") {
+			t.Errorf("%s: reference removed, got %s", elem, out)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Limits on the resources used by FFmpeg, so that video processing doesn't starve the web server.
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// throttleArgs adds the configured limits to the arguments for an FFmpeg command.
+func (up *Uploader) throttleArgs(arg []string) []string {
+
+	if up.VideoThreads == 0 && up.VideoReadRate == 0 {
+		return arg
+	}
+
+	var limited []string
+	if up.VideoThreads > 0 {
+		limited = append(limited, "-filter_threads", strconv.Itoa(up.VideoThreads))
+	}
+
+	for i, a := range arg {
+		if i == len(arg)-1 && up.VideoThreads > 0 {
+			// encoder threads, an output option before the output file
+			limited = append(limited, "-threads", strconv.Itoa(up.VideoThreads))
+		}
+		if a == "-i" && up.VideoReadRate > 0 {
+			// input option
+			limited = append(limited, "-readrate", strconv.FormatFloat(up.VideoReadRate, 'f', -1, 64))
+		}
+		limited = append(limited, a)
+	}
+	return limited
+}
+
+// niceCommand returns a command for a local executable, run at reduced CPU and I/O priority if configured.
+func (up *Uploader) niceCommand(name string, arg ...string) *exec.Cmd {
+
+	if up.VideoIOIdle {
+		arg = append([]string{"-c", "3", name}, arg...)
+		name = "ionice"
+	}
+	if up.VideoNice > 0 {
+		arg = append([]string{"-n", strconv.Itoa(up.VideoNice), name}, arg...)
+		name = "nice"
+	}
+	return exec.Command(name, arg...)
+}
+
+// startFFmpeg waits until another FFmpeg command may run, within the limit across all workers.
+// It returns a function to be called when the command has finished.
+func (up *Uploader) startFFmpeg() func() {
+
+	if up.chFFmpeg == nil {
+		return func() {}
+	}
+	up.chFFmpeg <- struct{}{}
+	return func() { <-up.chFFmpeg }
+}
@@ -0,0 +1,111 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Signed tokens for uploads, so that a transaction code cannot be used from another session.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+var (
+	errToken        = errors.New("Upload not authorised")
+	errTokenExpired = errors.New("Upload form has expired, please reload the page")
+	errTooMany      = errors.New("Too many files uploaded for this form")
+)
+
+// txLimit is the limit on uploads for a transaction, set by an upload token.
+type txLimit struct {
+	max      int // maximum uploads
+	accepted int // uploads accepted, including replacements
+}
+
+// UploadToken returns a signed token for uploads to a transaction, for the parent's form instead of the plain transaction code.
+// It is bound to a session identifier chosen by the parent application, such as a session token,
+// and allows at most maxUploads uploads (0 for no limit) until it expires. It requires TokenKey.
+func (up *Uploader) UploadToken(tx etx.TxId, session string, maxUploads int, expires time.Time) string {
+
+	payload := etx.String(tx) + "." + strconv.Itoa(maxUploads) + "." + strconv.FormatInt(expires.Unix(), 36)
+	return payload + "." + up.tokenMAC(payload, session)
+}
+
+// VerifyToken checks a token from UploadToken in an AJAX upload request, for the same session.
+// It returns the transaction ID, or an error to be reported to the client if the token is invalid or expired,
+// or if the number of files uploaded has reached the limit. The limit is applied again when each file is saved,
+// so that concurrent requests cannot exceed it.
+func (up *Uploader) VerifyToken(token string, session string) (etx.TxId, error) {
+
+	sf := strings.Split(token, ".")
+	if len(sf) != 4 || up.TokenKey == nil {
+		return 0, errToken
+	}
+	payload := strings.Join(sf[:3], ".")
+	if !hmac.Equal([]byte(sf[3]), []byte(up.tokenMAC(payload, session))) {
+		return 0, errToken
+	}
+
+	tx, err := etx.Id(sf[0])
+	if err != nil {
+		return 0, errToken
+	}
+	max, err := strconv.Atoi(sf[1])
+	if err != nil {
+		return 0, errToken
+	}
+	expires, err := strconv.ParseInt(sf[2], 36, 64)
+	if err != nil {
+		return 0, errToken
+	}
+	if time.Now().Unix() > expires || !up.ValidCode(tx) {
+		return 0, errTokenExpired
+	}
+
+	// uploads so far, including any replaced
+	if max > 0 {
+		// SERIALISED
+		up.muUploads.Lock()
+		l := up.limits[tx]
+		l.max = max
+		up.limits[tx] = l
+		up.muUploads.Unlock()
+
+		if l.accepted >= max {
+			return 0, errTooMany
+		}
+	}
+	return tx, nil
+}
+
+// accept counts an upload against any limit for the transaction, and returns false if the limit has been reached.
+// It must be called with muUploads locked.
+func (up *Uploader) accept(tx etx.TxId) bool {
+
+	l, ok := up.limits[tx]
+	if !ok {
+		return true
+	}
+	if l.accepted >= l.max {
+		return false
+	}
+	l.accepted++
+	up.limits[tx] = l
+	return true
+}
+
+// tokenMAC returns the signature for an upload token.
+func (up *Uploader) tokenMAC(payload string, session string) string {
+
+	mac := hmac.New(sha256.New, up.TokenKey)
+	mac.Write([]byte(payload))
+	mac.Write([]byte{0})
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
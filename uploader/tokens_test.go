@@ -0,0 +1,85 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// testDB is a stub for the parent's database.
+type testDB struct{}
+
+func (testDB) Begin() func() { return func() {} }
+
+// TestTokenLimit checks that concurrent uploads, including replacements, cannot exceed a token's limit.
+func TestTokenLimit(t *testing.T) {
+
+	store, _ := etx.NewMemStore("") // no error without a snapshot
+	up := &Uploader{
+		FilePath: t.TempDir(),
+		MaxW:     400,
+		MaxH:     300,
+		ThumbW:   80,
+		ThumbH:   60,
+		MaxAge:   time.Hour,
+		TokenKey: []byte("test key"),
+	}
+	up.Initialise(log.New(ioutil.Discard, "", 0), testDB{}, etx.New(nil, store))
+	defer up.Stop()
+
+	code, err := up.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := etx.Id(code)
+	token := up.UploadToken(tx, "session", 3, time.Now().Add(time.Hour))
+
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 40, 30)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same name, uploaded repeatedly and concurrently
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tx, err := up.VerifyToken(token, "session")
+			if err != nil {
+				return
+			}
+			if err, _ := up.SaveReader(bytes.NewReader(img.Bytes()), "photo.jpg", tx); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			} else if err != errTooMany {
+				t.Error("upload " + strconv.Itoa(i) + ": " + err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if accepted != 3 {
+		t.Errorf("%d uploads accepted", accepted)
+	}
+	if _, err := up.VerifyToken(token, "session"); err != errTooMany {
+		t.Errorf("token still accepted, error %v", err)
+	}
+	if _, err := up.VerifyToken(token, "other session"); err != errToken {
+		t.Errorf("token accepted for another session, error %v", err)
+	}
+}
@@ -6,8 +6,11 @@
 // that modifies the parent. The parent need not exist at the time of upload,
 // and a log is used to maintain consistency between the database and the media files.
 //
-// Images are resized to fit within limits specified by the server.
-// Videos are converted to MP4 format. Thumbnails are generated for both images and videos.
+// Images are resized to fit within limits specified by the server, and optionally converted to WebP or AVIF.
+// SVG images, if accepted, are sanitised to remove scripts and external references.
+// Videos are converted to MP4 format, with optional HLS renditions for streaming. Documents such as PDFs are stored unchanged.
+// Thumbnails are generated for images, videos and documents.
+// A watermark, such as a club logo, may be overlaid on processed images and converted videos.
 //
 // Note that files are given revision numbers for these reasons:
 // (1) A different name forces browsers to fetch the updated file after its content has been changed.
@@ -25,18 +28,25 @@
 // Use the uploader as follows:
 //
 // (1) A web request is received to create or update a parent object: call Begin and add the transaction code as a hidden field in the form.
-// Use NameFromFile to extract the media names shown to users from the media file names.
+// Use NameFromFile to extract the media names shown to users from the media file names
+// (or Uploader.NameFromFile if NameKey is set).
 //
 // (2) A media file is uploaded via an AJAX request: call Save with the transaction code.
+// For media from other sources, such as email attachments or API clients, call SaveReader instead.
+// For large files sent in chunks, call SaveChunk for each chunk and then EndChunks, with a version chosen by the client for the file.
 // Images are resized and thumbnails generated asynchronously to the request.
+// Call Progress to report the state of an upload to the user.
+// Set OnMetadata to receive capture dates and camera details, for example to sort media in the parent.
 //
 // (3) A parent object is created, updated or deleted: call SetParent to associate the transaction code with the object.
 // Use CleanName to sanitise user names for media, and use MediaType to check that uploaded file types are acceptable.
-// If the media name is new or changed, call FileFromName to get the file name to be stored in the database.
+// If the media name is new or changed, call FileFromName to get the file name to be stored in the database
+// (or Uploader.FileFromName if NameKey is set).
 // (Changed versions for existing names are handled in step 5.)
 // Call tx.SetNext ensure the next step will be executed, commit the change to the database.
 //
 // (4) Call DoNext. The uploader waits for any uploads to be processed, and then calls the operation specified by etx.SetNext.
+// Any further uploads for the transaction are rejected with ErrLate.
 //
 // (5) Handle the parent bind request from DoNext.
 //
@@ -51,6 +61,7 @@
 // When deleting an object, call StartBind (with no request code), delete the object and then call EndBind.
 //
 // Use Thumbnail to get the file name for a thumbnail image corresponding to a media file.
+// Use FileSystem to serve media files, and Migrate to move them to a new location without stopping the server.
 package uploader
 
 import (
@@ -80,8 +91,11 @@ const (
 	MediaImage = 1
 	MediaVideo = 2
 	MediaAudio = 3
+	MediaDoc   = 4
 )
 
+var errStopped = errors.New("Server is shutting down")
+
 // op holds the state of uploading media for a single transaction
 type op struct {
 	next    bool // true if the parent's next operation has been specified
@@ -92,7 +106,8 @@ type op struct {
 type Uploader struct {
 
 	// parameters
-	FilePath     string
+	FilePath     string // initial location, changed by Migrate
+	TempPath     string // optional separate directory for uploads before they are bound to a parent, such as a fast local volume
 	MaxW         int
 	MaxH         int
 	ThumbW       int
@@ -100,9 +115,98 @@ type Uploader struct {
 	MaxAge       time.Duration // maximum time for a parent update
 	SnapshotAt   time.Duration // snapshot time in video (-ve for none)
 	AudioTypes   []string
-	VideoPackage string        // software for video processing: ffmpeg, or a docker-hosted implementation of ffmpeg, for debugging
+	VideoPackage string        // software for video processing: ffmpeg, a path to an ffmpeg executable, or a docker-hosted implementation of ffmpeg, for debugging
 	VideoTypes   []string
 
+	// optional hardware encoding of videos
+	VideoEncoder string // FFmpeg encoder, such as "h264_vaapi", "h264_videotoolbox" or "h264_nvenc" (empty for software encoding)
+	VideoDevice  string // device for VAAPI (default "/dev/dri/renderD128")
+
+	// optional FFmpeg options for conversions, by media type (MediaVideo, or MediaImage for ImageType)
+	Profiles map[int]*Profile
+
+	// optional key for signed upload tokens (see UploadToken)
+	TokenKey []byte
+
+	// optional opaque file names, as a keyed hash of users' names for media, with the names held by the parent application
+	NameKey []byte
+	Names   NameStore
+
+	// optional retention of uploads as received, with the prefix "O", counted in DiskUsage (see Original)
+	KeepOriginals bool
+
+	// optional extraction of a subtitle track from videos, as WebVTT captions (see Captions)
+	Subtitles bool
+
+	// optional EBU R128 loudness normalisation of audio files and converted videos, as a target in LUFS, such as -16 (0 for none)
+	Loudness float64
+
+	// optional image processing
+	ImageType     string // output format for images: ".webp" or ".avif", converted by VideoPackage, or empty for JPEG and PNG
+	ImageQuality  int    // quality for converted images, 1 to 100 (0 for default)
+	StripMetadata bool   // remove EXIF and other metadata, such as GPS location, from images saved unchanged
+	Renditions    []int  // widths of smaller copies of images, for responsive pages
+	SVG           bool   // accept SVG images, sanitised, with thumbnails rendered by DocPackage
+
+	// optional document uploads
+	DocTypes   []string // accepted document types, such as ".pdf"
+	DocPackage string   // software for document and SVG thumbnails: "magick" for ImageMagick, or a path to an executable with the same arguments, or empty for an icon
+
+	// optional HLS renditions of videos, for streamed playback: HLSNone, HLSAlso or HLSOnly (requires VideoPackage)
+	HLS int
+
+	// optional watermark for processed images and converted videos
+	Watermark *Watermark
+
+	// optional worker pools, with bounded queues (0 for one worker of each kind, and 20 queued requests)
+	ImageWorkers int // concurrent processing of images and other media
+	VideoWorkers int // concurrent video conversions, typically limited to one because FFmpeg uses all cores
+	QueueSize    int // requests waiting for each kind of worker, before further uploads are delayed
+
+	// optional limits on FFmpeg, for a small host shared with the web server
+	VideoNice     int     // CPU priority adjustment for local FFmpeg commands, 1 (least) to 19 (0 for none)
+	VideoIOIdle   bool    // run local FFmpeg commands at idle I/O priority, using ionice on Linux
+	VideoThreads  int     // threads for each FFmpeg command (0 for FFmpeg's default)
+	VideoReadRate float64 // input read rate for FFmpeg, as a multiple of real time (0 for no limit, requires FFmpeg 5)
+	MaxFFmpeg     int     // FFmpeg commands to run at once, across all workers (0 for no limit)
+
+	// optional retries of failed video conversions, logged so that they continue after a restart
+	ConvertRetries int           // maximum retries (0 for none)
+	RetryAfter     time.Duration // delay before the first retry, doubled for each further retry (default 1 minute)
+
+	// optional policy for uploads with the same name in a transaction: CollisionReplace, CollisionReject or CollisionSuffix
+	Collisions int
+
+	// optional limit on storage for each user
+	Quota Quota
+
+	// optional limits on upload sizes, in bytes
+	MaxImageBytes int64
+	MaxVideoBytes int64
+	MaxAudioBytes int64
+	MaxDocBytes   int64
+
+	// optional limits on videos, checked before conversion (0 for no limit, and ignored without VideoPackage)
+	MaxVideoDuration time.Duration
+	MaxVideoPixels   int // width x height
+
+	// optional period to recognise uploads of identical content, which are stored once and not reprocessed (0 for none)
+	Dedup time.Duration
+
+	// optional callback with capture date and camera details for uploaded media, called before processing is complete
+	OnMetadata func(tx etx.TxId, name string, md *Metadata)
+
+	// optional virus scanning, with rejected uploads reported to the application, and kept for inspection if QuarantinePath is set
+	Scanner        Scanner
+	QuarantinePath string
+	OnRejected     func(tx etx.TxId, name string, reason string)
+
+	// optional log of media lifecycle events, such as to show users a history of changes to a parent's media
+	MediaEvents func(e *MediaEvent)
+	subscribers []func(e *MediaEvent) // such as webhooks
+
+	// optional callback when files have been migrated to a new location, so that the application can use it on restart
+	OnMigrated func(to string)
 
 	// components
 	errorLog *log.Logger
@@ -110,18 +214,50 @@ type Uploader struct {
 	tick     *time.Ticker
 	tm       *etx.TM
 
-	// background worker
+	// background workers, stopped by closing chDone
 	chDone    chan bool
-	chSave    chan reqSave
+	chSave    chan reqSave // images and documents, processed ahead of audio and video
+	chSaveAV  chan reqSave
 	chOrphans chan OpOrphans
+	wgWorkers sync.WaitGroup
 
-	// separate worker for video processing
+	// separate workers for video processing, stopped by closing chVideosDone
 	chVideosDone chan bool
 	chConvert    chan reqConvert
+	chFFmpeg     chan struct{} // limit on FFmpeg commands running
+	wgVideos     sync.WaitGroup
+
+	// shutdown, with stopping protected by muUploads
+	stopping bool
+	sending  sync.WaitGroup // uploads being queued for workers
 
 	// uploads in progress for each transaction
 	muUploads sync.Mutex
 	ops     map[etx.TxId]op
+	progress  map[etx.TxId]map[string]Progress // by upload name
+
+	// limits on uploads from upload tokens, also protected by muUploads
+	limits map[etx.TxId]txLimit
+
+	// transactions for which DoNext has been called, also protected by muUploads
+	committed map[etx.TxId]bool
+
+	// media migration in progress, also protected by muUploads
+	migration *migration
+
+	// chunked uploads being written, by transaction and name
+	muChunks sync.Mutex
+	chunking map[string]*chunkLock
+
+	// current locations of media files, changed by a migration
+	muPaths sync.RWMutex
+	paths   paths
+
+	// watermark image, with opacity applied
+	watermark image.Image
+
+	// statistics for metrics
+	stats stats
 }
 
 // Context for a sequence of bind calls.
@@ -133,6 +269,10 @@ type Bind struct {
 	delVersions []fileVersion
 }
 
+// opOrphans is the operation type to remove files for an abandoned transaction.
+// It is distinct from 0, used by earlier versions, so that timeouts can select it.
+const opOrphans = 3
+
 type OpOrphans struct {
 	tx etx.TxId
 }
@@ -143,6 +283,16 @@ type reqSave struct {
 	mediaType int          // image or video
 	fullsize  bytes.Buffer // original image or video
 	img       image.Image  // nil for video
+	hash      string       // content hash, for deduplication
+
+	// client's choice of snapshot time for a video thumbnail, or zero for the default
+	snapshotAt time.Duration
+}
+
+// hints holds optional details for an upload, supplied by the client.
+type hints struct {
+	original   image.Point   // declared size of an image downscaled by the client, or zero
+	snapshotAt time.Duration // snapshot time for a video thumbnail, or zero
 }
 
 // DB is an interface to the database manager that handles parent transactions.
@@ -168,17 +318,57 @@ func (up *Uploader) Name() string {
 }
 
 func (up *Uploader) ForOperation(opType int) etx.Op {
-	return &OpOrphans{}
+
+	switch opType {
+	case opMigrate:
+		return &OpMigrate{}
+	case opRetry:
+		return &OpRetry{}
+	default:
+		return &OpOrphans{}
+	}
 }
 
 func (up *Uploader) Operation(id etx.TxId, opType int, op etx.Op) {
 
-	// this is the only operation we log
-	opO := op.(*OpOrphans)
-	opO.tx = id
+	switch opType {
+	case opMigrate:
+		// copy files to new location
+		go up.migrate(id, op.(*OpMigrate))
+
+	case opRetry:
+		// convert again, after a delay
+		up.retry(id, op.(*OpRetry))
+
+	default:
+		opO := op.(*OpOrphans)
+		opO.tx = id
+
+		// leave the operation to be redone on restart, if the worker has stopped
+		up.muUploads.Lock()
+		stopping := up.stopping
+		up.muUploads.Unlock()
+		if stopping {
+			return
+		}
+
+		// defer further operations, such as on recovery, if the worker is busy
+		if len(up.chOrphans) >= cap(up.chOrphans)-1 {
+			up.tm.Overloaded(up, time.Second)
+		}
+
+		// remove files for abandoned transaction
+		up.chOrphans <- *opO
+	}
+}
 
-	// remove files for abandoned transaction
-	up.chOrphans <- *opO
+// Cancelled implements etx.Canceller, to remove the files for a cancelled transaction.
+// A cancelled migration or conversion retry needs no clean up, because it leaves existing files usable.
+func (up *Uploader) Cancelled(id etx.TxId, opType int, op etx.Op) {
+
+	if opType != opMigrate && opType != opRetry {
+		up.Operation(id, opType, op)
+	}
 }
 
 // Initialise starts the file uploader.
@@ -186,33 +376,86 @@ func (up *Uploader) Initialise(log *log.Logger, db DB, tm *etx.TM) {
 
 	up.errorLog = log
 	up.db = db
+	if up.TempPath == "" {
+		up.TempPath = up.FilePath
+	}
+	up.paths = paths{file: up.FilePath, temp: up.TempPath}
 	up.tm = tm
-	up.chDone = make(chan bool, 1)
-	up.chSave = make(chan reqSave, 20)
+	if up.ImageWorkers < 1 {
+		up.ImageWorkers = 1
+	}
+	if up.VideoWorkers < 1 {
+		up.VideoWorkers = 1
+	}
+	if up.QueueSize < 1 {
+		up.QueueSize = 20
+	}
+	if up.RetryAfter == 0 {
+		up.RetryAfter = time.Minute
+	}
+	up.chDone = make(chan bool)
+	up.chSave = make(chan reqSave, up.QueueSize)
+	up.chSaveAV = make(chan reqSave, up.QueueSize)
 	up.chOrphans = make(chan OpOrphans, 4)
 	up.ops = make(map[etx.TxId]op, 8)
+	up.committed = make(map[etx.TxId]bool, 8)
+	up.progress = make(map[etx.TxId]map[string]Progress, 8)
+	up.limits = make(map[etx.TxId]txLimit)
+	up.initMetrics()
 
-	up.chVideosDone = make(chan bool, 1)
-
-	// start background worker
+	// start background worker, and any additional workers for media
 	up.tick = time.NewTicker(up.MaxAge / 8)
-	go up.worker(up.chSave, up.chOrphans, up.tick.C, up.chDone)
+	up.wgWorkers.Add(up.ImageWorkers)
+	go up.worker(up.chSave, up.chSaveAV, up.chOrphans, up.tick.C, up.chDone)
+	for i := 1; i < up.ImageWorkers; i++ {
+		go up.mediaWorker(up.chSave, up.chSaveAV, up.chDone)
+	}
 
-	// separate worker for video processing
+	// separate workers for video processing
 	if up.VideoPackage != "" {
-		up.chConvert = make(chan reqConvert, 20)
-		go up.videoWorker(up.chConvert, up.chDone)
+		up.chVideosDone = make(chan bool)
+		up.chConvert = make(chan reqConvert, up.QueueSize)
+		if up.MaxFFmpeg > 0 {
+			up.chFFmpeg = make(chan struct{}, up.MaxFFmpeg)
+		}
+		up.wgVideos.Add(up.VideoWorkers)
+		for i := 0; i < up.VideoWorkers; i++ {
+			go up.videoWorker(up.chConvert, up.chVideosDone)
+		}
 	} else {
 		up.SnapshotAt = -1 // no snapshots
+		up.ImageType = ""  // no image conversions
+		up.HLS = HLSNone
+	}
+
+	if up.Watermark != nil {
+		if err := up.loadWatermark(); err != nil {
+			up.errorLog.Print("Watermark not loaded: ", err.Error())
+			up.watermark = nil
+		}
 	}
 }
 
 // Stop shuts down the uploader.
+// New uploads are refused, and it returns when the uploads already received have been processed.
+// Requests to remove orphans are not completed, because they will be redone by etx on restart.
 func (up *Uploader) Stop() {
+
+	// SERIALISED
+	up.muUploads.Lock()
+	up.stopping = true
+	up.muUploads.Unlock()
+
+	// wait for uploads to be queued, and then for media workers to finish
+	up.sending.Wait()
 	up.tick.Stop()
-	up.chDone <- true
-	if up.VideoPackage != "" {
-		up.chVideosDone <- true
+	close(up.chDone)
+	up.wgWorkers.Wait()
+
+	// media workers may have added video conversions
+	if up.chVideosDone != nil {
+		close(up.chVideosDone)
+		up.wgVideos.Wait()
 	}
 }
 
@@ -225,15 +468,16 @@ func (up *Uploader) Begin() (string, error) {
 	id := up.tm.Begin()
 
 	// add operation to remove orphan files, if the update is abandoned
-	if err := up.tm.SetNext(id, up, 0, &OpOrphans{}); err != nil {
+	if err := up.tm.SetNext(id, up, opOrphans, &OpOrphans{}); err != nil {
 		return "", err
 	}
 
 	return etx.String(id), nil
 }
 
-// NameFromFile returns the owner ID, media file name and revision from a file name.
+// NameFromFile returns the owner ID, stored media name and revision from a file name.
 // If the revision is 0, the owner is the request, otherwise the owner is a parent object.
+// Use Uploader.NameFromFile instead for opaque names.
 func NameFromFile(fileName string) (string, string, int) {
 	if len(fileName) > 0 {
 		// sf[0] is "P"
@@ -263,37 +507,144 @@ func (up *Uploader) Save(fh *multipart.FileHeader, tx etx.TxId) (err error, byCl
 	}
 	defer file.Close()
 
+	return up.save(file, fh.Filename, tx, hints{})
+}
+
+// SaveDownscaled is like Save, for an image that has been downscaled by the browser before upload (see upload-04.js).
+// The width and height are the dimensions of the original image, as declared by the client.
+// The image is saved without further resizing if it fits within the limits for the uploader.
+func (up *Uploader) SaveDownscaled(fh *multipart.FileHeader, tx etx.TxId, width int, height int) (err error, byClient bool) {
+
+	file, err := fh.Open()
+	if err != nil {
+		return err, false
+	}
+	defer file.Close()
+
+	return up.save(file, fh.Filename, tx, hints{original: image.Pt(width, height)})
+}
+
+// SaveWithSnapshot is like Save, for a video with a thumbnail taken at a time chosen by the client,
+// such as a poster frame selected by the user (sent as "snapshot" by upload-04.js). Zero or a time beyond the end of the video uses SnapshotAt.
+func (up *Uploader) SaveWithSnapshot(fh *multipart.FileHeader, tx etx.TxId, at time.Duration) (err error, byClient bool) {
+
+	file, err := fh.Open()
+	if err != nil {
+		return err, false
+	}
+	defer file.Close()
+
+	return up.save(file, fh.Filename, tx, hints{snapshotAt: at})
+}
+
+// SaveReader decodes a media file from a reader, and schedules it to be saved in the filesystem.
+// It allows media to be ingested from sources other than an HTTP form, such as email attachments or API clients.
+// The name is the user's name for the file, and it is cleaned before use.
+func (up *Uploader) SaveReader(r io.Reader, name string, tx etx.TxId) (err error, byClient bool) {
+	return up.save(r, name, tx, hints{})
+}
+
+// SaveFrom is like SaveReader, and also returns the name for the upload, as SaveAs does.
+// It lets API clients, server-side imports and tests use the same processing as form uploads,
+// and refer to the media by the name it was given after applying the collision policy.
+func (up *Uploader) SaveFrom(r io.Reader, name string, tx etx.TxId) (saved string, err error, byClient bool) {
+	return up.saveAs(r, name, tx, hints{})
+}
+
+// save decodes a media file, and schedules it to be saved in the filesystem.
+// hints are optional details supplied by the client.
+func (up *Uploader) save(r io.Reader, name string, tx etx.TxId, client hints) (err error, byClient bool) {
+	_, err, byClient = up.saveAs(r, name, tx, client)
+	return
+}
+
+// saveAs is save, also returning the name for the upload, after applying the collision policy.
+func (up *Uploader) saveAs(r io.Reader, name string, tx etx.TxId, client hints) (saved string, err error, byClient bool) {
+
 	// unmodified copy of file
 	var buffered bytes.Buffer
 
 	// image or video?
 	var img image.Image
-	name := CleanName(fh.Filename)
+	name = CleanName(name)
 	ft := up.MediaType(name)
 
+	// size limit for the media type
+	lr := &limitReader{r: r, n: up.maxBytes(ft)}
+	if lr.n > 0 {
+		r = lr
+	}
+
 	switch ft {
 
 	case MediaImage:
-		// duplicate file in buffer, since we can only read it from the header once
-		tee := io.TeeReader(file, &buffered)
+		if isSVG(name) {
+			if err, byClient := readSVG(r, &buffered); err != nil {
+				if lr.exceeded {
+					return "", errTooLarge, true
+				}
+				return "", err, byClient
+			}
+			break
+		}
+
+		// duplicate file in buffer, since we can only read it once
+		tee := io.TeeReader(r, &buffered)
 
 		// decode image
 		img, err = imaging.Decode(tee, imaging.AutoOrientation(true))
-		if err != nil {
-			return err, true // this is a bad image from client
+		if lr.exceeded {
+			return "", errTooLarge, true
+		} else if err != nil {
+			return "", err, true // this is a bad image from client
+		}
+
+		// check image downscaled by client
+		if client.original != (image.Point{}) && !isDownscaled(img.Bounds().Size(), client.original) {
+			return "", errors.New("Image size does not match original"), true
+		}
+
+	case MediaAudio, MediaVideo, MediaDoc:
+		if _, err := io.Copy(&buffered, r); lr.exceeded {
+			return "", errTooLarge, true
+		} else if err != nil {
+			return "", err, false // don't know why this might fail
 		}
 
-	case MediaAudio, MediaVideo:
-		if _, err := io.Copy(&buffered, file); err != nil {
-			return err, false // don't know why this might fail
+		// check that the content is the type claimed
+		if !validContent(name, buffered.Bytes()) {
+			return "", errors.New("File content does not match its type"), true
 		}
 
 	default:
-		return errors.New("File format not supported"), true
+		return "", errors.New("File format not supported"), true
+	}
+
+	// storage allowance
+	if err, byClient := up.checkQuota(tx, name, int64(buffered.Len())); err != nil {
+		return "", err, byClient
 	}
 
 	//SERIALISED
 	up.muUploads.Lock()
+	if up.stopping {
+		up.muUploads.Unlock()
+		return "", errStopped, false
+	}
+	if up.isLate(tx) {
+		up.muUploads.Unlock()
+		return "", ErrLate, true
+	}
+	if name, err = up.collision(tx, name, ft); err != nil {
+		up.muUploads.Unlock()
+		return "", err, true
+	}
+	if !up.accept(tx) {
+		up.muUploads.Unlock()
+		return "", errTooMany, true
+	}
+	up.sending.Add(1)
+	defer up.sending.Done()
 
 	// count uploads in progress
 	op := up.ops[tx]
@@ -301,16 +652,29 @@ func (up *Uploader) Save(fh *multipart.FileHeader, tx etx.TxId) (err error, byCl
 	up.ops[tx] = op
 	up.muUploads.Unlock()
 
+	up.setDisplayName(name, ft)
+	up.setProgress(tx, name, StateQueued, int64(buffered.Len()), 0)
+	up.event(&MediaEvent{Event: EventUploaded, Tx: tx, Name: name})
+	up.countReceived(ft)
+
 	// resizing or converting is slow, so do the remaining processing in background worker
-	up.chSave <- reqSave{
+	req := reqSave{
 		name:      name,
 		tx:        tx,
 		mediaType: ft,
 		fullsize:  buffered,
 		img:       img,
+		hash:      up.contentHash(buffered.Bytes()),
+
+		snapshotAt: client.snapshotAt,
+	}
+	if ft == MediaAudio || ft == MediaVideo {
+		up.chSaveAV <- req
+	} else {
+		up.chSave <- req
 	}
 
-	return nil, true
+	return name, nil, true
 }
 
 // STEP 3 : when web form to create or update parent object received.
@@ -341,12 +705,12 @@ func CleanName(name string) string {
 
 // fileFromNameRev returns a stored file name from a user's name for a saved media file.
 // Once the parent update has been saved, the owner is the parent ID and the name has a revision number.
-func fileFromNameRev(ownerId int64, name string, rev int) string {
+func (up *Uploader) fileFromNameRev(ownerId int64, name string, rev int) string {
 	if name != "" {
 		return fmt.Sprintf("P-%s$%s-%s",
 			strconv.FormatInt(ownerId, 36),
 			strconv.FormatInt(int64(rev), 36),
-			name)
+			up.storedName(name))
 	} else {
 		return ""
 	}
@@ -355,6 +719,7 @@ func fileFromNameRev(ownerId int64, name string, rev int) string {
 // FileFromName returns a stored file name from a user's name for a newly uploaded file.
 // The owner is a transaction code, because the parent object may not exist yet.
 // It has no revision number, so it doesn't overwrite a previous copy yet.
+// Use Uploader.FileFromName instead for opaque names.
 func FileFromName(id etx.TxId, name string) string {
 	if name != "" {
 		return fmt.Sprintf("P-%s-%s", etx.String(id), name)
@@ -367,6 +732,11 @@ func FileFromName(id etx.TxId, name string) string {
 func (up *Uploader) MediaType(name string) int {
 
 	mt, _, _ := getType(name, up.AudioTypes, up.VideoTypes)
+	if mt == MediaImage && !up.SVG && isSVG(name) {
+		mt = 0
+	} else if mt == 0 && up.isDoc(name) {
+		mt = MediaDoc
+	}
 	return mt
 }
 
@@ -394,6 +764,10 @@ func (up *Uploader) DoNext(tx etx.TxId) {
 		panic("Uploader: missing ops map!")
 	}
 
+	// no more uploads for this transaction, so incomplete chunked uploads are useless
+	up.commit(tx)
+	defer up.removeChunks(tx)
+
 	// uploads in progress?
 	op := up.ops[tx]
 	wait := op.uploads > 0
@@ -411,6 +785,17 @@ func (up *Uploader) DoNext(tx etx.TxId) {
 
 // STEP 4 : asyncronous processing of a parent update.
 
+// mediaName changes the file type of a name referenced by the parent, to match converted media.
+func (up *Uploader) mediaName(name string) string {
+
+	if !up.isDoc(name) && !isPlaylist(name) {
+		name, _ = changeType(name, up.AudioTypes, up.VideoTypes)
+		name = up.imageName(name)
+		name = up.streamName(name)
+	}
+	return name
+}
+
 // StartBind initiates linking a parent object to a set of uploaded files, returning a context for calls to Bind and EndBind.
 // It loads updated file versions. tx is 0 when we are deleting a parent object.
 func (up *Uploader) StartBind(parentId int64, tx etx.TxId) *Bind {
@@ -424,7 +809,7 @@ func (up *Uploader) StartBind(parentId int64, tx etx.TxId) *Bind {
 	parentName := strconv.FormatInt(parentId, 36)
 
 	// find existing versions
-	b.versions = up.globVersions(filepath.Join(up.FilePath, "P-"+parentName+"$*"))
+	b.versions = up.globVersions(filepath.Join(up.filePath(), "P-"+parentName+"$*"))
 
 	// generate new revision nunbers
 	if tx != 0 {
@@ -432,7 +817,7 @@ func (up *Uploader) StartBind(parentId int64, tx etx.TxId) *Bind {
 		txCode := etx.String(tx)
 
 		// find new files and set version number for each
-		newVersions := up.globVersions(filepath.Join(up.FilePath, "P-"+txCode+"-*"))
+		newVersions := up.globVersions(filepath.Join(up.tempPath(), "P-"+txCode+"-*"))
 
 		for lc, nv := range newVersions {
 			nv.upload = true
@@ -478,7 +863,7 @@ func (b *Bind) File(fileName string) (string, error) {
 	_, name, rev := NameFromFile(fileName)
 
 	// change user's file type, to match converted media
-	name, _ = changeType(name, up.AudioTypes, up.VideoTypes)
+	name = up.mediaName(name)
 	lc := strings.ToLower(name)
 
 	// current version
@@ -501,6 +886,12 @@ func (b *Bind) File(fileName string) (string, error) {
 				return "", fmt.Errorf("cannot bind upload for %v: %w", fileName, err)
 			}
 			cv.upload = false
+
+			ev := EventBound
+			if cv.revision > 1 {
+				ev = EventReplaced
+			}
+			up.event(&MediaEvent{Event: ev, Tx: b.tx, Parent: b.parentId, Name: name, File: cv.fileName})
 		}
 		newName = cv.fileName
 	}
@@ -526,6 +917,9 @@ func (b *Bind) End() error {
 
 		if !cv.keep && !cv.upload {
 			b.delVersions = append(b.delVersions, cv)
+
+			_, name, _ := up.NameFromFile(cv.fileName)
+			up.event(&MediaEvent{Event: EventDeleted, Tx: b.tx, Parent: b.parentId, Name: name, File: cv.fileName})
 		}
 	}
 
@@ -535,6 +929,10 @@ func (b *Bind) End() error {
 			return err
 		}
 	}
+
+	if b.tx != 0 {
+		up.forgetProgress(b.tx)
+	}
 	return nil
 }
 
@@ -545,9 +943,14 @@ func Thumbnail(filename string) string {
 
 	switch filepath.Ext(filename) {
 
-	case ".jpg", ".png":
+	case ".jpg", ".png", ".webp", ".avif":
 		return "S" + filename[1:]
 
+	case ".svg":
+		// rasterised
+		tn := changeExt(filename, ".png")
+		return "S" + tn[1:]
+
 	// ## extensions not normalised for current websites :-(
 	case ".jpeg", ".JPG", ".PNG", ".JPEG":
 		return "S" + filename[1:]
@@ -583,6 +986,11 @@ func getType(name string, audioTypes []string, videoTypes []string) (mediaType i
 			ext = ".jpg"
 			changed = true
 		}
+	} else if isSVG(name) {
+		// vector image, sanitised
+		mediaType = MediaImage
+		ext = ".svg"
+
 	} else {
 		t := strings.ToLower(filepath.Ext(name))
 
@@ -626,6 +1034,17 @@ func changeType(name string, audioTypes []string, videoTypes []string) (nm strin
 	return
 }
 
+// imageName changes the file type for an image name, if images are converted to a configured type.
+func (up *Uploader) imageName(name string) string {
+
+	if up.ImageType != "" {
+		if _, err := imaging.FormatFromFilename(name); err == nil {
+			return changeExt(name, up.ImageType)
+		}
+	}
+	return name
+}
+
 // copyStatic copies a static file to the specified directory.
 func copyStatic(toDir, name string, fromFS fs.FS, path string) error {
 	var src fs.File
@@ -679,6 +1098,21 @@ func (up *Uploader) globVersions(pattern string) map[string]fileVersion {
 	return versions
 }
 
+// isDownscaled returns true if an image could have been downscaled from the original size.
+func isDownscaled(size image.Point, original image.Point) bool {
+
+	if size.X > original.X || size.Y > original.Y {
+		return false
+	}
+
+	// same aspect ratio, allowing for rounding by the client
+	diff := size.X*original.Y - size.Y*original.X
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= original.X+original.Y
+}
+
 // opDone decrements the count of in-progress uploads, and requests the next operation when ready.
 func (up *Uploader) opDone(tx etx.TxId) {
 
@@ -711,13 +1145,13 @@ func (up *Uploader) removeMedia(fileName string) error {
 	nm := fileName
 
 	// remove file
-	err := os.Remove(filepath.Join(up.FilePath, nm))
+	err := os.Remove(up.mediaPath(nm))
 	if err != nil && errors.Is(err, fs.ErrNotExist) {
 
 		// Is it a legacy file saved by an earlier implementation?
 		if filepath.Ext(nm) == ".jpg" {
 			nm = changeExt(nm, ".jpeg")
-			err = os.Remove(filepath.Join(up.FilePath, nm))
+			err = os.Remove(up.mediaPath(nm))
 		}
 	}
 
@@ -726,9 +1160,11 @@ func (up *Uploader) removeMedia(fileName string) error {
 		return err
 	}
 
-	// remove corresponding thumbnail
-	if err := os.Remove(filepath.Join(up.FilePath, Thumbnail(nm))); err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
+	// remove corresponding thumbnail and renditions
+	for _, v := range up.variants(nm) {
+		if err := os.Remove(up.mediaPath(v)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 	}
 	return nil
 }
@@ -741,7 +1177,7 @@ func (up *Uploader) removeOrphans(id etx.TxId) error {
 
 	// all files for transaction
 	tn := etx.String(id)
-	files := up.globVersions(filepath.Join(up.FilePath, "P-"+tn+"-*"))
+	files := up.globVersions(filepath.Join(up.tempPath(), "P-"+tn+"-*"))
 
 	for _, f := range files {
 		if err := up.removeMedia(f.fileName); err != nil {
@@ -749,21 +1185,29 @@ func (up *Uploader) removeOrphans(id etx.TxId) error {
 		}
 	}
 
-	// end transaction
-	return up.tm.End(id)
+	// incomplete uploads
+	if err := up.removeChunks(id); err != nil {
+		return err
+	}
+	up.forgetProgress(id)
+
+	// end transaction (which may have been ended by an earlier request for the same orphans)
+	if err := up.tm.End(id); err != nil && !errors.Is(err, etx.ErrEnded) {
+		return err
+	}
+	return nil
 }
 
 // saveAudio saves the audio file and a dummy thumbnail.
-// It returns true if no format conversion is needed.
-// (No conversions are implemented in this version.)
+// It returns true if no conversion is needed. The only conversion is loudness normalisation, keeping the file type.
 func (up *Uploader) saveAudio(req reqSave) (bool, error) {
 
 	// normalise file name
 	name, _ := changeType(req.name, up.AudioTypes, []string{})
 
 	// path for saved file
-	fn := FileFromName(req.tx, name)
-	path := filepath.Join(up.FilePath, fn)
+	fn := up.FileFromName(req.tx, name)
+	path := filepath.Join(up.tempPath(), fn)
 
 	// save uploaded audio file
 	audio, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
@@ -776,10 +1220,20 @@ func (up *Uploader) saveAudio(req reqSave) (bool, error) {
 		return true, err
 	}
 
-	// add a dummy thumbnail
-	err = copyStatic(up.FilePath, Thumbnail(fn), WebFiles, "web/static/audio.png")
+	// thumbnail from embedded cover art, or a dummy one
+	if !up.saveAlbumArt(fn) {
+		err = copyStatic(up.tempPath(), Thumbnail(fn), WebFiles, "web/static/audio.png")
+	}
+	if err != nil || up.Loudness == 0 || up.VideoPackage == "" {
+		return true, err
+	}
 
-	return true, err
+	// normalise loudness, from a copy with a temporary name
+	if err = os.Rename(path, path+rawAudio); err != nil {
+		return true, err
+	}
+	up.chConvert <- reqConvert{file: fn + rawAudio, name: req.name, hash: req.hash, tx: req.tx, audio: true}
+	return false, nil
 }
 
 
@@ -790,33 +1244,47 @@ func (up *Uploader) saveImage(req reqSave) error {
 	name, convert := changeType(req.name, []string{}, []string{})
 
 	// path for saved files
-	filename := FileFromName(req.tx, name)
-	savePath := filepath.Join(up.FilePath, filename)
-	thumbPath := filepath.Join(up.FilePath, Thumbnail(filename))
+	filename := up.FileFromName(req.tx, name)
+	savePath := filepath.Join(up.tempPath(), filename)
+	thumbPath := filepath.Join(up.tempPath(), Thumbnail(filename))
 
 	// check if uploaded image small enough to save
 	size := req.img.Bounds().Size()
-	if size.X <= up.MaxW && size.Y <= up.MaxH && !convert {
+	unchanged := size.X <= up.MaxW && size.Y <= up.MaxH && !convert && up.watermark == nil
+	img := up.watermarkImage(req.img)
+
+	// remove metadata, without re-encoding unless needed for orientation
+	var original io.Reader = &req.fullsize
+	if unchanged && up.StripMetadata {
+		var data []byte
+		data, unchanged = stripMetadata(name, req.fullsize.Bytes())
+		original = bytes.NewReader(data)
+	}
+
+	savedWidth := size.X
+	if unchanged {
 
 		// save uploaded file unchanged
 		saved, err := os.OpenFile(savePath, os.O_WRONLY|os.O_CREATE, 0666)
 		if err != nil {
 			return err // could be a bad name?
 		}
-		defer saved.Close()
-		if _, err = io.Copy(saved, &req.fullsize); err != nil {
+		_, err = io.Copy(saved, original)
+		saved.Close()
+		if err != nil {
 			return err
 		}
 
 	} else {
 
 		// ## Could set compression option, or sharpen, but how much?
-		resized := imaging.Fit(req.img, up.MaxW, up.MaxH, imaging.Lanczos)
+		resized := imaging.Fit(img, up.MaxW, up.MaxH, imaging.Lanczos)
 		runtime.Gosched()
 
 		if err := imaging.Save(resized, savePath); err != nil {
 			return err // ## could be a bad name?
 		}
+		savedWidth = resized.Bounds().Dx()
 	}
 
 	// save thumbnail
@@ -824,7 +1292,23 @@ func (up *Uploader) saveImage(req reqSave) error {
 		return err
 	}
 
-	return nil
+	// smaller renditions
+	resized, linked, err := up.saveRenditions(img, filename, savedWidth)
+	if err != nil {
+		return err
+	}
+
+	// convert to a more efficient format
+	if up.ImageType != "" {
+		for _, fn := range append([]string{filename, Thumbnail(filename)}, resized...) {
+			if err := up.convertImage(fn); err != nil {
+				return err
+			}
+		}
+		filename = changeExt(filename, up.ImageType)
+	}
+
+	return up.linkRenditions(filename, linked)
 }
 
 // saveMedia performs image or video processing, called from background worker.
@@ -832,25 +1316,69 @@ func (up *Uploader) saveMedia(req reqSave) error {
 	var done bool
 	var err error
 
+	up.setProgress(req.tx, req.name, StateProcessing, -1, 0)
+
+	// reject infected files
+	if ok, err := up.scan(req); !ok {
+		if err != nil {
+			up.doneProgress(req.tx, req.name, err)
+		}
+		up.opDone(req.tx)
+		return err
+	}
+
+	// identical content already processed?
+	name := up.uploadName(req.name, req.mediaType)
+	if req.hash != "" && up.fromCache(req.hash, req.tx, name) {
+		up.cachedMetadata(req, name)
+		up.doneProgress(req.tx, req.name, nil)
+		up.opDone(req.tx)
+		return nil
+	}
+
+	// keep the upload as received
+	if err := up.saveOriginal(req, name); err != nil {
+		up.doneProgress(req.tx, req.name, err)
+		up.opDone(req.tx)
+		return err
+	}
+
 	switch req.mediaType {
 	case MediaAudio:
 		done, err = up.saveAudio(req)
-		if done {
-			up.opDone(req.tx)
-		}
 
 	case MediaImage:
-		err = up.saveImage(req)
-		up.opDone(req.tx)
+		if isSVG(req.name) {
+			err = up.saveSVG(req)
+		} else {
+			if up.OnMetadata != nil {
+				up.OnMetadata(req.tx, req.name, imageMetadata(req.fullsize.Bytes(), req.img))
+			}
+			err = up.saveImage(req)
+		}
+		done = true
 
 	case MediaVideo:
 		done, err = up.saveVideo(req)
-		if done {
+		if err == errRejected {
 			up.opDone(req.tx)
+			return nil
 		}
-		// otherwise, processing continued in video worker
+		// if not done, processing continued in video worker
+
+	case MediaDoc:
+		err = up.saveDoc(req)
+		done = true
+	}
+
+	if done && err == nil && req.hash != "" {
+		up.toCache(req.hash, up.FileFromName(req.tx, name))
 	}
 
+	if done || err != nil {
+		up.doneProgress(req.tx, req.name, err)
+		up.opDone(req.tx)
+	}
 	return err
 }
 
@@ -866,30 +1394,37 @@ func (up *Uploader) saveVersion(parentId int64, tx etx.TxId, name string, rev in
 
 	// Link the file, rather than rename it, so the current version of the parent continues to work.
 	// We'll remove the old name once the parent update has been committed.
+	// (If uploads are on a different volume, the file is copied instead.)
 
 	// the file should already be saved without a revision nuumber
-	uploaded := FileFromName(tx, name)
-	revised := fileFromNameRev(parentId, name, rev)
+	uploaded := up.FileFromName(tx, name)
+	revised := up.fileFromNameRev(parentId, name, rev)
 
 	// main image ..
-	uploadedPath := filepath.Join(up.FilePath, uploaded)
-	revisedPath := filepath.Join(up.FilePath, revised)
-	if err := os.Link(uploadedPath, revisedPath); err != nil {
+	uploadedPath := filepath.Join(up.tempPath(), uploaded)
+	revisedPath := filepath.Join(up.filePath(), revised)
+	if err := linkVariant(uploadedPath, revisedPath); err != nil {
 		return revised, err
 	}
 
-	// .. and thumbnail
-	uploadedPath = filepath.Join(up.FilePath, Thumbnail(uploaded))
-	revisedPath = filepath.Join(up.FilePath, Thumbnail(revised))
-	err := os.Link(uploadedPath, revisedPath)
+	// .. and thumbnail, renditions and HLS files
+	revisedVs := up.variants(revised)
+	for i, v := range up.variants(uploaded) {
+		uploadedPath = filepath.Join(up.tempPath(), v)
+		revisedPath = filepath.Join(up.filePath(), revisedVs[i])
+		if err := linkVariant(uploadedPath, revisedPath); err != nil {
+			return revised, err
+		}
+	}
 
 	// rename with a revision number
-	return revised, err
+	return revised, nil
 }
 
 // worker does background processing for media.
 func (up *Uploader) worker(
 	chSave <-chan reqSave,
+	chSaveAV <-chan reqSave,
 	chOrphans <-chan OpOrphans,
 	chTick <-chan time.Time,
 	chDone <-chan bool) {
@@ -898,6 +1433,17 @@ func (up *Uploader) worker(
 		// returns to client sooner?
 		runtime.Gosched()
 
+		// images take priority, so that thumbnails aren't delayed by audio and video
+		select {
+		case req := <-chSave:
+			if err := up.saveMedia(req); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+			continue
+
+		default:
+		}
+
 		select {
 
 		case req := <-chSave:
@@ -907,6 +1453,11 @@ func (up *Uploader) worker(
 				up.errorLog.Print(err.Error())
 			}
 
+		case req := <-chSaveAV:
+			if err := up.saveMedia(req); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+
 		case req := <-chOrphans:
 			if err := up.removeOrphans(req.tx); err != nil {
 				up.errorLog.Print(err.Error())
@@ -916,14 +1467,75 @@ func (up *Uploader) worker(
 			// cutoff time for orphans
 			cutoff := time.Now().Add(-1 * up.MaxAge)
 
-			// request timeout for extended transactions started before the cutoff time
-			if err := up.tm.Timeout(up, 0, cutoff); err != nil {
+			// request timeout for uploads started before the cutoff time and not bound to a parent
+			// (operations saved with type 0 by earlier versions are redone on recovery)
+			if err := up.tm.Timeout(up, opOrphans, cutoff); err != nil {
 				up.errorLog.Print(err.Error())
 			}
 
+			// forget old content hashes and committed transactions
+			up.removeCached()
+			up.forgetCommitted(cutoff)
+			up.removeStaleChunks(cutoff)
+
+			// storage used, for metrics
+			up.measureStorage()
+
 		case <-chDone:
-			// ## do something to finish other pending requests
+			up.drainSaves(chSave, chSaveAV)
+			up.wgWorkers.Done()
 			return
 		}
 	}
 }
+
+// mediaWorker is an additional worker, just for processing uploaded media.
+func (up *Uploader) mediaWorker(chSave <-chan reqSave, chSaveAV <-chan reqSave, chDone <-chan bool) {
+
+	for {
+		// images first
+		select {
+		case req := <-chSave:
+			if err := up.saveMedia(req); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+			continue
+
+		default:
+		}
+
+		select {
+		case req := <-chSave:
+			if err := up.saveMedia(req); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+
+		case req := <-chSaveAV:
+			if err := up.saveMedia(req); err != nil {
+				up.errorLog.Print(err.Error())
+			}
+
+		case <-chDone:
+			up.drainSaves(chSave, chSaveAV)
+			up.wgWorkers.Done()
+			return
+		}
+	}
+}
+
+// drainSaves processes the uploads remaining when the uploader is stopped.
+func (up *Uploader) drainSaves(chSave <-chan reqSave, chSaveAV <-chan reqSave) {
+
+	for {
+		var req reqSave
+		select {
+		case req = <-chSave:
+		case req = <-chSaveAV:
+		default:
+			return
+		}
+		if err := up.saveMedia(req); err != nil {
+			up.errorLog.Print(err.Error())
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+// Package uploadertest provides a harness to test applications that use the uploader,
+// running full upload, bind and delete cycles without a database, Docker or FFmpeg.
+//
+// The harness acts as the application: it implements the parent's bind operation as an etx resource manager,
+// using a temporary directory for media files, an in-memory etx.MemStore for the redo log, and a fake FFmpeg executable.
+// The fake copies video files unchanged and returns a plain image for snapshots.
+// It is a shell script, so the harness needs a Unix-like system.
+package uploadertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+	"github.com/inchworks/webparts/uploader"
+)
+
+// Timeout is the maximum time to wait for uploads to be processed.
+var Timeout = 10 * time.Second
+
+// Harness holds an uploader and its test environment.
+type Harness struct {
+	Dir      string             // media files
+	Uploader *uploader.Uploader // with parameters set for testing
+	TM       *etx.TM
+	Store    *etx.MemStore // redo log
+
+	tb     testing.TB
+	chBind chan result
+}
+
+// OpBind is the parent's operation to bind uploaded files.
+type OpBind struct {
+	ParentId int64
+	Files    []string // stored file names, referenced by the parent
+}
+
+// result holds the outcome of a bind operation.
+type result struct {
+	files []string
+	err   error
+}
+
+// db is a stub for the parent's database.
+type db struct{}
+
+// Begin starts a (non-existent) database transaction.
+func (db) Begin() func() {
+	return func() {}
+}
+
+// fakeFFmpeg is a script that pretends to be FFmpeg.
+const fakeFFmpeg = `#!/bin/sh
+# fake FFmpeg for uploadertest: the last argument is the output file
+for a; do out="$a"; done
+while [ $# -gt 0 ]; do
+	if [ "$1" = "-i" ]; then in="$2"; fi
+	shift
+done
+case "$out" in
+	*.jpg) cp "%s" "$out" ;;
+	*) cp "$in" "$out" ;;
+esac
+`
+
+// New returns a harness with a running uploader. It is stopped when the test ends.
+func New(tb testing.TB) *Harness {
+
+	tb.Helper()
+
+	h := &Harness{
+		Dir:    tb.TempDir(),
+		tb:     tb,
+		chBind: make(chan result, 1),
+	}
+
+	// fake FFmpeg, with an image for snapshots
+	tools := tb.TempDir()
+	snapshot := filepath.Join(tools, "snapshot.jpg")
+	if err := writeImage(snapshot); err != nil {
+		tb.Fatal(err)
+	}
+	ffmpeg := filepath.Join(tools, "ffmpeg")
+	if err := ioutil.WriteFile(ffmpeg, []byte(fmt.Sprintf(fakeFFmpeg, snapshot)), 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	h.Store, _ = etx.NewMemStore("") // no error without a snapshot
+	h.TM = etx.New(nil, h.Store)
+	h.Uploader = &uploader.Uploader{
+		FilePath:     h.Dir,
+		MaxW:         1600,
+		MaxH:         1200,
+		ThumbW:       278,
+		ThumbH:       208,
+		MaxAge:       time.Hour,
+		SnapshotAt:   time.Second,
+		AudioTypes:   []string{".mp3", ".m4a"},
+		VideoPackage: ffmpeg,
+		VideoTypes:   []string{".mp4", ".mov"},
+	}
+	h.Uploader.Initialise(log.New(ioutil.Discard, "", 0), db{}, h.TM)
+	tb.Cleanup(h.Uploader.Stop)
+
+	return h
+}
+
+// Name, ForOperation and Operation implement the RM interface for webparts.etx.
+
+func (h *Harness) Name() string {
+	return "webparts.uploadertest"
+}
+
+func (h *Harness) ForOperation(opType int) etx.Op {
+	return &OpBind{}
+}
+
+// Operation binds the uploaded files to the parent, as an application would.
+func (h *Harness) Operation(tx etx.TxId, opType int, op etx.Op) {
+
+	o := op.(*OpBind)
+	b := h.Uploader.StartBind(o.ParentId, tx)
+
+	var err error
+	files := make([]string, len(o.Files))
+	for i, f := range o.Files {
+		var nm string
+		if nm, err = b.File(f); err != nil {
+			break
+		}
+		if nm != "" {
+			files[i] = nm // changed version
+		} else {
+			files[i] = f
+		}
+	}
+
+	// the parent would be saved here
+	if err == nil {
+		err = b.End()
+	}
+	if err == nil {
+		err = h.TM.End(tx)
+	}
+	h.chBind <- result{files: files, err: err}
+}
+
+// Begin starts an update to a parent, returning the transaction for uploads.
+func (h *Harness) Begin() etx.TxId {
+
+	h.tb.Helper()
+
+	code, err := h.Uploader.Begin()
+	if err != nil {
+		h.tb.Fatal(err)
+	}
+	tx, err := etx.Id(code)
+	if err != nil {
+		h.tb.Fatal(err)
+	}
+	return tx
+}
+
+// Upload saves media content, as if it had been uploaded by a client.
+func (h *Harness) Upload(tx etx.TxId, name string, content []byte) error {
+
+	err, _ := h.Uploader.SaveReader(bytes.NewReader(content), name, tx)
+	return err
+}
+
+// Update saves a parent referencing the named media, as if its form had been submitted.
+// Names are either user names for new uploads, or stored file names from a previous update.
+// It waits for uploads to be processed and bound, and returns the stored file names.
+func (h *Harness) Update(tx etx.TxId, parentId int64, names []string) ([]string, error) {
+
+	files := make([]string, len(names))
+	for i, nm := range names {
+		if strings.HasPrefix(nm, "P-") {
+			files[i] = nm // stored file
+		} else {
+			files[i] = h.Uploader.FileFromName(tx, uploader.CleanName(nm)) // new upload
+		}
+	}
+
+	if err := h.TM.SetNext(tx, h, 0, &OpBind{ParentId: parentId, Files: files}); err != nil {
+		return nil, err
+	}
+	h.Uploader.DoNext(tx)
+
+	return h.wait()
+}
+
+// Delete removes all media for a parent, as if it had been deleted.
+func (h *Harness) Delete(parentId int64) error {
+	return h.Uploader.StartBind(parentId, 0).End()
+}
+
+// Files returns the names of all files in the media directory, sorted.
+func (h *Harness) Files() []string {
+
+	h.tb.Helper()
+
+	fs, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		h.tb.Fatal(err)
+	}
+
+	names := make([]string, 0, len(fs))
+	for _, f := range fs {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wait returns the result of a bind operation.
+func (h *Harness) wait() ([]string, error) {
+
+	select {
+	case r := <-h.chBind:
+		return r.files, r.err
+
+	case <-time.After(Timeout):
+		return nil, errors.New("uploadertest: timed out waiting for uploads to be processed")
+	}
+}
+
+// writeImage saves a small JPEG image.
+func writeImage(path string) error {
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{R: 64, G: 128, B: 192, A: 255})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return jpeg.Encode(f, img, nil)
+}
@@ -0,0 +1,100 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploadertest_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/inchworks/webparts/uploader/uploadertest"
+)
+
+// TestCycle uploads an image, binds it to a parent, replaces it, and deletes the parent.
+func TestCycle(t *testing.T) {
+
+	h := uploadertest.New(t)
+
+	// upload and bind
+	tx := h.Begin()
+	if err := h.Upload(tx, "photo.jpg", jpegImage(t, 200)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := h.Update(tx, 1, []string{"photo.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasPrefix(files[0], "P-") {
+		t.Fatalf("bound %v", files)
+	}
+	first := files[0]
+	if !contains(h.Files(), first) {
+		t.Fatalf("%s not saved, found %v", first, h.Files())
+	}
+
+	// replace with a new version of the same name
+	tx = h.Begin()
+	if err := h.Upload(tx, "photo.jpg", jpegImage(t, 100)); err != nil {
+		t.Fatal(err)
+	}
+	files, err = h.Update(tx, 1, []string{"photo.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] == first {
+		t.Fatalf("replaced %s by %v", first, files)
+	}
+	if !contains(h.Files(), files[0]) {
+		t.Fatalf("%s not saved, found %v", files[0], h.Files())
+	}
+	if contains(h.Files(), first) {
+		t.Errorf("%s not removed", first)
+	}
+
+	// delete parent
+	if err := h.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range h.Files() {
+		if strings.HasPrefix(f, "P-") {
+			t.Errorf("%s not deleted", f)
+		}
+	}
+
+	// nothing left in the redo log
+	if recs := h.Store.ForManager(h.Name(), math.MaxInt64); len(recs) != 0 {
+		t.Errorf("redo log holds %d records", len(recs))
+	}
+}
+
+// contains returns true if a name is in a list.
+func contains(names []string, name string) bool {
+
+	for _, nm := range names {
+		if nm == name {
+			return true
+		}
+	}
+	return false
+}
+
+// jpegImage returns a small JPEG image, with a shade of grey to distinguish versions.
+func jpegImage(t *testing.T, grey uint8) []byte {
+
+	img := image.NewRGBA(image.Rect(0, 0, 80, 60))
+	for x := 0; x < 80; x++ {
+		for y := 0; y < 60; y++ {
+			img.Set(x, y, color.RGBA{R: grey, G: grey, B: grey, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
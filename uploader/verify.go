@@ -0,0 +1,67 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Validation of file references before a parent update is committed.
+
+import (
+	"errors"
+	"strings"
+)
+
+// Checked is the result of Bind.Verify for one file name.
+type Checked struct {
+	FileName  string // name as referenced by the parent
+	MediaType int    // media type, or 0 if not accepted
+	Pending   bool   // upload is still being received or processed
+	Err       error  // why the reference cannot be bound, or nil
+}
+
+var (
+	errNotAccepted = errors.New("File type not accepted")
+	errNoUpload    = errors.New("No file uploaded with this name")
+	errNotSaved    = errors.New("Upload could not be processed")
+)
+
+// Verify checks file references, as they would be passed to File, without binding them.
+// It allows a parent application to validate an update before committing it, using a Bind from StartBind
+// with no call to End, which has no side effects. Uploads still in progress are reported as Pending, not as errors.
+func (b *Bind) Verify(fileNames ...string) []Checked {
+
+	up := b.up
+	results := make([]Checked, 0, len(fileNames))
+
+	for _, fileName := range fileNames {
+		c := Checked{FileName: fileName}
+		if fileName == "" {
+			results = append(results, c) // no media file
+			continue
+		}
+
+		_, name, _ := NameFromFile(fileName)
+		c.MediaType = up.MediaType(name)
+		if c.MediaType == 0 && !isPlaylist(name) {
+			c.Err = errNotAccepted
+			results = append(results, c)
+			continue
+		}
+
+		// upload still being processed?
+		if b.tx != 0 {
+			_, display, _ := up.NameFromFile(fileName) // progress is for the user's name
+			switch up.Progress(b.tx, display).State {
+			case StateReceiving, StateQueued, StateProcessing, StateConverting:
+				c.Pending = true
+			case StateFailed, StateRejected:
+				c.Err = errNotSaved
+			}
+		}
+
+		// saved file, converted as for File
+		if !c.Pending && c.Err == nil && b.versions[strings.ToLower(up.mediaName(name))].revision == 0 {
+			c.Err = errNoUpload
+		}
+		results = append(results, c)
+	}
+	return results
+}
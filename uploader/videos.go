@@ -5,12 +5,14 @@ package uploader
 // Video file processing.
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,15 +21,32 @@ import (
 	"github.com/inchworks/webparts/etx"
 )
 
+var errRejected = errors.New("upload rejected") // already reported
+
 type reqConvert struct {
 	file string
+	name string // upload name, for progress
+	hash string // content hash, for deduplication
 	tx etx.TxId
+
+	stream bool // HLS rendition only, without conversion
+	audio  bool // audio loudness normalisation
+
+	// retries
+	attempt int      // previous attempts
+	retry   etx.TxId // transaction for logged retries, or 0
+}
+
+// convert saves a video file in the specified type, with optional FFmpeg output options.
+func (up *Uploader) convert(fromName string, toType string, opts ...string) error {
+	return up.convertWith(fromName, toType, nil, opts, nil)
 }
 
-// convert saves a video file in the specified type.
-func (up *Uploader) convert(fromName string, toType string) error {
+// convertWith saves a video file in the specified type, with FFmpeg options for the input and output.
+// Progress is reported as a percentage, if a function is specified.
+func (up *Uploader) convertWith(fromName string, toType string, inOpts []string, outOpts []string, progress func(int)) error {
 
-	fromPath := filepath.Join(up.FilePath, fromName)
+	fromPath := filepath.Join(up.tempPath(), fromName)
 
 	// the file may have already been converted, if we are redoing the operations
 	if exists, err := exists(fromPath); err != nil {
@@ -40,7 +59,15 @@ func (up *Uploader) convert(fromName string, toType string) error {
 	to := strings.TrimSuffix(fromName, filepath.Ext(fromName)) + toType
 
 	// convert to specified type
-	err := up.ffmpeg("-v", "error", "-i", fromName, to)
+	args := append([]string{"-v", "error"}, inOpts...)
+	args = append(append(args, "-i", fromName), outOpts...)
+	args = append(args, to)
+	var err error
+	if progress != nil {
+		err = up.ffmpegProgress(up.probeVideo(fromName).Duration, progress, args...)
+	} else {
+		err = up.ffmpeg(args...)
+	}
 
 	// remove original
 	if err == nil {
@@ -49,6 +76,37 @@ func (up *Uploader) convert(fromName string, toType string) error {
 	return err
 }
 
+// convertImage saves an image file in the configured output type.
+func (up *Uploader) convertImage(fromName string) error {
+
+	var opts []string
+	switch up.ImageType {
+	case ".webp":
+		if up.ImageQuality > 0 {
+			opts = []string{"-quality", strconv.Itoa(up.ImageQuality)}
+		}
+
+	case ".avif":
+		opts = []string{"-still-picture", "1"}
+		if up.ImageQuality > 0 {
+			// map quality to AV1 constant rate factor, 0 (best) to 63
+			opts = append(opts, "-crf", strconv.Itoa(63-(up.ImageQuality*63)/100))
+		}
+	}
+
+	// overrides
+	p := up.profile(MediaImage)
+	if p.Codec != "" {
+		opts = append(opts, "-c:v", p.Codec)
+	}
+	if len(p.Filters) > 0 {
+		opts = append(opts, "-vf", strings.Join(p.Filters, ","))
+	}
+	opts = append(opts, p.options()...)
+
+	return up.convert(fromName, up.ImageType, opts...)
+}
+
 // exists returns true if a file already exists
 func exists(path string) (bool, error) {
 	if _, err := os.Stat(path); err != nil {
@@ -63,14 +121,14 @@ func exists(path string) (bool, error) {
 }
 
 // saveSnapshot saves a video thumbnail.
-func (up *Uploader) saveSnapshot(videoName string) error {
+func (up *Uploader) saveSnapshot(videoName string, at time.Duration) error {
 
 	var err error
 	if up.SnapshotAt >= 0 {
 
 		// get snapshot for thumbnail (if possible; may fail for e.g. tiny video)
 		var snPath string
-		snPath, err = up.snapshot(videoName, "S", up.SnapshotAt)
+		snPath, err = up.snapshot(videoName, "S", at)
 
 		// read full-size snapshot
 		var sn *os.File
@@ -95,11 +153,39 @@ func (up *Uploader) saveSnapshot(videoName string) error {
 
 	if up.SnapshotAt < 0 || err != nil {
 		// dummy thumbnail, instead
-		err = copyStatic(up.FilePath, Thumbnail(videoName), WebFiles, "web/static/video.jpg")
+		err = copyStatic(up.tempPath(), Thumbnail(videoName), WebFiles, "web/static/video.jpg")
 	}
 	return err
 }
 
+// saveAlbumArt saves a thumbnail from the cover art embedded in an audio file, such as an MP3 or M4A,
+// and returns false if there is none.
+func (up *Uploader) saveAlbumArt(audioName string) bool {
+
+	if up.VideoPackage == "" {
+		return false
+	}
+	to := Thumbnail(audioName)
+	toPath := filepath.Join(up.tempPath(), to)
+
+	// extract the attached picture, which FFmpeg sees as a video stream
+	os.Remove(toPath) // FFmpeg will not overwrite a file from an earlier attempt
+	if err := up.ffmpeg("-v", "quiet", "-i", audioName, "-an", "-frames:v", "1", to); err != nil {
+		return false // no cover art
+	}
+
+	art, err := imaging.Open(toPath, imaging.AutoOrientation(true))
+	if err == nil {
+		err = up.saveThumbnail(art, toPath)
+	}
+	if err != nil {
+		up.errorLog.Print(err.Error())
+		os.Remove(toPath)
+		return false
+	}
+	return true
+}
+
 // saveVideo saves the video file and a thumbnail. It returns true if no format conversion is needed.
 func (up *Uploader) saveVideo(req reqSave) (bool, error) {
 
@@ -110,8 +196,8 @@ func (up *Uploader) saveVideo(req reqSave) (bool, error) {
 	}
 
 	// path for saved file
-	fn := FileFromName(req.tx, name)
-	path := filepath.Join(up.FilePath, fn)
+	fn := up.FileFromName(req.tx, name)
+	path := filepath.Join(up.tempPath(), fn)
 
 	// save uploaded video file
 	video, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
@@ -124,15 +210,41 @@ func (up *Uploader) saveVideo(req reqSave) (bool, error) {
 		return true, err
 	}
 
-	// add a snapshot thumbnail
-	err = up.saveSnapshot(fn)
+	// report metadata, before any conversion
+	var md *Metadata
+	if up.OnMetadata != nil || (up.VideoPackage != "" && (up.MaxVideoDuration > 0 || up.MaxVideoPixels > 0)) {
+		md = up.probeVideo(fn)
+	}
+
+	// reject videos that would take too long to convert
+	if reason := up.videoLimits(md); reason != "" {
+		up.errorLog.Printf("Upload %s for %s rejected: %s", req.name, etx.String(req.tx), reason)
+		os.Remove(path)
+		up.reject(req.tx, req.name, reason)
+		return true, errRejected
+	}
+
+	if up.OnMetadata != nil {
+		up.OnMetadata(req.tx, req.name, md)
+	}
+
+	// add a snapshot thumbnail, at the time requested by the client if it is within the video
+	at := up.SnapshotAt
+	if req.snapshotAt > 0 && (md == nil || md.Duration == 0 || req.snapshotAt < md.Duration) {
+		at = req.snapshotAt
+	}
+	err = up.saveSnapshot(fn, at)
 	if err != nil {
 		return true, err
 	}
+	up.saveCaptions(fn)
 
 	// convert video format, if we can
 	if convert && up.VideoPackage != "" {
-		up.chConvert <- reqConvert{file: fn, tx: req.tx}
+		up.chConvert <- reqConvert{file: fn, name: req.name, hash: req.hash, tx: req.tx}
+		return false, nil
+	} else if up.HLS != HLSNone {
+		up.chConvert <- reqConvert{file: fn, name: req.name, hash: req.hash, tx: req.tx, stream: true}
 		return false, nil
 	} else {
 		// #### could use "ffmpeg -f null" to validate as a video
@@ -140,12 +252,27 @@ func (up *Uploader) saveVideo(req reqSave) (bool, error) {
 	}
 }
 
+// videoLimits returns the reason a video exceeds the configured limits, or an empty string.
+func (up *Uploader) videoLimits(md *Metadata) string {
+
+	if md == nil || up.VideoPackage == "" {
+		return ""
+	}
+	if up.MaxVideoDuration > 0 && md.Duration > up.MaxVideoDuration {
+		return "Video longer than " + strDuration(up.MaxVideoDuration)
+	}
+	if up.MaxVideoPixels > 0 && md.Width*md.Height > up.MaxVideoPixels {
+		return fmt.Sprintf("Video resolution %dx%d too high", md.Width, md.Height)
+	}
+	return ""
+}
+
 // frame generates a freeze frame image, and returns its path.
 func (up *Uploader) snapshot(fromName string, prefix string, after time.Duration) (string, error){
 
 	// output file name
 	to := prefix + strings.TrimSuffix(fromName[1:], filepath.Ext(fromName)) + ".jpg"
-	toPath := filepath.Join(up.FilePath, to)
+	toPath := filepath.Join(up.tempPath(), to)
 
 	// the snapshot may have already been created, if we are redoing the operations, and FFmpeg will not overwrite it
 	if exists, err := exists(toPath); err != nil {
@@ -163,10 +290,24 @@ func (up *Uploader) snapshot(fromName string, prefix string, after time.Duration
 }
 
 // ffmpeg executes an FFmpeg command, either direct or using Docker (as a convenience for testing on MacOS).
+// An absolute path specifies an executable to be run instead of FFmpeg, such as a fake implementation for testing.
 func (up *Uploader) ffmpeg(arg ...string) error {
+	return up.ffmpegOut(nil, arg...)
+}
+
+// ffmpegOut executes an FFmpeg command, with optional output.
+func (up *Uploader) ffmpegOut(out io.Writer, arg ...string) error {
+
+	defer up.startFFmpeg()()
+	return up.videoTool("ffmpeg", out, up.throttleArgs(arg)...)
+}
 
-	// absolute path to files
-	abs, err := filepath.Abs(up.FilePath)
+// videoTool executes a command from the FFmpeg package, such as ffmpeg or ffprobe, with optional output.
+// For an absolute path to FFmpeg, the other tools are expected in the same directory.
+func (up *Uploader) videoTool(tool string, out io.Writer, arg ...string) error {
+
+	// absolute path to files (video processing is only needed for uploads)
+	abs, err := filepath.Abs(up.tempPath())
 	if err != nil {
 		return err
 	}
@@ -174,7 +315,16 @@ func (up *Uploader) ffmpeg(arg ...string) error {
 	var c *exec.Cmd
 	if up.VideoPackage == "ffmpeg" {
 		// a direct command to the local implementation of FFmpeg
-		c = exec.Command("ffmpeg", arg...)
+		c = up.niceCommand(tool, arg...)
+		c.Dir = abs
+
+	} else if filepath.IsAbs(up.VideoPackage) {
+		// a specified executable
+		cmd := up.VideoPackage
+		if tool != "ffmpeg" {
+			cmd = filepath.Join(filepath.Dir(cmd), tool)
+		}
+		c = up.niceCommand(cmd, arg...)
 		c.Dir = abs
 
 	} else {
@@ -182,11 +332,16 @@ func (up *Uploader) ffmpeg(arg ...string) error {
 		volume := abs + ":/uploader"
 
 		// run FFmpeg in a Docker container
-		dockerArgs := []string{"run", "-v", volume, "-w", "/uploader", up.VideoPackage}
+		dockerArgs := []string{"run", "-v", volume, "-w", "/uploader"}
+		if tool != "ffmpeg" {
+			dockerArgs = append(dockerArgs, "--entrypoint", tool)
+		}
+		dockerArgs = append(dockerArgs, up.VideoPackage)
 		dockerArgs = append(dockerArgs, arg...)
 
 		c = exec.Command("docker", dockerArgs...)
 	}
+	c.Stdout = out
 	c.Stderr = up.errorLog.Writer()
 	return c.Run()
 }
@@ -210,16 +365,58 @@ func (up *Uploader) videoWorker(
 	for {
 		select {
 		case req := <-chConvert:
+			up.convertRequest(req)
 
-			// convert video
-			if err := up.convert(req.file, ".mp4"); err != nil {
-				up.errorLog.Print(err.Error())
+		case <-done:
+			// finish pending requests
+			for {
+				select {
+				case req := <-chConvert:
+					up.convertRequest(req)
+				default:
+					up.wgVideos.Done()
+					return
+				}
 			}
-			up.opDone(req.tx)
+		}
+	}
+}
 
-		case <-done:
-			// ## do something to finish other pending requests
-			return
+// convertRequest converts a video, and adds an HLS rendition.
+func (up *Uploader) convertRequest(req reqConvert) {
+
+	up.setProgress(req.tx, req.name, StateConverting, -1, 0)
+	ended := up.startConversion(req.file)
+	progress := func(percent int) {
+		up.setProgress(req.tx, req.name, StateConverting, -1, percent)
+	}
+	var err error
+	var saved string
+	if req.audio {
+		saved = strings.TrimSuffix(req.file, rawAudio)
+		err = up.normaliseAudio(req.file, progress)
+
+	} else {
+		if !req.stream {
+			err = up.convertVideo(req.file, progress)
+		}
+		video := changeExt(req.file, ".mp4")
+		if err == nil {
+			err = up.saveStream(video)
 		}
+		saved = up.streamName(video)
+	}
+	ended()
+	if err != nil && up.retryConversion(req, err) {
+		return // still in progress
+	}
+
+	if err != nil {
+		up.errorLog.Print(err.Error())
+	} else if req.hash != "" {
+		up.toCache(req.hash, saved)
 	}
+	up.doneProgress(req.tx, req.name, err)
+	up.opDone(req.tx)
+	up.endRetry(req.retry)
 }
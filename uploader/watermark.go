@@ -0,0 +1,131 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Watermarks on processed images and converted videos.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermark positions.
+const (
+	BottomRight = iota
+	BottomLeft
+	TopRight
+	TopLeft
+	Centre
+)
+
+const watermarkFile = ".watermark.png" // copy for FFmpeg, in the upload directory
+
+// Watermark specifies an image, such as a logo with a transparent background, to be overlaid on media.
+type Watermark struct {
+	Path     string  // image file
+	Position int     // BottomRight, BottomLeft, TopRight, TopLeft or Centre
+	Opacity  float64 // 0 to 1 (0 for opaque)
+	Width    float64 // width as a fraction of the media width (0 for 0.2)
+	Margin   int     // pixels from the edges
+}
+
+// loadWatermark reads the watermark image, with its opacity applied, and saves a copy for video conversions.
+func (up *Uploader) loadWatermark() error {
+
+	wm := up.Watermark
+	if wm.Opacity <= 0 || wm.Opacity > 1 {
+		wm.Opacity = 1
+	}
+	if wm.Width <= 0 || wm.Width > 1 {
+		wm.Width = 0.2
+	}
+
+	img, err := imaging.Open(wm.Path)
+	if err != nil {
+		return err
+	}
+
+	// apply opacity to the image's transparency
+	sz := img.Bounds().Size()
+	up.watermark = imaging.Overlay(imaging.New(sz.X, sz.Y, color.NRGBA{}), img, image.Pt(0, 0), wm.Opacity)
+
+	if up.VideoPackage != "" {
+		return imaging.Save(up.watermark, filepath.Join(up.tempPath(), watermarkFile))
+	}
+	return nil
+}
+
+// watermarkImage returns an image with the watermark overlaid, or the original image if there is no watermark.
+func (up *Uploader) watermarkImage(img image.Image) image.Image {
+
+	if up.watermark == nil {
+		return img
+	}
+
+	sz := img.Bounds().Size()
+	w := int(float64(sz.X) * up.Watermark.Width)
+	if w < 1 {
+		return img
+	}
+	wm := imaging.Resize(up.watermark, w, 0, imaging.Lanczos)
+	wsz := wm.Bounds().Size()
+
+	// position
+	m := up.Watermark.Margin
+	var pos image.Point
+	switch up.Watermark.Position {
+	case BottomLeft:
+		pos = image.Pt(m, sz.Y-wsz.Y-m)
+	case TopRight:
+		pos = image.Pt(sz.X-wsz.X-m, m)
+	case TopLeft:
+		pos = image.Pt(m, m)
+	case Centre:
+		pos = image.Pt((sz.X-wsz.X)/2, (sz.Y-wsz.Y)/2)
+	default:
+		pos = image.Pt(sz.X-wsz.X-m, sz.Y-wsz.Y-m)
+	}
+
+	return imaging.Overlay(img, wm, pos.Add(img.Bounds().Min), 1)
+}
+
+// watermarkFilter returns an FFmpeg filter graph to overlay the watermark, as the second input, on a video stream, such as "[0]".
+// It returns an empty string if there is no watermark.
+func (up *Uploader) watermarkFilter(video string) string {
+
+	if up.watermark == nil {
+		return ""
+	}
+
+	// copy may have been lost, e.g. by a migration to a new location
+	if _, err := os.Stat(filepath.Join(up.tempPath(), watermarkFile)); err != nil {
+		if err = imaging.Save(up.watermark, filepath.Join(up.tempPath(), watermarkFile)); err != nil {
+			up.errorLog.Print(err.Error())
+			return ""
+		}
+	}
+
+	// position
+	m := up.Watermark.Margin
+	var x, y string
+	switch up.Watermark.Position {
+	case BottomLeft:
+		x, y = fmt.Sprint(m), fmt.Sprintf("H-h-%d", m)
+	case TopRight:
+		x, y = fmt.Sprintf("W-w-%d", m), fmt.Sprint(m)
+	case TopLeft:
+		x, y = fmt.Sprint(m), fmt.Sprint(m)
+	case Centre:
+		x, y = "(W-w)/2", "(H-h)/2"
+	default:
+		x, y = fmt.Sprintf("W-w-%d", m), fmt.Sprintf("H-h-%d", m)
+	}
+
+	// scale the watermark relative to the video, and overlay it
+	return fmt.Sprintf("[1]%sscale2ref=w=main_w*%g:h=ow*ih/iw[wm][v];[v][wm]overlay=%s:%s", video, up.Watermark.Width, x, y)
+}
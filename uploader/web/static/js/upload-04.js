@@ -0,0 +1,187 @@
+// Copyright © Rob Burke inchworks.com, 2020.
+
+// Client-side functions to upload media files (audio, images and videos).
+
+// Upload file specified for uploading.
+// If maxW and maxH are specified, images that are too large are downscaled before upload,
+// and the original dimensions are sent for the server to check.
+function uploadFile($inp, token, maxUpload, timestamp, $btnSubmit, maxW, maxH) {
+
+    var fileName = $inp.val().split("\\").pop();
+    var file = $inp[0].files[0];
+    var $slide = $inp.closest(".childForm")
+
+    // disable submit button
+    $btnSubmit.prop("disabled", true);
+
+    // show file name in form entry, as confirmation to user ..
+    $inp.siblings(".upload-text").addClass("selected").html(fileName);
+
+    // set file name in hidden field, so we can match the image to the slide
+    $inp.closest(".media").children(".mediaName").val(fileName);
+
+    // clear previous status
+    reset($slide);
+
+    if (maxW && maxH && (file.type == "image/jpeg" || file.type == "image/png")) {
+        downscale(file, maxW, maxH, function(blob, width, height) {
+            if (blob)
+                send($slide, token, maxUpload, timestamp, blob, fileName, width, height);
+            else
+                send($slide, token, maxUpload, timestamp, file, fileName, 0, 0);
+        });
+    } else {
+        send($slide, token, maxUpload, timestamp, file, fileName, 0, 0);
+    }
+}
+
+// Downscale an image to fit within the limits, calling done with the new image and original dimensions.
+// The image is null if no downscaling is needed, or the browser cannot do it.
+function downscale(file, maxW, maxH, done) {
+
+    var url = URL.createObjectURL(file);
+    var img = new Image();
+
+    img.onload = function() {
+        URL.revokeObjectURL(url);
+        var w = img.naturalWidth, h = img.naturalHeight;
+        var scale = Math.min(maxW / w, maxH / h);
+        if (scale >= 1) {
+            done(null, 0, 0);
+            return;
+        }
+
+        var canvas = document.createElement("canvas");
+        canvas.width = Math.round(w * scale);
+        canvas.height = Math.round(h * scale);
+        canvas.getContext("2d").drawImage(img, 0, 0, canvas.width, canvas.height);
+        canvas.toBlob(function(blob) { done(blob, w, h); }, file.type, 0.9);
+    };
+    img.onerror = function() {
+        URL.revokeObjectURL(url);
+        done(null, 0, 0);
+    };
+    img.src = url;
+}
+
+// Send file, or downscaled image, to server.
+function send($slide, token, maxUpload, timestamp, file, fileName, width, height) {
+
+    // check file size (rounding to nearest MB)
+    var sz = (file.size + (1 << 19)) >> 20
+    if (sz > maxUpload) {
+         uploadRejected($slide, "This file is " + sz + " MB, " + maxUpload + " MB is allowed");
+         return;
+    }
+
+    // show progress and status
+    $slide.find(".upload").show();
+
+    // upload file with AJAX
+    var fd = new FormData();
+    fd.append('csrf_token', token);
+    fd.append('timestamp', timestamp);
+    fd.append('media', file, fileName);
+    if (width > 0) {
+        fd.append('width', width);
+        fd.append('height', height);
+    }
+
+    // optional snapshot time for a video thumbnail, in seconds, chosen by the user
+    var snapshot = $slide.find(".mediaSnapshot").val();
+    if (snapshot) {
+        fd.append('snapshot', snapshot);
+    }
+
+    $.ajax({
+        url: '/upload',  
+        type: 'POST',
+        data: fd,
+        dataType: 'json',
+        success:function(reply, rqStatus, jq){ uploaded($slide, reply, rqStatus) },
+        error:function(jq, rqStatus, error){ uploadFailed($slide, rqStatus, error) },
+        cache: false,
+        contentType: false,
+        processData: false,
+        xhr: function() { return xhrWithProgress($slide); }
+    });
+}
+
+// XHR object with progress monitoring.
+function xhrWithProgress($slide) {
+    var xhr = $.ajaxSettings.xhr();
+    var $p = $slide.find(".progress-bar");
+    xhr.upload.onprogress = function (e) {
+        if (e.lengthComputable) {
+            var percent = (e.loaded / e.total) * 100;
+            $p.width(percent + '%');
+        }
+    };
+    return xhr;	
+}
+
+// Event handler for upload request done.
+function uploaded($slide, reply, rqStatus) {
+    var $alert = $slide.find(".upload-status")
+    if (reply.error == "") {
+        setStatus($alert, "uploaded", "alert-success");
+
+        // the server may have renamed the upload, to avoid a duplicate name
+        if (reply.name)
+            $slide.find(".mediaName").val(reply.name);
+    }
+
+    else {
+        // rejected by server - discard filename
+        setStatus($alert, reply.error, "alert-danger");
+        $slide.find(".mediaName").val("");
+    }
+
+    // re-enable submit button
+    $("#submit").prop("disabled", false);
+}
+
+// Event handler for upload failed.
+function uploadFailed($slide, rqStatus, error) {
+    var $alert = $slide.find(".upload-status")
+    setStatus($alert, rqStatus + " : " + error, "alert-danger")
+
+    // discard filename, so client doesn't claim to have uploaded it
+    $slide.find(".mediaName").val("");
+
+    // re-enable submit button
+    $("#submit").prop("disabled", false);
+}
+
+// Upload rejected.
+function uploadRejected($slide, error) {
+    var $badFile = $slide.find(".bad-file");
+    $badFile.text(error);
+    $badFile.show();
+
+    // discard filename, so client doesn't claim to have uploaded it
+    $slide.find(".mediaName").val("");
+
+    // re-enable submit button
+    $("#submit").prop("disabled", false);
+}
+
+// Reset upload bar and status fields.
+function reset($slide) {
+    $slide.find(".upload").hide();
+    $slide.find(".progress-bar").width(0);
+
+    var $alert = $slide.find(".upload-status")
+    $alert.text("");
+    $alert.removeClass("alert-success alert-danger");
+
+    var $badFile = $slide.find(".bad-file");
+    $badFile.text("");
+    $badFile.hide();
+}
+
+// Set upload status.
+function setStatus($alert, status, highlight) {
+    $alert.text(status);
+    $alert.addClass(highlight);
+}
@@ -0,0 +1,197 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package uploader
+
+// Delivery of media events to external systems.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// webhook delivery parameters
+const (
+	webhookQueue    = 100 // events waiting for delivery
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// eventNames are the names of media events, as sent by a Webhook.
+var eventNames = []string{"uploaded", "processed", "bound", "replaced", "deleted", "failed"}
+
+// Webhook posts media events as JSON to an external system, such as to purge a CDN or update a search index.
+// Start it, and add its Send method to the uploader with Subscribe.
+// Events are delivered in the background, with retries, and are dropped if the receiver cannot keep up.
+type Webhook struct {
+	URL      string
+	Events   []int       // events to be sent (empty for all)
+	Secret   string      // optional key to sign the body with HMAC-SHA256, in header X-Webparts-Signature
+	ErrorLog *log.Logger // optional
+
+	client *http.Client
+	ch     chan *MediaEvent
+	chDone chan bool // closed to stop delivery, so that late events are not sent on a closed channel
+}
+
+// webhookEvent is the JSON body for an event.
+type webhookEvent struct {
+	Event  string    `json:"event"`
+	At     time.Time `json:"at"`
+	Tx     string    `json:"tx,omitempty"`
+	Parent int64     `json:"parent,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	File   string    `json:"file,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Subscribe adds a function to be called for each media event, in addition to MediaEvents.
+// It must be called before Initialise.
+func (up *Uploader) Subscribe(fn func(e *MediaEvent)) {
+	up.subscribers = append(up.subscribers, fn)
+}
+
+// Start begins delivery of events.
+func (wh *Webhook) Start() {
+
+	wh.client = &http.Client{Timeout: webhookTimeout}
+	wh.ch = make(chan *MediaEvent, webhookQueue)
+	wh.chDone = make(chan bool)
+	go wh.deliver()
+}
+
+// Stop ends delivery of events. Events not yet delivered, and any sent later, are discarded.
+func (wh *Webhook) Stop() {
+	close(wh.chDone)
+}
+
+// Send queues an event for delivery, if it is one of the selected events.
+func (wh *Webhook) Send(e *MediaEvent) {
+
+	if !wh.selected(e.Event) {
+		return
+	}
+	ev := *e // the caller may reuse the event
+	select {
+	case <-wh.chDone:
+		// stopped
+	case wh.ch <- &ev:
+	default:
+		wh.log(fmt.Errorf("webhook %s: queue full, event dropped", wh.URL))
+	}
+}
+
+// deliver posts queued events.
+func (wh *Webhook) deliver() {
+
+	for {
+		var e *MediaEvent
+		select {
+		case e = <-wh.ch:
+		case <-wh.chDone:
+			return
+		}
+
+		body, err := json.Marshal(webhookEvent{
+			Event:  eventName(e.Event),
+			At:     e.At,
+			Tx:     txString(e.Tx),
+			Parent: e.Parent,
+			Name:   e.Name,
+			File:   e.File,
+			Detail: e.Detail,
+		})
+		if err != nil {
+			wh.log(err)
+			continue
+		}
+
+		for i := 0; i < webhookAttempts; i++ {
+			if i > 0 {
+				select {
+				case <-time.After(time.Second << (i - 1)):
+				case <-wh.chDone:
+					return
+				}
+			}
+			if err = wh.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			wh.log(fmt.Errorf("webhook %s: %s", wh.URL, err.Error()))
+		}
+	}
+}
+
+// post sends an event, signed if a secret is configured.
+func (wh *Webhook) post(body []byte) error {
+
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Webparts-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// log reports an error, if a log is configured.
+func (wh *Webhook) log(err error) {
+	if wh.ErrorLog != nil {
+		wh.ErrorLog.Print(err.Error())
+	}
+}
+
+// selected returns true if an event is to be sent.
+func (wh *Webhook) selected(event int) bool {
+
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// eventName returns the name for an event.
+func eventName(event int) string {
+
+	if event < 0 || event >= len(eventNames) {
+		return "unknown"
+	}
+	return eventNames[event]
+}
+
+// txString formats a transaction ID, or returns an empty string if there isn't one.
+func txString(tx etx.TxId) string {
+
+	if tx == 0 {
+		return ""
+	}
+	return etx.String(tx)
+}
@@ -52,30 +52,37 @@ func (u *Users) canSignup(username string) (*User, error) {
 }
 
 // forEditUsers returns data to edit users in a form.
-func (u *Users) forEditUsers(token string) *UsersForm {
+// If mgr is not nil, only users with the same Parent as the administrator are included.
+func (u *Users) forEditUsers(mgr *User, token string) *UsersForm {
 
 	// serialisation
 	defer u.App.Serialise(false)()
 
 	// users
-	users := u.Store.ByName()
+	users := u.managed(mgr)
 
 	// form
 	var d = make(url.Values)
 	f := u.NewUsersForm(d, token)
 
-	// add template and users to form
+	// add template and users to form, with custom fields
 	f.AddTemplate()
-	for i, u := range users {
-		f.Add(i, u)
+	f.Children[0].Fields = u.fieldInputs(nil, false)
+	for i, usr := range users {
+		f.Add(i, usr)
+		f.Children[i+1].Fields = u.fieldInputs(u.fieldValues(usr.Id), false)
 	}
+	f.SetVersion(users)
 
 	return f
 }
 
 // onEditUsers processes returned form data. Returns an extended transaction ID if there are no errors (client or server).
+// If users have been changed by someone else since the form was rendered, no changes are made,
+// and the IDs of the changed users are returned instead.
+// If mgr is not nil, only users with the same Parent as the administrator are changed, and new users are given that Parent.
 // ## Why not take the whole form?
-func (ua *Users) onEditUsers(usSrc []*UserFormData) etx.TxId {
+func (ua *Users) onEditUsers(mgr *User, usSrc []*UserFormData, version string) (etx.TxId, map[int64]bool) {
 
 	app := ua.App
 
@@ -90,10 +97,15 @@ func (ua *Users) onEditUsers(usSrc []*UserFormData) etx.TxId {
 	iDest := 0
 
 	// compare modified users against current users, and update
-	usDest := ua.Store.ByName()
+	usDest := ua.managed(mgr)
 	nSrc := len(usSrc)
 	nDest := len(usDest)
 
+	// check that the users haven't been changed by someone else
+	if changed := conflicts(usSrc, usDest, version); changed != nil {
+		return 0, changed
+	}
+
 	for iSrc < nSrc || iDest < nDest {
 
 		if iSrc == nSrc {
@@ -111,7 +123,13 @@ func (ua *Users) onEditUsers(usSrc []*UserFormData) etx.TxId {
 				Status:   usSrc[iSrc].Status,
 				Password: []byte(""),
 			}
+			if mgr != nil {
+				u.Parent = mgr.Parent
+			}
 			ua.Store.Update(&u)
+			if err := ua.setFieldValues(u.Id, inputValues(usSrc[iSrc].Fields, nil)); err != nil {
+				ua.App.Log(err)
+			}
 			iSrc++
 
 		} else {
@@ -136,7 +154,17 @@ func (ua *Users) onEditUsers(usSrc []*UserFormData) etx.TxId {
 					uDest.Role = uSrc.Role
 					uDest.Status = uSrc.Status
 					if err := ua.Store.Update(uDest); err != nil {
-						return 0 // unexpected database error
+						return 0, nil // unexpected database error
+					}
+				}
+
+				// check if custom fields changed
+				if len(uSrc.Fields) > 0 {
+					current := ua.fieldValues(uDest.Id)
+					if values := inputValues(uSrc.Fields, current); !sameValues(values, current) {
+						if err := ua.setFieldValues(uDest.Id, values); err != nil {
+							ua.App.Log(err)
+						}
 					}
 				}
 				iSrc++
@@ -145,18 +173,70 @@ func (ua *Users) onEditUsers(usSrc []*UserFormData) etx.TxId {
 			} else {
 				// out of sequence team index
 				app.Rollback()
-				return 0
+				return 0, nil
 			}
 		}
 	}
 
-	return tx
+	return tx, nil
+}
+
+// conflicts returns the IDs of users changed by someone else since the form was rendered, or nil if there are none.
+// The map may be empty if the only change is a user deleted by someone else.
+// Forms without version stamps are not checked.
+func conflicts(usSrc []*UserFormData, usDest []*User, version string) map[int64]bool {
+
+	if version == "" {
+		return nil
+	}
+
+	// current users by ID
+	current := make(map[int64]*User, len(usDest))
+	for _, u := range usDest {
+		current[u.Id] = u
+	}
+
+	changed := make(map[int64]bool)
+	conflict := false
+
+	// edited users must be unchanged, and in the same position
+	submitted := make(map[int64]bool, len(usSrc))
+	for _, uSrc := range usSrc {
+		if uSrc.ChildIndex < 0 || uSrc.NUser == 0 {
+			continue // template or new user
+		}
+		submitted[uSrc.NUser] = true
+
+		uDest := current[uSrc.NUser]
+		if uDest == nil {
+			conflict = true // deleted by someone else
+
+		} else if uSrc.ChildIndex >= len(usDest) || usDest[uSrc.ChildIndex].Id != uSrc.NUser ||
+			userVersion(uDest) != uSrc.Version {
+			changed[uSrc.NUser] = true
+		}
+	}
+
+	// users added or removed
+	if usersVersion(usDest) != version {
+		conflict = true
+		for _, u := range usDest {
+			if !submitted[u.Id] {
+				changed[u.Id] = true // added by someone else (or deleted on this form)
+			}
+		}
+	}
+
+	if conflict || len(changed) > 0 {
+		return changed
+	}
+	return nil
 }
 
 // onUserSignup processes a sigup request.
 //
 // #### Assumes serialisation started earlier
-func (u *Users) onUserSignup(user *User, name string, password string) error {
+func (u *Users) onUserSignup(user *User, name string, password string, values FieldValues) error {
 
 	// serialisation
 	// #### should serialise from call to CanSignup
@@ -168,5 +248,8 @@ func (u *Users) onUserSignup(user *User, name string, password string) error {
 	user.Status = UserActive
 	user.Created = time.Now()
 
-	return u.Store.Update(user)
+	if err := u.Store.Update(user); err != nil {
+		return err
+	}
+	return u.setFieldValues(user.Id, values)
 }
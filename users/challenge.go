@@ -0,0 +1,217 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Challenges to resist automated abuse of the sign-up form.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inchworks/webparts/multiforms"
+)
+
+// Challenge is an optional interface to check that a sign-up request comes from a person and not a bot.
+type Challenge interface {
+	// Issue adds challenge data to the sign-up form.
+	Issue(r *http.Request, f *multiforms.Form)
+
+	// Verify checks the response returned with the sign-up form.
+	Verify(r *http.Request, f *multiforms.Form) error
+}
+
+// ProofOfWork is a built-in challenge, requiring the browser to find a hash with a number of leading zero bits.
+// The calculation is done by signup-pow-01.js, which is included by the sign-up template when needed.
+type ProofOfWork struct {
+	Key        []byte        // secret key for signing challenges (required)
+	Difficulty int           // leading zero bits required, e.g. 18
+	MaxAge     time.Duration // time allowed to complete the form (default 20 minutes)
+
+	// challenges used, until they expire
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// SiteVerify is a challenge verified by a third-party service, such as hCaptcha or Cloudflare Turnstile.
+// The site must override the "signupChallenge" template to add the service's widget, using the form's "siteKey" value.
+type SiteVerify struct {
+	SiteKey  string // public key for the widget
+	Secret   string // secret key for verification
+	URL      string // verification endpoint, e.g. https://hcaptcha.com/siteverify
+	Response string // form field for the widget's response, e.g. "h-captcha-response"
+
+	Client *http.Client // optional client for verification requests
+}
+
+var (
+	errChallenge = errors.New("webparts/users: challenge failed")
+	errNoKey     = errors.New("webparts/users: ProofOfWork requires a Key")
+)
+
+// Issue adds a signed challenge to the form. Without a key, no challenge is issued, and verification will fail.
+func (pw *ProofOfWork) Issue(r *http.Request, f *multiforms.Form) {
+
+	if len(pw.Key) == 0 {
+		return
+	}
+
+	salt := make([]byte, 12)
+	rand.Read(salt)
+
+	c := base64.RawURLEncoding.EncodeToString(salt) + "." +
+		strconv.FormatInt(time.Now().Unix(), 36) + "." +
+		strconv.Itoa(pw.Difficulty)
+
+	f.Set("powChallenge", c+"."+pw.sign(c))
+}
+
+// Verify checks the challenge signature and age, and the browser's solution. Each challenge may be used only once.
+func (pw *ProofOfWork) Verify(r *http.Request, f *multiforms.Form) error {
+
+	if len(pw.Key) == 0 {
+		return errNoKey
+	}
+
+	c := f.Get("powChallenge")
+	ps := strings.Split(c, ".")
+	if len(ps) != 4 {
+		return errChallenge
+	}
+
+	// challenge must be ours ..
+	signed := strings.Join(ps[:3], ".")
+	if !hmac.Equal([]byte(ps[3]), []byte(pw.sign(signed))) {
+		return errChallenge
+	}
+
+	// .. and recent
+	issued, err := strconv.ParseInt(ps[1], 36, 64)
+	if err != nil {
+		return errChallenge
+	}
+	expires := time.Unix(issued, 0).Add(pw.maxAge())
+	if time.Now().After(expires) {
+		return errChallenge
+	}
+
+	// check work done
+	h := sha256.Sum256([]byte(c + ":" + f.Get("powNonce")))
+	if leadingZeros(h[:]) < pw.Difficulty {
+		return errChallenge
+	}
+
+	// and not used before
+	if !pw.use(ps[0], expires) {
+		return errChallenge
+	}
+	return nil
+}
+
+// maxAge returns the time allowed to complete the form.
+func (pw *ProofOfWork) maxAge() time.Duration {
+
+	if pw.MaxAge == 0 {
+		return 20 * time.Minute
+	}
+	return pw.MaxAge
+}
+
+// sign returns an HMAC for a challenge.
+func (pw *ProofOfWork) sign(c string) string {
+
+	mac := hmac.New(sha256.New, pw.Key)
+	mac.Write([]byte(c))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// use records a challenge, identified by its salt, until it expires. It returns false if the challenge has been used already.
+func (pw *ProofOfWork) use(salt string, expires time.Time) bool {
+
+	// SERIALISED
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.used == nil {
+		pw.used = make(map[string]time.Time)
+	}
+	if _, seen := pw.used[salt]; seen {
+		return false
+	}
+
+	// forget expired challenges
+	now := time.Now()
+	for s, exp := range pw.used {
+		if now.After(exp) {
+			delete(pw.used, s)
+		}
+	}
+
+	pw.used[salt] = expires
+	return true
+}
+
+// Issue adds the site key to the form, for the widget.
+func (sv *SiteVerify) Issue(r *http.Request, f *multiforms.Form) {
+	f.Set("siteKey", sv.SiteKey)
+}
+
+// Verify asks the service to check the widget's response.
+func (sv *SiteVerify) Verify(r *http.Request, f *multiforms.Form) error {
+
+	resp := f.Get(sv.Response)
+	if resp == "" {
+		return errChallenge
+	}
+
+	client := sv.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	rsp, err := client.PostForm(sv.URL, url.Values{
+		"secret":   {sv.Secret},
+		"response": {resp},
+		"remoteip": {ip},
+	})
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errChallenge
+	}
+	return nil
+}
+
+// leadingZeros returns the number of leading zero bits in a hash.
+func leadingZeros(h []byte) int {
+
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,230 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Periodic digest of account events, emailed to administrators.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+const (
+	opDigest     = 0  // operation type
+	digestListed = 20 // maximum accounts listed for each event
+)
+
+// OpDigest is the logged operation to send the next digest, so that the schedule survives a restart.
+type OpDigest struct {
+	From time.Time // start of period
+	Due  time.Time // end of period, when the digest is sent
+}
+
+// Name returns the resource manager name, for the redo log.
+// Users is a resource manager for the digest, and must be passed to etx.TM.Recover if DigestEvery is set.
+func (u *Users) Name() string {
+	return "webparts.users"
+}
+
+// ForOperation returns an operation struct to receive unmarshalled data.
+func (u *Users) ForOperation(opType int) etx.Op {
+	return &OpDigest{}
+}
+
+// Operation schedules the digest, on start-up or after the previous one has been sent.
+func (u *Users) Operation(id etx.TxId, opType int, op etx.Op) {
+
+	opD := op.(*OpDigest)
+
+	// SERIALISED
+	u.muDigest.Lock()
+	u.digestTx = id
+	u.muDigest.Unlock()
+
+	delay := time.Until(opD.Due)
+	if delay < 0 {
+		delay = 0 // overdue after a restart
+	}
+	time.AfterFunc(delay, func() { u.sendDigest(id, opD) })
+}
+
+// StartDigest starts the schedule of digests to administrators, if DigestEvery is set.
+// Call it after etx.TM.Recover, which resumes a schedule that has already been started.
+func (u *Users) StartDigest() error {
+
+	if u.DigestEvery <= 0 || u.Mailer == nil {
+		return nil
+	}
+
+	// SERIALISED
+	u.muDigest.Lock()
+	started := u.digestTx != 0
+	u.muDigest.Unlock()
+	if started {
+		return nil
+	}
+
+	now := time.Now()
+	return u.nextDigest(0, &OpDigest{From: now, Due: now.Add(u.DigestEvery)})
+}
+
+// countFailedLogin records a failed log-in for the digest, noting the highest number in an hour.
+func (u *Users) countFailedLogin() {
+
+	if u.DigestEvery <= 0 {
+		return
+	}
+
+	// SERIALISED
+	u.muDigest.Lock()
+	defer u.muDigest.Unlock()
+
+	hour := time.Now().Truncate(time.Hour)
+	if !hour.Equal(u.failedHour) {
+		u.failedHour = hour
+		u.failedInHour = 0
+	}
+	u.failedInHour++
+	u.failed++
+	if u.failedInHour > u.failedPeak {
+		u.failedPeak = u.failedInHour
+	}
+}
+
+// digest compiles the summary of account events for a period.
+func (u *Users) digest(from time.Time, to time.Time) string {
+
+	// failed log-ins since the last digest (not kept over a restart)
+	u.muDigest.Lock()
+	failed, peak := u.failed, u.failedPeak
+	u.failed, u.failedPeak, u.failedInHour = 0, 0, 0
+	u.muDigest.Unlock()
+
+	// SERIALISED
+	var signups, suspended, invited []*User
+	func() {
+		defer u.App.Serialise(false)()
+
+		for _, user := range u.Store.ByName() {
+			switch user.Status {
+			case UserSuspended:
+				suspended = append(suspended, user)
+			case UserKnown:
+				invited = append(invited, user)
+			case UserActive:
+				if !user.Created.Before(from) {
+					signups = append(signups, user)
+				}
+			}
+		}
+	}()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Account summary from %s to %s.\n", from.Format("2 Jan 2006 15:04"), to.Format("2 Jan 2006 15:04 MST"))
+
+	listUsers(&b, "New sign-ups", signups)
+	fmt.Fprintf(&b, "\nFailed log-ins: %d", failed)
+	if failed > 0 {
+		fmt.Fprintf(&b, " (at most %d in one hour)", peak)
+	}
+	b.WriteString("\n")
+	listUsers(&b, "Suspended accounts", suspended)
+	listUsers(&b, "Invitations not yet accepted", invited)
+
+	return b.String()
+}
+
+// digestRole returns the minimum role for users to receive the digest.
+func (u *Users) digestRole() int {
+
+	switch {
+	case u.DigestRole > 0:
+		return u.DigestRole
+	case u.AdminRole > 0:
+		return u.AdminRole
+	default:
+		return len(u.Roles) - 1 // highest role
+	}
+}
+
+// nextDigest logs the operation for the next digest, ending the transaction for the previous one.
+func (u *Users) nextDigest(prev etx.TxId, op *OpDigest) error {
+
+	// SERIALISED
+	commit := u.App.Serialise(true)
+	tx := u.TM.Begin()
+	err := u.TM.SetNext(tx, u, opDigest, op)
+	if err == nil && prev != 0 {
+		err = u.TM.End(prev)
+	}
+	if err != nil {
+		u.App.Rollback()
+	}
+	commit()
+
+	if err != nil {
+		return err
+	}
+	u.TM.DoNext(tx)
+	return nil
+}
+
+// sendDigest emails the digest to administrators, and schedules the next one.
+func (u *Users) sendDigest(id etx.TxId, op *OpDigest) {
+
+	if u.Mailer != nil {
+		body := u.digest(op.From, op.Due)
+		minRole := u.digestRole()
+
+		var admins []*User
+		func() {
+			defer u.App.Serialise(false)()
+			for _, user := range u.Store.ByName() {
+				if user.Status == UserActive && user.Role >= minRole {
+					admins = append(admins, user)
+				}
+			}
+		}()
+
+		for _, admin := range admins {
+			if err := u.Mailer.Send(admin.Username, "Account summary", "Hello "+admin.Name+",\n\n"+body); err != nil {
+				u.App.Log(err)
+			}
+		}
+	}
+
+	// stop if digests are no longer configured
+	if u.DigestEvery <= 0 {
+		defer u.App.Serialise(true)()
+		if err := u.TM.End(id); err != nil {
+			u.App.Log(err)
+		}
+		return
+	}
+
+	// the next period starts where this one ended, unless the server has been stopped for longer
+	from := op.Due
+	due := from.Add(u.DigestEvery)
+	if now := time.Now(); due.Before(now) {
+		due = now.Add(u.DigestEvery)
+	}
+	if err := u.nextDigest(id, &OpDigest{From: from, Due: due}); err != nil {
+		u.App.Log(err)
+	}
+}
+
+// listUsers adds a count and list of accounts to the digest.
+func listUsers(b *strings.Builder, title string, users []*User) {
+
+	fmt.Fprintf(b, "\n%s: %d\n", title, len(users))
+	for i, user := range users {
+		if i == digestListed {
+			fmt.Fprintf(b, "  .. and %d more\n", len(users)-i)
+			break
+		}
+		fmt.Fprintf(b, "  %s (%s)\n", user.Name, user.Username)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inchworks/webparts/etx"
+)
+
+// testApp is a minimal parent application, recording errors.
+type testApp struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (a *testApp) Authenticated(r *http.Request, id int64)                                {}
+func (a *testApp) Flash(r *http.Request, msg string)                                      {}
+func (a *testApp) GetRedirect(r *http.Request) string                                     { return "" }
+func (a *testApp) LogThreat(msg string, r *http.Request)                                  {}
+func (a *testApp) OnRemoveUser(tx etx.TxId, user *User)                                   {}
+func (a *testApp) Render(w http.ResponseWriter, r *http.Request, t string, d interface{}) {}
+func (a *testApp) Rollback()                                                              {}
+func (a *testApp) Serialise(updates bool) func()                                          { return func() {} }
+func (a *testApp) Token(r *http.Request) string                                           { return "" }
+
+func (a *testApp) Log(err error) {
+	a.mu.Lock()
+	a.errs = append(a.errs, err)
+	a.mu.Unlock()
+}
+
+// testStore holds users in memory.
+type testStore struct {
+	users []*User
+}
+
+var errNoRecord = errors.New("no record")
+
+func (s *testStore) ByName() []*User           { return s.users }
+func (s *testStore) DeleteId(id int64) error   { return nil }
+func (s *testStore) IsNoRecord(err error) bool { return err == errNoRecord }
+func (s *testStore) Name(id int64) string      { return "" }
+func (s *testStore) Rollback()                 {}
+func (s *testStore) Update(user *User) error   { return nil }
+
+func (s *testStore) Get(id int64) (*User, error) {
+	for _, user := range s.users {
+		if user.Id == id {
+			return user, nil
+		}
+	}
+	return nil, errNoRecord
+}
+
+func (s *testStore) GetNamed(username string) (*User, error) {
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, errNoRecord
+}
+
+// testMailer records emails sent.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (m *testMailer) Send(to string, subject string, body string) error {
+
+	m.mu.Lock()
+	m.sent = append(m.sent, to+": "+body)
+	m.mu.Unlock()
+	return nil
+}
+
+// TestDigest checks that digests are sent to administrators, with a single scheduled operation in the redo log.
+func TestDigest(t *testing.T) {
+
+	store, _ := etx.NewMemStore("") // no error without a snapshot
+	app := &testApp{}
+	mailer := &testMailer{}
+	u := &Users{
+		App:         app,
+		DigestEvery: 50 * time.Millisecond,
+		Mailer:      mailer,
+		Roles:       []string{"unknown", "member", "admin"},
+		Store: &testStore{users: []*User{
+			{Id: 1, Username: "admin@example.com", Name: "Admin", Role: 2, Status: UserActive},
+			{Id: 2, Username: "old@example.com", Name: "Old", Role: 1, Status: UserActive, Created: time.Now().Add(-time.Hour)},
+			{Id: 3, Username: "invited@example.com", Name: "Invited", Role: 1, Status: UserKnown},
+		}},
+		TM: etx.New(app, store),
+	}
+	if err := u.TM.Recover(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.StartDigest(); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for two digests
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mailer.mu.Lock()
+		n := len(mailer.sent)
+		mailer.mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d digests sent", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mailer.mu.Lock()
+	first := mailer.sent[0]
+	mailer.mu.Unlock()
+	if !strings.HasPrefix(first, "admin@example.com: ") {
+		t.Errorf("sent %q", first)
+	}
+	if !strings.Contains(first, "New sign-ups: 0") || !strings.Contains(first, "Invitations not yet accepted: 1") {
+		t.Errorf("digest %q", first)
+	}
+
+	// only the next digest is scheduled
+	if recs := store.ForManager(u.Name(), math.MaxInt64); len(recs) != 1 {
+		t.Errorf("redo log holds %d digests", len(recs))
+	}
+
+	app.mu.Lock()
+	for _, err := range app.errs {
+		t.Error(err)
+	}
+	app.mu.Unlock()
+}
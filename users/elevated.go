@@ -0,0 +1,164 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Time-limited elevated privileges ("sudo mode") for sensitive changes.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Limit on failed password confirmations by a user.
+const (
+	elevateAttempts = 5
+	elevateWindow   = 15 * time.Minute
+)
+
+var (
+	ErrTooManyAttempts = errors.New("webparts/users: too many password confirmations")
+
+	errNotElevated = errors.New("webparts/users: App must implement AppElevated when ElevatedFor is set")
+)
+
+// elevateFails counts failed password confirmations by a user.
+type elevateFails struct {
+	n     int
+	since time.Time
+}
+
+// AppElevated is an optional extension to App, needed if Users.ElevatedFor is set.
+type AppElevated interface {
+	// ElevatedAt returns the time the user last confirmed their password, probably from a session key
+	ElevatedAt(r *http.Request) time.Time
+
+	// SetElevated records the time the user confirmed their password, via the session
+	SetElevated(r *http.Request, at time.Time)
+
+	// UserId returns the ID of the logged-in user
+	UserId(r *http.Request) int64
+}
+
+// Elevate checks the logged-in user's password, and starts a period of elevated privileges.
+// After repeated failures, it returns ErrTooManyAttempts for a while without checking the password.
+func (u *Users) Elevate(r *http.Request, password string) error {
+
+	if u.ElevatedFor == 0 {
+		return nil // no check needed
+	}
+	app, ok := u.App.(AppElevated)
+	if !ok {
+		return errNotElevated
+	}
+	id := app.UserId(r)
+	if !u.canElevate(id) {
+		return ErrTooManyAttempts
+	}
+
+	user, err := u.Store.Get(id)
+	if err == nil {
+		err = user.authenticate(password)
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		u.failedElevate(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	// SERIALISED
+	u.muElevate.Lock()
+	delete(u.elevateFail, id)
+	u.muElevate.Unlock()
+
+	app.SetElevated(r, time.Now())
+	return nil
+}
+
+// IsElevated returns true if the user has confirmed their password recently.
+// It is always true if elevated privileges are not required, and never true if App cannot record them.
+func (u *Users) IsElevated(r *http.Request) bool {
+
+	if u.ElevatedFor == 0 {
+		return true
+	}
+	app, ok := u.App.(AppElevated)
+	if !ok {
+		return false
+	}
+
+	return time.Since(app.ElevatedAt(r)) < u.ElevatedFor
+}
+
+// canElevate returns false if a user has failed to confirm their password too often, recently.
+func (u *Users) canElevate(id int64) bool {
+
+	// SERIALISED
+	u.muElevate.Lock()
+	defer u.muElevate.Unlock()
+
+	f, ok := u.elevateFail[id]
+	if ok && time.Since(f.since) > elevateWindow {
+		delete(u.elevateFail, id)
+		return true
+	}
+	return f.n < elevateAttempts
+}
+
+// failedElevate counts a failed password confirmation.
+func (u *Users) failedElevate(id int64) {
+
+	// SERIALISED
+	u.muElevate.Lock()
+	defer u.muElevate.Unlock()
+
+	if u.elevateFail == nil {
+		u.elevateFail = make(map[int64]elevateFails)
+	}
+	f := u.elevateFail[id]
+	if f.n == 0 {
+		f.since = time.Now()
+	}
+	f.n++
+	u.elevateFail[id] = f
+}
+
+// isSensitive returns true if the changes to users include role changes, deletions, or new users with a role.
+// Users are matched by ID, and a user submitted in a different position is also sensitive,
+// because changes are applied by position.
+func (u *Users) isSensitive(mgr *User, usSrc []*UserFormData) bool {
+
+	// serialisation
+	defer u.App.Serialise(false)()
+
+	usDest := u.managed(mgr)
+	current := make(map[int64]*User, len(usDest))
+	for _, usr := range usDest {
+		current[usr.Id] = usr
+	}
+	kept := make(map[int64]bool, len(usDest))
+
+	for _, uSrc := range usSrc {
+		ix := uSrc.ChildIndex
+		if ix < 0 {
+			continue // template
+		}
+
+		uDest := current[uSrc.NUser]
+		if uDest == nil {
+			// new user, or one that will replace an existing user at the same position
+			if ix < len(usDest) || uSrc.Role > 0 {
+				return true
+			}
+			continue
+		}
+		kept[uDest.Id] = true
+		if ix >= len(usDest) || usDest[ix].Id != uDest.Id || uSrc.Role != uDest.Role {
+			return true
+		}
+	}
+
+	// deletions
+	return len(kept) < len(usDest)
+}
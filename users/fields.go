@@ -0,0 +1,262 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Custom profile fields for users, defined by the application.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/inchworks/webparts/multiforms"
+)
+
+// Types of custom field.
+const (
+	FieldText = iota
+	FieldNumber
+	FieldPhone
+	FieldEmail
+)
+
+var (
+	phoneRX = regexp.MustCompile(`^\+?[0-9][0-9 ()-]{4,20}$`)
+	emailRX = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+// Field specifies an application-defined profile field for users, such as a membership number.
+// The name is used for form inputs, and must not clash with the names used by this package's forms.
+type Field struct {
+	Name     string         // key for storage and form input
+	Label    string         // for display
+	Type     int            // FieldText, FieldNumber, FieldPhone or FieldEmail
+	Required bool           // value needed
+	Max      int            // maximum characters (default MaxName)
+	Pattern  *regexp.Regexp // optional validation
+	Signup   bool           // requested on the sign-up form, as well as on the form to edit users
+}
+
+// FieldStore is an optional extension to UserStore, to hold custom field values for each user.
+// It is needed if Users.Fields are specified.
+type FieldStore interface {
+	Fields(userId int64) (map[string]string, error)         // custom field values for user
+	SetFields(userId int64, values map[string]string) error // replace custom field values for user
+}
+
+// FieldValues holds custom field values for a user, with typed accessors.
+type FieldValues map[string]string
+
+// FieldInput holds a custom field and its value, for display on a form.
+type FieldInput struct {
+	Field
+	Value string
+}
+
+// Int returns the value of a number field, and false if it is not set.
+func (fv FieldValues) Int(name string) (int64, bool) {
+
+	n, err := strconv.ParseInt(fv[name], 10, 64)
+	return n, err == nil
+}
+
+// String returns the value of a field, or an empty string if it is not set.
+func (fv FieldValues) String(name string) string {
+	return fv[name]
+}
+
+// Check returns a message if a value is not valid for the field, or an empty string.
+func (f *Field) Check(value string) string {
+
+	if value == "" {
+		if f.Required {
+			return "Cannot be blank"
+		}
+		return ""
+	}
+
+	max := f.Max
+	if max == 0 {
+		max = MaxName
+	}
+	if utf8.RuneCountInString(value) > max {
+		return fmt.Sprintf("Too long (maximum %d characters)", max)
+	}
+
+	switch f.Type {
+	case FieldNumber:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "Must be a whole number"
+		}
+
+	case FieldPhone:
+		if !phoneRX.MatchString(value) {
+			return "Not a phone number"
+		}
+
+	case FieldEmail:
+		if !emailRX.MatchString(value) {
+			return "Not an email address"
+		}
+	}
+
+	if f.Pattern != nil && !f.Pattern.MatchString(value) {
+		return "Invalid value"
+	}
+	return ""
+}
+
+// InputType returns the HTML input type for a field.
+func (f *Field) InputType() string {
+
+	switch f.Type {
+	case FieldNumber:
+		return "number"
+	case FieldPhone:
+		return "tel"
+	case FieldEmail:
+		return "email"
+	default:
+		return "text"
+	}
+}
+
+// FieldValues returns the custom field values for a user.
+func (u *Users) FieldValues(user *User) FieldValues {
+
+	// serialisation
+	defer u.App.Serialise(false)()
+
+	return u.fieldValues(user.Id)
+}
+
+// SetFieldValues validates and changes the custom field values for a user, such as from an application's profile page.
+// Values for fields not in Users.Fields are ignored.
+func (u *Users) SetFieldValues(user *User, values FieldValues) error {
+
+	for _, fd := range u.Fields {
+		if msg := fd.Check(values[fd.Name]); msg != "" {
+			return fmt.Errorf("%s: %s", fd.Label, msg)
+		}
+	}
+
+	// serialisation
+	defer u.App.Serialise(true)()
+
+	return u.setFieldValues(user.Id, values)
+}
+
+// childFields reads and validates custom fields for a child form.
+// Fields missing from the form, as when the template has been overridden without them, are not included.
+func (u *Users) childFields(f *multiforms.Form, i int, ix int, nItems int) []FieldInput {
+
+	var inputs []FieldInput
+	for _, fd := range u.Fields {
+		if len(f.Values[fd.Name]) != nItems {
+			continue
+		}
+
+		value := strings.TrimSpace(f.Values[fd.Name][i])
+		if ix >= 0 {
+			if msg := fd.Check(value); msg != "" {
+				f.ChildErrors.Add(fd.Name, ix, msg)
+			}
+		}
+		inputs = append(inputs, FieldInput{Field: fd, Value: value})
+	}
+	return inputs
+}
+
+// fieldInputs returns the custom fields and their values, for a form.
+func (u *Users) fieldInputs(values FieldValues, signup bool) []FieldInput {
+
+	var inputs []FieldInput
+	for _, fd := range u.Fields {
+		if fd.Signup || !signup {
+			inputs = append(inputs, FieldInput{Field: fd, Value: values[fd.Name]})
+		}
+	}
+	return inputs
+}
+
+// fieldValues returns the stored custom field values for a user.
+// It must be called with serialisation.
+func (u *Users) fieldValues(userId int64) FieldValues {
+
+	if len(u.Fields) > 0 {
+		if fs, ok := u.Store.(FieldStore); ok {
+			if values, err := fs.Fields(userId); err == nil && values != nil {
+				return values
+			}
+		}
+	}
+	return make(FieldValues)
+}
+
+// formFields reads and validates the custom fields from the sign-up form.
+func (u *Users) formFields(f *multiforms.Form) ([]FieldInput, FieldValues) {
+
+	inputs := u.fieldInputs(nil, true)
+	values := make(FieldValues, len(inputs))
+	for i := range inputs {
+		fd := &inputs[i]
+		fd.Value = strings.TrimSpace(f.Get(fd.Name))
+		if msg := fd.Check(fd.Value); msg != "" {
+			f.Errors.Add(fd.Name, msg)
+		}
+		values[fd.Name] = fd.Value
+	}
+	return inputs, values
+}
+
+// inputValues returns the values from form inputs, merged with current values for fields not on the form.
+func inputValues(inputs []FieldInput, current FieldValues) FieldValues {
+
+	values := make(FieldValues, len(current)+len(inputs))
+	for k, v := range current {
+		values[k] = v
+	}
+	for _, in := range inputs {
+		values[in.Name] = in.Value
+	}
+	return values
+}
+
+// setFieldValues stores custom field values for a user, merged with any current values not specified.
+// It must be called with serialisation.
+func (u *Users) setFieldValues(userId int64, values FieldValues) error {
+
+	if len(u.Fields) == 0 {
+		return nil
+	}
+
+	fs, ok := u.Store.(FieldStore)
+	if !ok {
+		return errors.New("webparts/users: store does not hold custom fields")
+	}
+
+	merged := u.fieldValues(userId)
+	for _, fd := range u.Fields {
+		if v, ok := values[fd.Name]; ok {
+			merged[fd.Name] = v
+		}
+	}
+	return fs.SetFields(userId, merged)
+}
+
+// sameValues returns true if two sets of field values are the same.
+func sameValues(a FieldValues, b FieldValues) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -3,7 +3,10 @@
 package users
 
 import (
+	"fmt"
+	"hash/fnv"
 	"net/url"
+	"strconv"
 
 	"github.com/inchworks/webparts/multiforms"
 )
@@ -14,6 +17,8 @@ type UsersForm struct {
 	StatusOpts []string
 	Children   []*UserFormData
 	App        interface{}
+
+	users *Users
 }
 
 type UserFormData struct {
@@ -23,6 +28,15 @@ type UserFormData struct {
 	NUser       int64
 	Role        int
 	Status      int
+	Version     string // stamp to detect changes by someone else
+
+	Fields []FieldInput // custom fields
+}
+
+// SignupForm is the form for a user to sign up, with any custom fields requested.
+type SignupForm struct {
+	*multiforms.Form
+	Fields []FieldInput
 }
 
 var statusOpts = []string{"suspended", "known", "active"}
@@ -34,6 +48,7 @@ func (u *Users) NewUsersForm(data url.Values, token string) *UsersForm {
 		RoleOpts:   u.Roles,
 		StatusOpts: statusOpts,
 		Children:   make([]*UserFormData, 0, 16),
+		users:      u,
 	}
 }
 
@@ -47,6 +62,7 @@ func (f *UsersForm) Add(index int, u *User) {
 		NUser:       u.Id,
 		Role:        u.Role,
 		Status:      u.Status,
+		Version:     userVersion(u),
 	})
 }
 
@@ -65,6 +81,9 @@ func (f *UsersForm) GetUsers(nRoleOpts int) (items []*UserFormData, err error) {
 
 	nItems := f.NChildItems()
 
+	// version stamps are missing if the form template has been overridden without them
+	versioned := len(f.Values["nUser"]) == nItems && len(f.Values["version"]) == nItems
+
 	for i := 0; i < nItems; i++ {
 
 		ix, err := f.ChildIndex("index", i)
@@ -82,13 +101,19 @@ func (f *UsersForm) GetUsers(nRoleOpts int) (items []*UserFormData, err error) {
 			return nil, err
 		}
 
-		items = append(items, &UserFormData{
+		item := &UserFormData{
 			Child:       multiforms.Child{Parent: &f.Form, ChildIndex: ix},
 			Username:    f.ChildText("username", i, ix, 8, MaxName),
 			DisplayName: f.ChildText("displayName", i, ix, 1, MaxName),
 			Role:        role,
 			Status:      status,
-		})
+			Fields:      f.users.childFields(&f.Form, i, ix, nItems),
+		}
+		if versioned {
+			item.NUser = int64(f.ChildPositive("nUser", i, ix))
+			item.Version = f.ChildText("version", i, ix, 0, 0)
+		}
+		items = append(items, item)
 	}
 
 	// Add the child items back into the form, in case we need to redisplay it
@@ -96,3 +121,38 @@ func (f *UsersForm) GetUsers(nRoleOpts int) (items []*UserFormData, err error) {
 
 	return items, nil
 }
+
+// MarkConflicts highlights the users changed by someone else since the form was rendered.
+func (f *UsersForm) MarkConflicts(changed map[int64]bool) {
+
+	f.Errors.Add("conflict", "Users have been changed by someone else. Check the highlighted users and make your changes again.")
+
+	for _, c := range f.Children {
+		if c.ChildIndex >= 0 && changed[c.NUser] {
+			f.ChildErrors.Add("displayName", c.ChildIndex, "Changed by someone else")
+		}
+	}
+}
+
+// SetVersion records a stamp for the set of users shown in the form.
+func (f *UsersForm) SetVersion(users []*User) {
+	f.Set("usersVersion", usersVersion(users))
+}
+
+// userVersion returns a stamp for the editable details of a user.
+func userVersion(u *User) string {
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d\x00%d", u.Id, u.Username, u.Name, u.Role, u.Status)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// usersVersion returns a stamp for a set of users, changed if users are added or removed.
+func usersVersion(users []*User) string {
+
+	h := fnv.New64a()
+	for _, u := range users {
+		fmt.Fprintf(h, "%d,", u.Id)
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
@@ -7,6 +7,7 @@ package users
 import (
 	"errors"
 	"net/http"
+	"net/url"
 
 	"github.com/inchworks/webparts/multiforms"
 )
@@ -41,6 +42,7 @@ func (u *Users) PostFormLogin(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if u.Store.IsNoRecord(err) || errors.Is(err, ErrInvalidCredentials) {
 			app.LogThreat("login error", r)
+			u.countFailedLogin()
 			f.Errors.Add("generic", "Username or password not known")
 			app.Render(w, r, "user-login.page.tmpl", f)
 
@@ -53,15 +55,22 @@ func (u *Users) PostFormLogin(w http.ResponseWriter, r *http.Request) {
 
 	// add the user ID to the session, so that they are now 'logged in'
 	app.Authenticated(r, user.Id)
+	u.startSession(r)
+	u.notifyLogin(r, user)
 
-	// get redirect path - probably the URL that the user accessed, or the home page (may show more, now logged in)
-	http.Redirect(w, r, app.GetRedirect(r), http.StatusSeeOther)
+	// get redirect path - probably the URL that the user accessed, or the landing page for their role
+	http.Redirect(w, r, u.landing(r, user), http.StatusSeeOther)
 }
 
 // GetFormSignup renders the form for a pre-approved user to sign-up.
 func (u *Users) GetFormSignup(w http.ResponseWriter, r *http.Request) {
 
-	u.App.Render(w, r, "user-signup.page.tmpl", multiforms.New(nil, u.App.Token(r)))
+	f := multiforms.New(make(url.Values), u.App.Token(r))
+	if u.Challenge != nil {
+		u.Challenge.Issue(r, f)
+	}
+
+	u.App.Render(w, r, "user-signup.page.tmpl", &SignupForm{Form: f, Fields: u.fieldInputs(nil, true)})
 }
 
 // PostFormSignup processes the sign-up form.
@@ -83,6 +92,19 @@ func (u *Users) PostFormSignup(w http.ResponseWriter, r *http.Request) {
 	//   form.MatchesPattern("email", forms.EmailRX)
 	f.MinLength("password", 10)
 	f.MaxLength("password", 60)
+	fields, values := u.formFields(f)
+
+	// check that the request isn't automated
+	if u.Challenge != nil {
+		if err := u.Challenge.Verify(r, f); err != nil {
+			if errors.Is(err, errChallenge) {
+				app.LogThreat("signup challenge failed", r)
+			} else {
+				app.Log(err)
+			}
+			f.Errors.Add("challenge", "Sign-up check failed. Please try again.")
+		}
+	}
 
 	// check if username known here
 	// We don't record the username, in case it is a mistake by a legitimate user.
@@ -96,13 +118,17 @@ func (u *Users) PostFormSignup(w http.ResponseWriter, r *http.Request) {
 
 	// If there are any errors, redisplay the signup form.
 	if !f.Valid() {
-		app.Render(w, r, "user-signup.page.tmpl", f)
+		if u.Challenge != nil {
+			u.Challenge.Issue(r, f) // new challenge
+		}
+		app.Render(w, r, "user-signup.page.tmpl", &SignupForm{Form: f, Fields: fields})
 		return
 	}
 
 	// add user
-	err = u.onUserSignup(user, f.Get("displayName"), f.Get("password"))
+	err = u.onUserSignup(user, f.Get("displayName"), f.Get("password"), values)
 	if err == nil {
+		u.notifySignup(user)
 		app.Flash(r, "Your sign-up was successful. Please log in.")
 
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
@@ -116,8 +142,15 @@ func (u *Users) GetFormEdit(w http.ResponseWriter, r *http.Request) {
 
 	app := u.App
 
+	// administrator may be limited to a set of users
+	mgr, err := u.manager(r)
+	if err != nil {
+		u.managerError(w, err)
+		return
+	}
+
 	// form to edit users, and
-	f := u.forEditUsers(app.Token(r))
+	f := u.forEditUsers(mgr, app.Token(r))
 
 	// display form
 	app.Render(w, r, "edit-users.page.tmpl", f)
@@ -134,6 +167,13 @@ func (u *Users) PostFormEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// administrator may be limited to a set of users
+	mgr, err := u.manager(r)
+	if err != nil {
+		u.managerError(w, err)
+		return
+	}
+
 	// process form data
 	f := u.NewUsersForm(r.PostForm, u.App.Token(r))
 	users, err := f.GetUsers(len(u.Roles))
@@ -142,6 +182,31 @@ func (u *Users) PostFormEdit(w http.ResponseWriter, r *http.Request) {
 		u.clientError(w, http.StatusBadRequest)
 		return
 	}
+	if !withinScope(mgr, users) {
+		app.LogThreat("role above scope", r)
+		u.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	// new users, role changes and deletions need a recent password confirmation
+	if f.Valid() && !u.IsElevated(r) && u.isSensitive(mgr, users) {
+		if pwd := f.Get("confirmPassword"); pwd == "" {
+			f.Errors.Add("confirmPassword", "Confirm your password to add users, change roles or delete users")
+
+		} else if err := u.Elevate(r, pwd); err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				app.LogThreat("elevate error", r)
+				f.Errors.Add("confirmPassword", "Password not recognised")
+			} else if errors.Is(err, ErrTooManyAttempts) {
+				app.LogThreat("elevate limit", r)
+				f.Errors.Add("confirmPassword", "Too many attempts, try again later")
+			} else {
+				app.Log(err)
+				u.clientError(w, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
 
 	// redisplay form if data invalid
 	if !f.Valid() {
@@ -150,16 +215,34 @@ func (u *Users) PostFormEdit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// save changes
-	if tx := u.onEditUsers(users); tx != 0 {
+	tx, changed := u.onEditUsers(mgr, users, f.Get("usersVersion"))
+	if tx != 0 {
 		u.TM.DoNext(tx)
 		app.Flash(r, "User changes saved.")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 
+	} else if changed != nil {
+		// users changed by someone else - redisplay current users
+		f := u.forEditUsers(mgr, app.Token(r))
+		f.MarkConflicts(changed)
+		app.Render(w, r, "edit-users.page.tmpl", f)
+
 	} else {
 		u.clientError(w, http.StatusBadRequest)
 	}
 }
 
+// managerError reports a failure to identify the rights of an administrator.
+func (u *Users) managerError(w http.ResponseWriter, err error) {
+
+	if errors.Is(err, errNotManager) {
+		u.clientError(w, http.StatusForbidden)
+	} else {
+		u.App.Log(err)
+		u.clientError(w, http.StatusInternalServerError)
+	}
+}
+
 // clientError request rollback of any updates, and sends a status code and description to the user.
 func (u *Users) clientError(w http.ResponseWriter, status int) {
 
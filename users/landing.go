@@ -0,0 +1,59 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Choice of page after log-in.
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AppLanding is an optional extension to App, to choose the page shown to a user after log-in.
+type AppLanding interface {
+	// Landing returns the next page for a user. redirect is the page from GetRedirect, possibly a deep link.
+	// It may call DefaultLanding for the standard choice.
+	Landing(r *http.Request, user *User, redirect string) string
+}
+
+// DefaultLanding returns the next page after log-in.
+// This is the page the user was trying to access, if their role permits it (see PathRoles),
+// otherwise the landing page for their role (see Landing), or the home page.
+func (u *Users) DefaultLanding(user *User, redirect string) string {
+
+	if redirect != "" && redirect != "/" && u.canAccess(user, redirect) {
+		return redirect
+	}
+
+	if user.Role >= 0 && user.Role < len(u.Landing) && u.Landing[user.Role] != "" {
+		return u.Landing[user.Role]
+	}
+
+	// a page the user may not access is never returned
+	return "/"
+}
+
+// canAccess returns true if the user's role permits access to a path.
+// The longest matching prefix in PathRoles applies.
+func (u *Users) canAccess(user *User, path string) bool {
+
+	min := 0
+	var longest int
+	for prefix, role := range u.PathRoles {
+		if len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			min = role
+			longest = len(prefix)
+		}
+	}
+	return user.Role >= min
+}
+
+// landing returns the next page after a user has logged in.
+func (u *Users) landing(r *http.Request, user *User) string {
+
+	redirect := u.App.GetRedirect(r)
+	if app, ok := u.App.(AppLanding); ok {
+		return app.Landing(r, user, redirect)
+	}
+	return u.DefaultLanding(user, redirect)
+}
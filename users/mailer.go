@@ -0,0 +1,227 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Email notifications to users.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification types, as bits for user preferences.
+const (
+	NotifySignup     = 1 << iota // confirmation of sign-up
+	NotifyPassword               // password reset (always sent)
+	NotifySuspicious             // log-in that the application considers suspicious
+	NotifyNews                   // application notices
+
+	NotifyDefault = NotifySignup | NotifyPassword | NotifySuspicious
+	notifyAlways  = NotifyPassword
+)
+
+// maxSending is the limit on notifications being sent in the background. Any more are dropped.
+const maxSending = 20
+
+// Mailer is the interface to send email to users.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// SMTPMailer sends email via an SMTP server.
+type SMTPMailer struct {
+	Addr     string // server host:port
+	From     string // sender address
+	Username string // for authentication, if needed
+	Password string
+	Timeout  time.Duration // limit on sending each email (default 30 seconds)
+}
+
+// PreferenceStore is an optional extension to UserStore, to hold each user's choice of notifications.
+// Without it, users get the default notifications.
+type PreferenceStore interface {
+	Preferences(userId int64) (int, error)        // notification bits for user
+	SetPreferences(userId int64, prefs int) error // change notifications for user
+}
+
+// AppSuspicious is an optional extension to App, to alert users to unusual log-ins.
+type AppSuspicious interface {
+	// Suspicious returns a description if a log-in is unusual for the user (such as from a new country), or an empty string
+	Suspicious(r *http.Request, user *User) string
+}
+
+// Send sends an email via the SMTP server.
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+
+	// line breaks would allow other headers to be added
+	if strings.ContainsAny(m.From+to+subject, "\r\n") {
+		return errors.New("webparts/users: line break in email header")
+	}
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	// headers, with CRLF line endings
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", m.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	return m.send(conn, host, to, msg)
+}
+
+// send sends an email on a connection to the SMTP server, as for smtp.SendMail.
+func (m *SMTPMailer) send(conn net.Conn, host string, to string, msg string) error {
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(m.From); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Notify sends an email to a user, if they have chosen to receive the type of notification.
+// It is also used by the application, for example to send password reset links.
+func (u *Users) Notify(user *User, kind int, subject string, body string) error {
+
+	if u.Mailer == nil {
+		return nil
+	}
+
+	if kind&notifyAlways == 0 && u.preferences(user)&kind == 0 {
+		return nil
+	}
+
+	return u.Mailer.Send(user.Username, subject, body)
+}
+
+// Preferences returns a user's choice of notifications.
+func (u *Users) Preferences(user *User) int {
+	return u.preferences(user)
+}
+
+// SetPreferences changes a user's choice of notifications. It requires a PreferenceStore.
+func (u *Users) SetPreferences(user *User, prefs int) error {
+
+	ps, ok := u.Store.(PreferenceStore)
+	if !ok {
+		return errors.New("webparts/users: store does not hold preferences")
+	}
+	return ps.SetPreferences(user.Id, prefs)
+}
+
+// notifyLogin alerts a user to a suspicious log-in.
+func (u *Users) notifyLogin(r *http.Request, user *User) {
+
+	app, ok := u.App.(AppSuspicious)
+	if !ok {
+		return
+	}
+
+	if why := app.Suspicious(r, user); why != "" {
+		body := fmt.Sprintf("Hello %s,\n\nThere was a log-in to your account at %s (%s).\nIf this wasn't you, change your password now.\n",
+			user.Name, time.Now().Format("2 Jan 2006 15:04 MST"), why)
+		u.notifyLater(user, NotifySuspicious, "Unusual log-in to your account", body)
+	}
+}
+
+// notifyLater sends a notification in the background, so that a slow mail server doesn't delay a request.
+func (u *Users) notifyLater(user *User, kind int, subject string, body string) {
+
+	if u.Mailer == nil || u.preferences(user)&kind == 0 {
+		return
+	}
+
+	// SERIALISED
+	u.muNotify.Lock()
+	busy := u.sending >= maxSending
+	if !busy {
+		u.sending++
+	}
+	u.muNotify.Unlock()
+
+	if busy {
+		u.App.Log(errors.New("webparts/users: too many notifications, \"" + subject + "\" not sent"))
+		return
+	}
+
+	go func() {
+		if err := u.Mailer.Send(user.Username, subject, body); err != nil {
+			u.App.Log(err)
+		}
+
+		u.muNotify.Lock()
+		u.sending--
+		u.muNotify.Unlock()
+	}()
+}
+
+// notifySignup confirms a user's sign-up.
+func (u *Users) notifySignup(user *User) {
+
+	body := fmt.Sprintf("Hello %s,\n\nYou have signed up successfully, as %s.\n", user.Name, user.Username)
+	u.notifyLater(user, NotifySignup, "Sign-up confirmed", body)
+}
+
+// preferences returns a user's stored notification preferences, or the defaults.
+func (u *Users) preferences(user *User) int {
+
+	if ps, ok := u.Store.(PreferenceStore); ok {
+		if prefs, err := ps.Preferences(user.Id); err == nil {
+			return prefs
+		}
+	}
+	return NotifyDefault
+}
@@ -0,0 +1,78 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Delegated user management, with administrators scoped to a set of users, such as a club.
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errNotManager = errors.New("webparts/users: not permitted to manage users")
+
+// AppScoped is an optional extension to App, needed if Users.AdminRole is set.
+// (An App that implements AppElevated already implements it.)
+type AppScoped interface {
+	// UserId returns the ID of the logged-in user
+	UserId(r *http.Request) int64
+}
+
+// manager returns the logged-in user if their management rights are scoped to users with the same Parent,
+// or nil if they may manage all users.
+func (u *Users) manager(r *http.Request) (*User, error) {
+
+	if u.AdminRole == 0 {
+		return nil, nil // no scoped administrators
+	}
+
+	app, ok := u.App.(AppScoped)
+	if !ok {
+		return nil, errors.New("webparts/users: App must implement AppScoped when AdminRole is set")
+	}
+
+	// serialisation
+	defer u.App.Serialise(false)()
+
+	mgr, err := u.Store.Get(app.UserId(r))
+	if err != nil {
+		return nil, errNotManager
+	}
+	if mgr.Role >= u.AdminRole {
+		return nil, nil
+	}
+	return mgr, nil
+}
+
+// managed returns the users that can be managed, in name order.
+// A scoped administrator cannot see or change users with a higher role than their own.
+// Must be called with serialisation started.
+func (u *Users) managed(mgr *User) []*User {
+
+	all := u.Store.ByName()
+	if mgr == nil {
+		return all
+	}
+
+	var users []*User
+	for _, usr := range all {
+		if usr.Parent == mgr.Parent && usr.Role <= mgr.Role {
+			users = append(users, usr)
+		}
+	}
+	return users
+}
+
+// withinScope returns false if a scoped administrator has given a user a role above their own.
+func withinScope(mgr *User, usSrc []*UserFormData) bool {
+
+	if mgr == nil {
+		return true
+	}
+	for _, uSrc := range usSrc {
+		if uSrc.ChildIndex >= 0 && uSrc.Role > mgr.Role {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+package users
+
+// Idle and absolute limits on the lifetime of a logged-in session.
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/inchworks/webparts/multiforms"
+)
+
+// AppSession is an optional extension to App, needed if Users.IdleTimeout or Users.MaxSession is set.
+type AppSession interface {
+	// LogOut removes the logged-in user from the session
+	LogOut(r *http.Request)
+
+	// SessionTimes returns the time the user logged in and the time of their last request, probably from session keys
+	SessionTimes(r *http.Request) (started time.Time, active time.Time)
+
+	// SetRedirect records the page to be shown after the user logs in again, via the session
+	SetRedirect(r *http.Request, path string)
+
+	// SetSessionTimes records the time the user logged in and the time of their last request, via the session
+	SetSessionTimes(r *http.Request, started time.Time, active time.Time)
+
+	// UserId returns the ID of the logged-in user
+	UserId(r *http.Request) int64
+}
+
+// SessionRemaining returns the time until the logged-in user's session expires, for a template to warn the user.
+// It is zero if no user is logged in, and -1 if sessions do not expire.
+func (u *Users) SessionRemaining(r *http.Request) time.Duration {
+
+	app, ok := u.App.(AppSession)
+	if !ok || (u.IdleTimeout == 0 && u.MaxSession == 0) {
+		return -1
+	}
+	if app.UserId(r) == 0 {
+		return 0
+	}
+
+	started, active := app.SessionTimes(r)
+	now := time.Now()
+	remaining := time.Duration(-1)
+	if u.IdleTimeout > 0 {
+		remaining = active.Add(u.IdleTimeout).Sub(now)
+	}
+	if u.MaxSession > 0 {
+		if max := started.Add(u.MaxSession).Sub(now); remaining < 0 || max < remaining {
+			remaining = max
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// SessionTimeout is middleware that logs out a user whose session has been idle or open for too long.
+// The user is shown a warning page, from which they may log in again and return to the page requested.
+func (u *Users) SessionTimeout(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		app, ok := u.App.(AppSession)
+		if !ok || (u.IdleTimeout == 0 && u.MaxSession == 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		userId := app.UserId(r)
+		if userId == 0 {
+			next.ServeHTTP(w, r) // not logged in
+			return
+		}
+
+		now := time.Now()
+		started, active := app.SessionTimes(r)
+		if started.IsZero() {
+			// session started before limits were set
+			started = now
+			active = now
+		}
+
+		var reason string
+		if u.MaxSession > 0 && now.Sub(started) > u.MaxSession {
+			reason = "Your session has reached its time limit."
+		} else if u.IdleTimeout > 0 && now.Sub(active) > u.IdleTimeout {
+			reason = "Your session has expired because you were inactive."
+		}
+
+		if reason == "" {
+			app.SetSessionTimes(r, started, now)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// log out, and return to the requested page after authentication
+		app.LogOut(r)
+		if r.Method == "GET" {
+			app.SetRedirect(r, r.URL.RequestURI())
+		}
+
+		// offer to log in again, as the same user
+		f := multiforms.New(make(url.Values), u.App.Token(r))
+		if user, err := u.Store.Get(userId); err == nil {
+			f.Set("username", user.Username)
+		}
+		f.Errors.Add("generic", reason+" Please log in again.")
+		u.App.Render(w, r, "user-expired.page.tmpl", f)
+	})
+}
+
+// startSession records the start of a logged-in session.
+func (u *Users) startSession(r *http.Request) {
+
+	if app, ok := u.App.(AppSession); ok {
+		now := time.Now()
+		app.SetSessionTimes(r, now, now)
+	}
+}
@@ -6,6 +6,7 @@ package users
 import (
 	"embed"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/inchworks/webparts/etx"
@@ -19,7 +20,8 @@ type App interface {
 	// Flash adds a confirmation message to the next page, via the session
 	Flash(r *http.Request, msg string)
 
-	// GetRedirect returns the next page after log-in, probably from a session key
+	// GetRedirect returns the next page after log-in, probably from a session key.
+	// (Implement AppLanding to choose the page according to the user.)
 	GetRedirect(r *http.Request) string
 
 	// Log optionally records an error
@@ -84,12 +86,40 @@ type UserStore interface {
 }
 
 // Users holds the dependencies of this package on the parent application.
-// It has no state of its own.
+// Apart from counts for the digest of account events, failed password confirmations and notifications being sent,
+// it has no state of its own.
 type Users struct {
-	App   App
-	Roles []string
-	Store UserStore
-	TM    *etx.TM
+	App         App
+	AdminRole   int            // optional minimum role to manage all users, with lower roles limited to users with the same Parent
+	Challenge   Challenge      // optional check on sign-up requests
+	DigestEvery time.Duration  // optional interval for a digest of account events to administrators, requiring Mailer and TM
+	DigestRole  int            // minimum role to receive the digest (default AdminRole, or the highest role)
+	ElevatedFor time.Duration  // time allowed for sensitive changes after confirming password (0 for no check)
+	Fields      []Field        // optional application-defined profile fields, requiring a FieldStore
+	IdleTimeout time.Duration  // optional log-out after inactivity, requiring AppSession
+	Landing     []string       // optional page after log-in for each role, indexed by role
+	Mailer      Mailer         // optional email to users
+	MaxSession  time.Duration  // optional log-out after a fixed time since log-in, requiring AppSession
+	PathRoles   map[string]int // optional minimum role for path prefixes, to check the page requested before log-in
+	Roles       []string
+	Store       UserStore
+	TM          *etx.TM
+
+	// digest state
+	muDigest     sync.Mutex
+	digestTx     etx.TxId
+	failed       int // failed log-ins since the last digest
+	failedPeak   int // highest number of failed log-ins in an hour
+	failedHour   time.Time
+	failedInHour int
+
+	// failed password confirmations for elevated privileges, by user ID
+	muElevate   sync.Mutex
+	elevateFail map[int64]elevateFails
+
+	// notifications being sent in the background
+	muNotify sync.Mutex
+	sending  int
 }
 
 // WebFiles are the package's web resources (templates and static files)
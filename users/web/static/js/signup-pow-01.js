@@ -0,0 +1,47 @@
+// Copyright © Rob Burke inchworks.com, 2021.
+
+// Client-side proof of work for the sign-up form.
+
+// Find a nonce giving a hash of the challenge with the required leading zero bits.
+// The submit button is disabled until the work is done.
+
+jQuery(document).ready(function() {
+
+    var $challenge = $('input[name="powChallenge"]');
+    if ($challenge.length == 0)
+        return;
+
+    var $submit = $challenge.closest('form').find('button[type="submit"]');
+    $submit.prop("disabled", true);
+
+    var challenge = $challenge.val();
+    var difficulty = Number(challenge.split(".")[2]);
+
+    solve(challenge, difficulty).then(function(nonce) {
+        $('input[name="powNonce"]').val(nonce);
+        $submit.prop("disabled", false);
+    });
+});
+
+// Try successive nonces. Hashing is asynchronous, so the page stays responsive.
+async function solve(challenge, difficulty) {
+    var encoder = new TextEncoder();
+    for (var nonce = 0; ; nonce++) {
+        var h = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce));
+        if (leadingZeros(new Uint8Array(h)) >= difficulty)
+            return String(nonce);
+    }
+}
+
+// Count leading zero bits.
+function leadingZeros(h) {
+    var n = 0;
+    for (var i = 0; i < h.length; i++) {
+        if (h[i] == 0) {
+            n += 8;
+            continue;
+        }
+        return n + Math.clz32(h[i]) - 24;
+    }
+    return n;
+}